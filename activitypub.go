@@ -0,0 +1,920 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/rs/zerolog"
+
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/id"
+)
+
+const (
+	activityPubPrefix = "/_feedserv/activitypub/"
+	webFingerPath     = "/.well-known/webfinger"
+
+	ActivityJSONMime = "application/activity+json"
+	JRDMime          = "application/jrd+json"
+
+	activityStreamsContext = "https://www.w3.org/ns/activitystreams"
+	securityContext        = "https://w3id.org/security/v1"
+	activityStreamsPublic  = "https://www.w3.org/ns/activitystreams#Public"
+
+	followersAccountDataType = "com.beeper.feedserv.activitypub_followers"
+
+	maxInboxBodySize    = 1024 * 1024
+	maxDeliveryAttempts = 3
+
+	// pollUpdateDelay is how long votes are collected before the updated poll is sent to followers.
+	pollUpdateDelay = 5 * time.Minute
+)
+
+type ActivityPubConfig struct {
+	Enabled        bool   `yaml:"enabled"`
+	PrivateKeyPath string `yaml:"private_key_path"`
+}
+
+type apPublicKey struct {
+	ID           string `json:"id"`
+	Owner        string `json:"owner"`
+	PublicKeyPEM string `json:"publicKeyPem"`
+}
+
+type apEndpoints struct {
+	SharedInbox string `json:"sharedInbox,omitempty"`
+}
+
+type apImage struct {
+	Type string `json:"type"`
+	URL  string `json:"url"`
+}
+
+type apActor struct {
+	Context                   any          `json:"@context,omitempty"`
+	ID                        string       `json:"id"`
+	Type                      string       `json:"type"`
+	PreferredUsername         string       `json:"preferredUsername"`
+	Name                      string       `json:"name,omitempty"`
+	Summary                   string       `json:"summary,omitempty"`
+	URL                       string       `json:"url,omitempty"`
+	Icon                      *apImage     `json:"icon,omitempty"`
+	Inbox                     string       `json:"inbox"`
+	Outbox                    string       `json:"outbox"`
+	Followers                 string       `json:"followers"`
+	ManuallyApprovesFollowers bool         `json:"manuallyApprovesFollowers"`
+	Discoverable              bool         `json:"discoverable"`
+	PublicKey                 *apPublicKey `json:"publicKey"`
+}
+
+// apRemoteActor contains the fields of remote actors (or standalone key objects) that are needed for following.
+type apRemoteActor struct {
+	ID           string       `json:"id"`
+	Inbox        string       `json:"inbox"`
+	Endpoints    apEndpoints  `json:"endpoints"`
+	PublicKey    *apPublicKey `json:"publicKey"`
+	Owner        string       `json:"owner"`
+	PublicKeyPEM string       `json:"publicKeyPem"`
+
+	key *rsa.PublicKey
+}
+
+type apAttachment struct {
+	Type      string `json:"type"`
+	MediaType string `json:"mediaType,omitempty"`
+	URL       string `json:"url"`
+	Name      string `json:"name,omitempty"`
+	Width     int    `json:"width,omitempty"`
+	Height    int    `json:"height,omitempty"`
+}
+
+type apObject struct {
+	Context      any               `json:"@context,omitempty"`
+	ID           string            `json:"id"`
+	Type         string            `json:"type"`
+	AttributedTo string            `json:"attributedTo,omitempty"`
+	Content      string            `json:"content,omitempty"`
+	ContentMap   map[string]string `json:"contentMap,omitempty"`
+	URL          string            `json:"url,omitempty"`
+	Published    string            `json:"published,omitempty"`
+	Updated      string            `json:"updated,omitempty"`
+	To           []string          `json:"to,omitempty"`
+	CC           []string          `json:"cc,omitempty"`
+	Attachment   []apAttachment    `json:"attachment,omitempty"`
+}
+
+type apActivity struct {
+	Context   any      `json:"@context,omitempty"`
+	ID        string   `json:"id"`
+	Type      string   `json:"type"`
+	Actor     string   `json:"actor"`
+	Published string   `json:"published,omitempty"`
+	To        []string `json:"to,omitempty"`
+	CC        []string `json:"cc,omitempty"`
+	Object    any      `json:"object"`
+}
+
+type apIncomingActivity struct {
+	ID     string          `json:"id"`
+	Type   string          `json:"type"`
+	Actor  json.RawMessage `json:"actor"`
+	Object json.RawMessage `json:"object"`
+}
+
+type apCollection struct {
+	Context      any           `json:"@context,omitempty"`
+	ID           string        `json:"id"`
+	Type         string        `json:"type"`
+	TotalItems   int           `json:"totalItems"`
+	OrderedItems []*apActivity `json:"orderedItems,omitempty"`
+}
+
+type webFingerLink struct {
+	Rel  string `json:"rel"`
+	Type string `json:"type,omitempty"`
+	Href string `json:"href"`
+}
+
+type webFingerResponse struct {
+	Subject string          `json:"subject"`
+	Aliases []string        `json:"aliases,omitempty"`
+	Links   []webFingerLink `json:"links"`
+}
+
+type apFollower struct {
+	Actor       string `json:"actor"`
+	Inbox       string `json:"inbox"`
+	SharedInbox string `json:"shared_inbox,omitempty"`
+}
+
+type apFollowerStore struct {
+	Followers map[string][]apFollower `json:"followers"`
+}
+
+type apDelivery struct {
+	feed  *FeedConfig
+	inbox string
+	body  []byte
+}
+
+// ActivityPub exposes feeds as ActivityPub actors that fediverse users can follow.
+type ActivityPub struct {
+	fs  *FeedServ
+	Log zerolog.Logger
+
+	key          *rsa.PrivateKey
+	publicKeyPEM string
+	domain       string
+	actors       map[string]*FeedConfig
+
+	followers     apFollowerStore
+	followersLock sync.Mutex
+	remoteActors  sync.Map
+	deliveries    chan apDelivery
+	// deliveriesLock guards closing the delivery queue, as poll update timers may still queue activities.
+	deliveriesLock    sync.RWMutex
+	deliveriesStopped bool
+	client            *http.Client
+
+	pollUpdates     map[pendingPollUpdate]*time.Timer
+	pollUpdatesLock sync.Mutex
+}
+
+type pendingPollUpdate struct {
+	feed   *FeedConfig
+	pollID id.EventID
+}
+
+var errNonPublicAddress = errors.New("refusing to connect to non-public address")
+
+// isPublicIP returns false for loopback, private, link-local and other addresses that aren't reachable on the internet.
+func isPublicIP(ip net.IP) bool {
+	return !ip.IsLoopback() && !ip.IsPrivate() && !ip.IsLinkLocalUnicast() && !ip.IsLinkLocalMulticast() &&
+		!ip.IsInterfaceLocalMulticast() && !ip.IsMulticast() && !ip.IsUnspecified()
+}
+
+// newPublicHTTPClient returns a HTTP client that only connects to public addresses, so that remote servers can't
+// make feedserv send requests to internal services through key IDs or inbox URLs. The addresses are checked after
+// resolving the host name and on every redirect. Proxies aren't used, as they would bypass the check.
+func newPublicHTTPClient(timeout time.Duration) *http.Client {
+	dialer := &net.Dialer{
+		Timeout:   timeout,
+		KeepAlive: 30 * time.Second,
+		Control: func(_, address string, _ syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			} else if ip := net.ParseIP(host); ip == nil || !isPublicIP(ip) {
+				return fmt.Errorf("%w %s", errNonPublicAddress, host)
+			}
+			return nil
+		},
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = nil
+	transport.DialContext = dialer.DialContext
+	return &http.Client{Timeout: timeout, Transport: transport}
+}
+
+func NewActivityPub(cfg *ActivityPubConfig, fs *FeedServ, log zerolog.Logger) (*ActivityPub, error) {
+	if cfg.PrivateKeyPath == "" {
+		cfg.PrivateKeyPath = "activitypub.pem"
+	}
+	publicURL, err := url.Parse(fs.Config.PublicURL)
+	if err != nil || publicURL.Host == "" {
+		return nil, fmt.Errorf("public_url must be an absolute URL for ActivityPub")
+	}
+	ap := &ActivityPub{
+		fs:         fs,
+		Log:        log,
+		domain:     publicURL.Host,
+		actors:     make(map[string]*FeedConfig),
+		deliveries: make(chan apDelivery, 1024),
+		client:     newPublicHTTPClient(30 * time.Second),
+
+		pollUpdates: make(map[pendingPollUpdate]*time.Timer),
+	}
+	ap.key, err = loadOrGenerateKey(cfg.PrivateKeyPath)
+	if err != nil {
+		return nil, err
+	}
+	ap.publicKeyPEM, err = encodePublicKey(&ap.key.PublicKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode public key: %w", err)
+	}
+	for feedID, feed := range fs.Config.Feeds {
+		if !feed.Private {
+			ap.actors[actorUsername(feedID)] = feed
+		}
+	}
+	err = fs.Client.GetAccountData(followersAccountDataType, &ap.followers)
+	if err != nil && !errors.Is(err, mautrix.MNotFound) {
+		return nil, fmt.Errorf("failed to load followers: %w", err)
+	}
+	if ap.followers.Followers == nil {
+		ap.followers.Followers = make(map[string][]apFollower)
+	}
+	return ap, nil
+}
+
+// actorUsername converts a feed ID into a username, e.g. /example becomes example and /foo/bar becomes foo.bar.
+func actorUsername(feedID string) string {
+	return strings.ReplaceAll(strings.TrimPrefix(feedID, "/"), "/", ".")
+}
+
+func randomID() string {
+	data := make([]byte, 16)
+	_, _ = rand.Read(data)
+	return hex.EncodeToString(data)
+}
+
+// apObjectID returns the ID of an object that may be either a plain string or an object with an id field.
+func apObjectID(raw json.RawMessage) string {
+	var objectID string
+	if json.Unmarshal(raw, &objectID) == nil {
+		return objectID
+	}
+	var object struct {
+		ID string `json:"id"`
+	}
+	_ = json.Unmarshal(raw, &object)
+	return object.ID
+}
+
+func (ap *ActivityPub) actorURL(feed *FeedConfig) string {
+	return ap.fs.Config.PublicURL + activityPubPrefix + "actors/" + actorUsername(feed.id)
+}
+
+func (ap *ActivityPub) keyID(feed *FeedConfig) string {
+	return ap.actorURL(feed) + "#main-key"
+}
+
+func (ap *ActivityPub) noteURL(feed *FeedConfig, eventID id.EventID) string {
+	return ap.actorURL(feed) + "/notes/" + url.PathEscape(eventID.String())
+}
+
+func (ap *ActivityPub) profileURL(feed *FeedConfig) string {
+	if feed.HTML {
+		return ap.fs.Config.PublicURL + feed.id + ".html"
+	}
+	return ap.fs.Config.PublicURL + feed.id
+}
+
+// makeActor builds the actor document of a feed. The caller must hold the update lock of the feed.
+func (ap *ActivityPub) makeActor(feed *FeedConfig) *apActor {
+	actorURL := ap.actorURL(feed)
+	actor := &apActor{
+		Context:           []string{activityStreamsContext, securityContext},
+		ID:                actorURL,
+		Type:              "Service",
+		PreferredUsername: actorUsername(feed.id),
+		Name:              feed.title,
+		Summary:           escapeHTMLText(feed.description),
+		URL:               ap.profileURL(feed),
+		Inbox:             actorURL + "/inbox",
+		Outbox:            actorURL + "/outbox",
+		Followers:         actorURL + "/followers",
+		Discoverable:      true,
+		PublicKey: &apPublicKey{
+			ID:           ap.keyID(feed),
+			Owner:        actorURL,
+			PublicKeyPEM: ap.publicKeyPEM,
+		},
+	}
+	if feed.icon != "" {
+		actor.Icon = &apImage{Type: "Image", URL: feed.icon}
+	}
+	return actor
+}
+
+func (ap *ActivityPub) makeNote(feed *FeedConfig, entry feedEntry) *apObject {
+	rendered := ap.fs.renderContent(entry)
+	content := string(ap.fs.sanitizeHTML(ap.fs.renderEntryHTML(entry, rendered, true)))
+	note := &apObject{
+		ID:           ap.noteURL(feed, entry.ID),
+		Type:         "Note",
+		AttributedTo: ap.actorURL(feed),
+		Content:      content,
+		URL:          entry.RoomID.EventURI(entry.ID, ap.fs.Config.homeserverDomain).MatrixToURL(),
+		Published:    time.UnixMilli(entry.Timestamp).UTC().Format(time.RFC3339),
+		To:           []string{activityStreamsPublic},
+		CC:           []string{ap.actorURL(feed) + "/followers"},
+	}
+	if entry.language != "" {
+		note.ContentMap = map[string]string{entry.language: content}
+	}
+	if !entry.Mautrix.EditedAt.IsZero() {
+		note.Updated = entry.Mautrix.EditedAt.Format(time.RFC3339)
+	}
+	for _, attachment := range ap.fs.getEntryAttachments(entry) {
+		note.Attachment = append(note.Attachment, apAttachment{
+			Type:      "Document",
+			MediaType: attachment.Media.MimeType,
+			URL:       attachment.Media.URL,
+			Name:      attachment.Media.Title,
+			Width:     attachment.Media.Width,
+			Height:    attachment.Media.Height,
+		})
+	}
+	return note
+}
+
+func (ap *ActivityPub) makeCreateActivity(note *apObject) *apActivity {
+	return &apActivity{
+		ID:        note.ID + "/activity",
+		Type:      "Create",
+		Actor:     note.AttributedTo,
+		Published: note.Published,
+		To:        note.To,
+		CC:        note.CC,
+		Object:    note,
+	}
+}
+
+// QueueEntryChange sends a Create, Update or Delete activity to the followers of the feed and any aggregate
+// feeds that include it, depending on how the entry changed. The caller must hold the update lock of the feed.
+func (ap *ActivityPub) QueueEntryChange(feed *FeedConfig, change feedChange, entryID id.EventID) {
+	evt, found := feed.entries.Get(entryID)
+	if !found {
+		return
+	}
+	if isPollStart(evt.Type) && change == feedChangeUpdate {
+		ap.schedulePollUpdate(feed, entryID)
+		return
+	}
+	entry := feed.makeEntry(evt)
+	if isPollStart(evt.Type) && change == feedChangeAdd {
+		feed.getPollState(entryID).federatedText = ap.fs.renderContent(entry).Text
+	}
+	ap.queueEntryActivities(feed, change, entry)
+}
+
+// schedulePollUpdate sends an update of the poll after a delay, so that a burst of votes only results in one
+// activity per follower instead of one per vote. The caller must hold the update lock of the feed.
+func (ap *ActivityPub) schedulePollUpdate(feed *FeedConfig, pollID id.EventID) {
+	key := pendingPollUpdate{feed: feed, pollID: pollID}
+	ap.pollUpdatesLock.Lock()
+	defer ap.pollUpdatesLock.Unlock()
+	if _, alreadyScheduled := ap.pollUpdates[key]; alreadyScheduled {
+		return
+	}
+	ap.pollUpdates[key] = time.AfterFunc(pollUpdateDelay, func() {
+		ap.sendPollUpdate(key)
+	})
+}
+
+// sendPollUpdate sends the current state of the poll to followers, unless the rendered poll hasn't changed
+// since it was last sent, like when votes are cast in a poll whose results are only shown after it ends.
+func (ap *ActivityPub) sendPollUpdate(key pendingPollUpdate) {
+	ap.pollUpdatesLock.Lock()
+	delete(ap.pollUpdates, key)
+	ap.pollUpdatesLock.Unlock()
+	key.feed.updateLock.Lock()
+	defer key.feed.updateLock.Unlock()
+	evt, found := key.feed.entries.Get(key.pollID)
+	if !found || evt.Unsigned.RedactedBecause != nil {
+		return
+	}
+	entry := key.feed.makeEntry(evt)
+	state := key.feed.getPollState(key.pollID)
+	text := ap.fs.renderContent(entry).Text
+	if text == state.federatedText {
+		return
+	}
+	state.federatedText = text
+	ap.queueEntryActivities(key.feed, feedChangeUpdate, entry)
+}
+
+// queueEntryActivities sends the change of the entry to the followers of the feed and the aggregate feeds containing it.
+// The caller must hold the update lock of the feed.
+func (ap *ActivityPub) queueEntryActivities(feed *FeedConfig, change feedChange, entry feedEntry) {
+	entryID := entry.ID
+	for _, actorFeed := range append([]*FeedConfig{feed}, feed.aggregates...) {
+		if actorFeed.hidden || actorFeed.Private {
+			continue
+		}
+		var activity *apActivity
+		switch change {
+		case feedChangeAdd:
+			activity = ap.makeCreateActivity(ap.makeNote(actorFeed, entry))
+		case feedChangeUpdate:
+			note := ap.makeNote(actorFeed, entry)
+			activity = &apActivity{
+				ID:     note.ID + "#update-" + randomID(),
+				Type:   "Update",
+				Actor:  note.AttributedTo,
+				To:     note.To,
+				CC:     note.CC,
+				Object: note,
+			}
+		case feedChangeRemove:
+			activity = &apActivity{
+				ID:     ap.noteURL(actorFeed, entryID) + "#delete",
+				Type:   "Delete",
+				Actor:  ap.actorURL(actorFeed),
+				To:     []string{activityStreamsPublic},
+				Object: &apObject{ID: ap.noteURL(actorFeed, entryID), Type: "Tombstone"},
+			}
+		default:
+			return
+		}
+		ap.queueActivity(actorFeed, activity)
+	}
+}
+
+// QueueActorUpdate sends the updated actor document to followers after the feed metadata changes.
+// The caller must hold the update lock of the feed.
+func (ap *ActivityPub) QueueActorUpdate(feed *FeedConfig) {
+	if feed.hidden || feed.Private {
+		return
+	}
+	actor := ap.makeActor(feed)
+	actor.Context = nil
+	ap.queueActivity(feed, &apActivity{
+		ID:     actor.ID + "#update-" + randomID(),
+		Type:   "Update",
+		Actor:  actor.ID,
+		To:     []string{activityStreamsPublic},
+		Object: actor,
+	})
+}
+
+func (ap *ActivityPub) queueActivity(feed *FeedConfig, activity *apActivity) {
+	activity.Context = activityStreamsContext
+	body, err := json.Marshal(activity)
+	if err != nil {
+		ap.Log.Err(err).Str("feed_id", feed.id).Msg("Failed to marshal activity")
+		return
+	}
+	for _, inbox := range ap.getFollowerInboxes(feed) {
+		ap.queueDelivery(apDelivery{feed: feed, inbox: inbox, body: body})
+	}
+}
+
+func (ap *ActivityPub) queueDelivery(delivery apDelivery) {
+	ap.deliveriesLock.RLock()
+	defer ap.deliveriesLock.RUnlock()
+	if ap.deliveriesStopped {
+		ap.Log.Warn().
+			Str("feed_id", delivery.feed.id).
+			Str("inbox", delivery.inbox).
+			Msg("Delivery queue is closed, dropping activity")
+		return
+	}
+	select {
+	case ap.deliveries <- delivery:
+	default:
+		ap.Log.Warn().
+			Str("feed_id", delivery.feed.id).
+			Str("inbox", delivery.inbox).
+			Msg("Delivery queue is full, dropping activity")
+	}
+}
+
+// getFollowerInboxes returns the inboxes to deliver activities to, preferring shared inboxes
+// so that each server only receives one copy.
+func (ap *ActivityPub) getFollowerInboxes(feed *FeedConfig) []string {
+	ap.followersLock.Lock()
+	defer ap.followersLock.Unlock()
+	seen := make(map[string]struct{})
+	var inboxes []string
+	for _, follower := range ap.followers.Followers[feed.id] {
+		inbox := follower.SharedInbox
+		if inbox == "" {
+			inbox = follower.Inbox
+		}
+		if _, alreadySeen := seen[inbox]; !alreadySeen {
+			seen[inbox] = struct{}{}
+			inboxes = append(inboxes, inbox)
+		}
+	}
+	return inboxes
+}
+
+// RunDeliveries delivers queued activities until StopDeliveries is called and the queue is empty,
+// or until the context is canceled.
+func (ap *ActivityPub) RunDeliveries(ctx context.Context) {
+	for delivery := range ap.deliveries {
+		if ctx.Err() != nil {
+			return
+		}
+		ap.deliver(ctx, delivery)
+	}
+}
+
+// StopDeliveries sends pending poll updates immediately and closes the delivery queue.
+// Activities queued after this are dropped.
+func (ap *ActivityPub) StopDeliveries() {
+	ap.pollUpdatesLock.Lock()
+	var pending []pendingPollUpdate
+	for key, timer := range ap.pollUpdates {
+		// Timers that already fired are sending the update themselves
+		if timer.Stop() {
+			pending = append(pending, key)
+		}
+	}
+	ap.pollUpdatesLock.Unlock()
+	for _, key := range pending {
+		ap.sendPollUpdate(key)
+	}
+	ap.deliveriesLock.Lock()
+	ap.deliveriesStopped = true
+	close(ap.deliveries)
+	ap.deliveriesLock.Unlock()
+}
+
+func (ap *ActivityPub) deliver(ctx context.Context, delivery apDelivery) {
+	log := ap.Log.With().Str("feed_id", delivery.feed.id).Str("inbox", delivery.inbox).Logger()
+	for attempt := 1; attempt <= maxDeliveryAttempts; attempt++ {
+		err := ap.postActivity(ctx, delivery)
+		if err == nil {
+			log.Debug().Msg("Delivered activity")
+			return
+		}
+		log.Warn().Err(err).Int("attempt", attempt).Msg("Failed to deliver activity")
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(time.Duration(attempt) * 5 * time.Second):
+		}
+	}
+	log.Error().Msg("Giving up on delivering activity")
+}
+
+func (ap *ActivityPub) postActivity(ctx context.Context, delivery apDelivery) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, delivery.inbox, bytes.NewReader(delivery.body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", ActivityJSONMime)
+	req.Header.Set("Accept", ActivityJSONMime)
+	if err = signRequest(req, delivery.body, ap.keyID(delivery.feed), ap.key); err != nil {
+		return err
+	}
+	resp, err := ap.client.Do(req)
+	if err != nil {
+		return err
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("unexpected status code %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// getRemoteActor fetches the actor that owns the given key ID. Actors are cached in memory,
+// unless refresh is set (e.g. when a signature didn't verify because the key was rotated).
+func (ap *ActivityPub) getRemoteActor(ctx context.Context, feed *FeedConfig, keyID string, refresh bool) (*apRemoteActor, error) {
+	if cached, ok := ap.remoteActors.Load(keyID); ok && !refresh {
+		return cached.(*apRemoteActor), nil
+	}
+	actor, err := ap.fetchRemoteObject(ctx, feed, keyID)
+	if err != nil {
+		return nil, err
+	}
+	var keyPEM string
+	if actor.PublicKeyPEM != "" && actor.Owner != "" {
+		// The key ID pointed at a standalone key object rather than the actor
+		keyPEM = actor.PublicKeyPEM
+		owner := actor.Owner
+		if actor, err = ap.fetchRemoteObject(ctx, feed, owner); err != nil {
+			return nil, err
+		} else if actor.ID != owner {
+			return nil, fmt.Errorf("key owner ID mismatch")
+		}
+	} else if actor.PublicKey == nil || actor.PublicKey.ID != keyID || actor.PublicKey.Owner != actor.ID {
+		return nil, fmt.Errorf("actor doesn't own key %s", keyID)
+	} else {
+		keyPEM = actor.PublicKey.PublicKeyPEM
+	}
+	if actor.Inbox == "" {
+		return nil, fmt.Errorf("actor doesn't have an inbox")
+	}
+	actor.key, err = parsePublicKey(keyPEM)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse public key: %w", err)
+	}
+	ap.remoteActors.Store(keyID, actor)
+	return actor, nil
+}
+
+func (ap *ActivityPub) fetchRemoteObject(ctx context.Context, feed *FeedConfig, objectURL string) (*apRemoteActor, error) {
+	parsedURL, err := url.Parse(objectURL)
+	if err != nil || parsedURL.Scheme != "https" || parsedURL.Host == "" {
+		return nil, fmt.Errorf("invalid object URL %q", objectURL)
+	}
+	parsedURL.Fragment = ""
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, parsedURL.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", ActivityJSONMime)
+	if err = signRequest(req, nil, ap.keyID(feed), ap.key); err != nil {
+		return nil, err
+	}
+	resp, err := ap.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status code %d fetching %s", resp.StatusCode, parsedURL)
+	}
+	var object apRemoteActor
+	if err = json.NewDecoder(io.LimitReader(resp.Body, maxInboxBodySize)).Decode(&object); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %w", parsedURL, err)
+	}
+	return &object, nil
+}
+
+func (ap *ActivityPub) saveFollowers() error {
+	return ap.fs.Client.SetAccountData(followersAccountDataType, &ap.followers)
+}
+
+func (ap *ActivityPub) addFollower(feed *FeedConfig, actor *apRemoteActor) error {
+	ap.followersLock.Lock()
+	defer ap.followersLock.Unlock()
+	followers := ap.followers.Followers[feed.id]
+	for i, follower := range followers {
+		if follower.Actor == actor.ID {
+			followers = append(followers[:i], followers[i+1:]...)
+			break
+		}
+	}
+	ap.followers.Followers[feed.id] = append(followers, apFollower{
+		Actor:       actor.ID,
+		Inbox:       actor.Inbox,
+		SharedInbox: actor.Endpoints.SharedInbox,
+	})
+	return ap.saveFollowers()
+}
+
+func (ap *ActivityPub) removeFollower(feed *FeedConfig, actorID string) error {
+	ap.followersLock.Lock()
+	defer ap.followersLock.Unlock()
+	followers := ap.followers.Followers[feed.id]
+	for i, follower := range followers {
+		if follower.Actor == actorID {
+			ap.followers.Followers[feed.id] = append(followers[:i], followers[i+1:]...)
+			return ap.saveFollowers()
+		}
+	}
+	return nil
+}
+
+func (ap *ActivityPub) countFollowers(feed *FeedConfig) int {
+	ap.followersLock.Lock()
+	defer ap.followersLock.Unlock()
+	return len(ap.followers.Followers[feed.id])
+}
+
+func writeActivityJSON(w http.ResponseWriter, mime string, data any) {
+	w.Header().Add("Content-Type", mime)
+	w.Header().Add("Cache-Control", "public, max-age=60")
+	w.WriteHeader(http.StatusOK)
+	_ = json.NewEncoder(w).Encode(data)
+}
+
+func (ap *ActivityPub) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == webFingerPath {
+		ap.serveWebFinger(w, r)
+		return
+	}
+	name, subPath, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, activityPubPrefix+"actors/"), "/")
+	feed, ok := ap.actors[name]
+	if !ok {
+		writeError(w, http.StatusNotFound, "Actor not found")
+		return
+	}
+	subPath, arg, _ := strings.Cut(subPath, "/")
+	if subPath == "inbox" {
+		if r.Method != http.MethodPost {
+			w.Header().Add("Allow", "POST")
+			writeError(w, http.StatusMethodNotAllowed, "Unsupported method %q", r.Method)
+			return
+		}
+		ap.handleInbox(w, r, feed)
+		return
+	} else if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Add("Allow", "GET, HEAD")
+		writeError(w, http.StatusMethodNotAllowed, "Unsupported method %q", r.Method)
+		return
+	}
+	switch subPath {
+	case "":
+		feed.updateLock.RLock()
+		actor := ap.makeActor(feed)
+		feed.updateLock.RUnlock()
+		writeActivityJSON(w, ActivityJSONMime, actor)
+	case "outbox":
+		ap.serveOutbox(w, feed)
+	case "followers":
+		writeActivityJSON(w, ActivityJSONMime, &apCollection{
+			Context:    activityStreamsContext,
+			ID:         ap.actorURL(feed) + "/followers",
+			Type:       "OrderedCollection",
+			TotalItems: ap.countFollowers(feed),
+		})
+	case "notes":
+		ap.serveNote(w, feed, id.EventID(arg))
+	default:
+		writeError(w, http.StatusNotFound, "Unknown endpoint")
+	}
+}
+
+func (ap *ActivityPub) serveWebFinger(w http.ResponseWriter, r *http.Request) {
+	resource := r.URL.Query().Get("resource")
+	var name string
+	if acct, ok := strings.CutPrefix(resource, "acct:"); ok {
+		var domain string
+		name, domain, _ = strings.Cut(acct, "@")
+		if !strings.EqualFold(domain, ap.domain) {
+			writeError(w, http.StatusNotFound, "Unknown domain")
+			return
+		}
+	} else {
+		name, _ = strings.CutPrefix(resource, ap.fs.Config.PublicURL+activityPubPrefix+"actors/")
+	}
+	feed, ok := ap.actors[strings.ToLower(name)]
+	if !ok {
+		writeError(w, http.StatusNotFound, "Actor not found")
+		return
+	}
+	actorURL := ap.actorURL(feed)
+	writeActivityJSON(w, JRDMime, &webFingerResponse{
+		Subject: fmt.Sprintf("acct:%s@%s", actorUsername(feed.id), ap.domain),
+		Aliases: []string{actorURL},
+		Links: []webFingerLink{
+			{Rel: "self", Type: ActivityJSONMime, Href: actorURL},
+			{Rel: "http://webfinger.net/rel/profile-page", Type: "text/html", Href: ap.profileURL(feed)},
+		},
+	})
+}
+
+func (ap *ActivityPub) serveOutbox(w http.ResponseWriter, feed *FeedConfig) {
+	feed.updateLock.RLock()
+	entries := feed.getEntries()
+	items := make([]*apActivity, len(entries))
+	for i, entry := range entries {
+		items[i] = ap.makeCreateActivity(ap.makeNote(feed, entry))
+	}
+	feed.updateLock.RUnlock()
+	writeActivityJSON(w, ActivityJSONMime, &apCollection{
+		Context:      activityStreamsContext,
+		ID:           ap.actorURL(feed) + "/outbox",
+		Type:         "OrderedCollection",
+		TotalItems:   len(items),
+		OrderedItems: items,
+	})
+}
+
+func (ap *ActivityPub) serveNote(w http.ResponseWriter, feed *FeedConfig, eventID id.EventID) {
+	feed.updateLock.RLock()
+	var note *apObject
+	for _, entry := range feed.getEntries() {
+		if entry.ID == eventID {
+			note = ap.makeNote(feed, entry)
+			break
+		}
+	}
+	feed.updateLock.RUnlock()
+	if note == nil {
+		writeError(w, http.StatusNotFound, "Note not found")
+		return
+	}
+	note.Context = activityStreamsContext
+	writeActivityJSON(w, ActivityJSONMime, note)
+}
+
+// handleInbox processes activities sent to a feed actor. Only follows and unfollows are handled,
+// and every request must be signed by the actor that sent the activity.
+func (ap *ActivityPub) handleInbox(w http.ResponseWriter, r *http.Request, feed *FeedConfig) {
+	log := ap.Log.With().Str("feed_id", feed.id).Str("action", "activitypub inbox").Logger()
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxInboxBodySize))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "Failed to read body")
+		return
+	}
+	sig, err := parseSignatureHeader(r.Header.Get("Signature"))
+	if err != nil {
+		log.Debug().Err(err).Msg("Rejecting request with invalid signature header")
+		writeError(w, http.StatusUnauthorized, "Invalid signature: %v", err)
+		return
+	}
+	actor, err := ap.getRemoteActor(r.Context(), feed, sig.KeyID, false)
+	if err == nil {
+		err = verifyRequestSignature(r, body, sig, actor.key)
+		if err != nil {
+			actor, err = ap.getRemoteActor(r.Context(), feed, sig.KeyID, true)
+			if err == nil {
+				err = verifyRequestSignature(r, body, sig, actor.key)
+			}
+		}
+	}
+	if err != nil {
+		log.Debug().Err(err).Str("key_id", sig.KeyID).Msg("Rejecting request with unverifiable signature")
+		writeError(w, http.StatusUnauthorized, "Invalid signature: %v", err)
+		return
+	}
+	var activity apIncomingActivity
+	if err = json.Unmarshal(body, &activity); err != nil {
+		writeError(w, http.StatusBadRequest, "Invalid activity JSON")
+		return
+	} else if apObjectID(activity.Actor) != actor.ID {
+		writeError(w, http.StatusUnauthorized, "Activity actor doesn't match signature")
+		return
+	}
+	log = log.With().Str("remote_actor", actor.ID).Str("activity_type", activity.Type).Logger()
+	switch activity.Type {
+	case "Follow":
+		if apObjectID(activity.Object) != ap.actorURL(feed) {
+			writeError(w, http.StatusBadRequest, "Follow object isn't this actor")
+			return
+		}
+		if err = ap.addFollower(feed, actor); err != nil {
+			log.Err(err).Msg("Failed to save new follower")
+			writeError(w, http.StatusInternalServerError, "Failed to save follower")
+			return
+		}
+		log.Info().Msg("Accepted new follower")
+		accept, _ := json.Marshal(&apActivity{
+			Context: activityStreamsContext,
+			ID:      ap.actorURL(feed) + "#accepts/" + randomID(),
+			Type:    "Accept",
+			Actor:   ap.actorURL(feed),
+			Object:  json.RawMessage(body),
+		})
+		ap.queueDelivery(apDelivery{feed: feed, inbox: actor.Inbox, body: accept})
+	case "Undo":
+		var undone apIncomingActivity
+		if err = json.Unmarshal(activity.Object, &undone); err != nil || undone.Type != "Follow" {
+			break
+		} else if apObjectID(undone.Actor) != actor.ID {
+			writeError(w, http.StatusUnauthorized, "Undone activity actor doesn't match signature")
+			return
+		}
+		if err = ap.removeFollower(feed, actor.ID); err != nil {
+			log.Err(err).Msg("Failed to remove follower")
+			writeError(w, http.StatusInternalServerError, "Failed to remove follower")
+			return
+		}
+		log.Info().Msg("Removed follower")
+	default:
+		log.Debug().Msg("Ignoring unsupported activity")
+	}
+	w.WriteHeader(http.StatusAccepted)
+}
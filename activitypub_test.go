@@ -0,0 +1,163 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+func TestIsPublicIP(t *testing.T) {
+	tests := map[string]bool{
+		"93.184.216.34":    true,
+		"2606:4700::1111":  true,
+		"127.0.0.1":        false,
+		"::1":              false,
+		"10.1.2.3":         false,
+		"172.16.0.1":       false,
+		"192.168.1.1":      false,
+		"fd00::1":          false,
+		"169.254.169.254":  false,
+		"fe80::1":          false,
+		"0.0.0.0":          false,
+		"::ffff:127.0.0.1": false,
+	}
+	for addr, expected := range tests {
+		if isPublicIP(net.ParseIP(addr)) != expected {
+			t.Errorf("isPublicIP(%s) should be %t", addr, expected)
+		}
+	}
+}
+
+func TestPublicHTTPClientRejectsLoopback(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Error("request reached the loopback server")
+	}))
+	defer server.Close()
+	_, err := newPublicHTTPClient(5 * time.Second).Get(server.URL)
+	if !errors.Is(err, errNonPublicAddress) {
+		t.Errorf("expected non-public address error, got %v", err)
+	}
+}
+
+func makeTestPoll(roomID id.RoomID, kind string) *event.Event {
+	content, _ := json.Marshal(map[string]any{
+		"m.poll": map[string]any{
+			"question": map[string]any{"m.text": "Favorite color?"},
+			"kind":     kind,
+			"answers": []map[string]any{
+				{"m.id": "red", "m.text": "Red"},
+				{"m.id": "blue", "m.text": "Blue"},
+			},
+		},
+	})
+	return &event.Event{
+		ID:        "$poll",
+		RoomID:    roomID,
+		Type:      EventPollStart,
+		Sender:    "@author:example.com",
+		Timestamp: 1700000000000,
+		Content:   event.Content{VeryRaw: content},
+	}
+}
+
+func makeTestVote(roomID id.RoomID, sender id.UserID, answer string) *event.Event {
+	content, _ := json.Marshal(map[string]any{
+		"m.relates_to": map[string]any{"rel_type": "m.reference", "event_id": "$poll"},
+		"m.selections": []string{answer},
+	})
+	return &event.Event{
+		ID:        id.EventID("$vote-" + sender.String()),
+		RoomID:    roomID,
+		Type:      EventPollResponse,
+		Sender:    sender,
+		Timestamp: 1700000001000,
+		Content:   event.Content{VeryRaw: content},
+	}
+}
+
+func makeTestPollActivityPub(t *testing.T) (ap *ActivityPub, feed *FeedConfig, vote func(voter id.UserID)) {
+	log := zerolog.Nop()
+	roomID := id.RoomID("!room:example.com")
+	feed = makeTestFeed("/polls", roomID)
+	fs := &FeedServ{Log: &log, Config: &Config{PublicURL: "https://example.com"}}
+	ap = &ActivityPub{
+		fs:          fs,
+		Log:         log,
+		domain:      "example.com",
+		deliveries:  make(chan apDelivery, 16),
+		pollUpdates: make(map[pendingPollUpdate]*time.Timer),
+		followers: apFollowerStore{Followers: map[string][]apFollower{
+			"/polls": {{Actor: "https://remote.example/users/a", Inbox: "https://remote.example/inbox"}},
+		}},
+	}
+	fs.ActivityPub = ap
+	vote = func(voter id.UserID) {
+		change, entryID := feed.pushEvent(log, makeTestVote(roomID, voter, "red"))
+		if change != feedChangeUpdate {
+			t.Fatalf("expected vote to update the poll, got %d", change)
+		}
+		ap.QueueEntryChange(feed, change, entryID)
+	}
+	change, entryID := feed.pushEvent(log, makeTestPoll(roomID, "m.poll.disclosed"))
+	ap.QueueEntryChange(feed, change, entryID)
+	if len(ap.deliveries) != 1 {
+		t.Fatalf("expected the poll to be delivered once, got %d deliveries", len(ap.deliveries))
+	}
+	<-ap.deliveries
+	return
+}
+
+func TestPollVotesAreDebounced(t *testing.T) {
+	ap, feed, vote := makeTestPollActivityPub(t)
+	drain := func() (count int) {
+		for ; len(ap.deliveries) > 0; count++ {
+			<-ap.deliveries
+		}
+		return
+	}
+
+	vote("@a:example.com")
+	vote("@b:example.com")
+	vote("@c:example.com")
+	if len(ap.deliveries) != 0 {
+		t.Errorf("votes were delivered immediately")
+	} else if len(ap.pollUpdates) != 1 {
+		t.Errorf("expected one pending poll update, got %d", len(ap.pollUpdates))
+	}
+	key := pendingPollUpdate{feed: feed, pollID: "$poll"}
+	ap.sendPollUpdate(key)
+	if count := drain(); count != 1 {
+		t.Errorf("expected one update after votes, got %d", count)
+	}
+	// Voting for the same answer again doesn't change the rendered poll
+	vote("@a:example.com")
+	ap.sendPollUpdate(key)
+	if count := drain(); count != 0 {
+		t.Errorf("unchanged poll was delivered again")
+	}
+}
+
+func TestStopDeliveriesSendsPendingPollUpdates(t *testing.T) {
+	ap, feed, vote := makeTestPollActivityPub(t)
+	vote("@a:example.com")
+	ap.StopDeliveries()
+	count := 0
+	for range ap.deliveries {
+		count++
+	}
+	if count != 1 {
+		t.Errorf("expected the pending poll update to be delivered on stop, got %d deliveries", count)
+	}
+	// Updates after stopping are dropped instead of panicking on the closed queue
+	vote("@b:example.com")
+	ap.sendPollUpdate(pendingPollUpdate{feed: feed, pollID: "$poll"})
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"sort"
+
+	"github.com/rs/zerolog"
+
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// feedEntry is a single item in a feed along with the feed it originally came from.
+// For normal feeds, the source is always the feed itself, while aggregate feeds collect
+// entries from all their source feeds.
+type feedEntry struct {
+	*event.Event
+	media       []*event.Event
+	pollResults *pollResults
+	source      *FeedConfig
+	language    string
+	author      JSONFeedAuthor
+	hasAuthor   bool
+}
+
+// IsAggregate returns true if the feed merges entries from other feeds rather than a room.
+func (feed *FeedConfig) IsAggregate() bool {
+	return len(feed.Sources) > 0
+}
+
+// getEntries returns a snapshot of the entries in the feed, newest first. Redacted entries are skipped.
+// The caller must hold the update lock of the feed. Aggregate feeds will
+// additionally read-lock each of their sources while collecting entries.
+func (feed *FeedConfig) getEntries() []feedEntry {
+	if feed.IsAggregate() {
+		return feed.getAggregateEntries()
+	}
+	entries := make([]feedEntry, 0, feed.entries.Size())
+	_ = feed.entries.Iter(func(_ id.EventID, evt *event.Event) error {
+		if evt.Unsigned.RedactedBecause == nil {
+			entries = append(entries, feed.makeEntry(evt))
+		}
+		return nil
+	})
+	return entries
+}
+
+func (feed *FeedConfig) makeEntry(evt *event.Event) feedEntry {
+	evtCopy := *evt
+	author, ok := feed.authors[evt.Sender]
+	var media []*event.Event
+	if group := feed.groupedMedia[evt.ID]; len(group) > 0 {
+		media = make([]*event.Event, len(group))
+		copy(media, group)
+	}
+	var results *pollResults
+	if isPollStart(evt.Type) {
+		results = feed.getPollResults(evt)
+	}
+	return feedEntry{
+		Event:       &evtCopy,
+		media:       media,
+		pollResults: results,
+		source:      feed,
+		language:    feed.getEntryLanguage(evt),
+		author:      author,
+		hasAuthor:   ok,
+	}
+}
+
+func (feed *FeedConfig) getAggregateEntries() []feedEntry {
+	seen := make(map[id.EventID]struct{})
+	var entries []feedEntry
+	for _, source := range feed.sources {
+		source.updateLock.RLock()
+		for _, entry := range source.getEntries() {
+			if _, alreadySeen := seen[entry.ID]; alreadySeen {
+				continue
+			}
+			seen[entry.ID] = struct{}{}
+			entries = append(entries, entry)
+		}
+		source.updateLock.RUnlock()
+	}
+	sort.SliceStable(entries, func(i, j int) bool {
+		return entries[i].Timestamp > entries[j].Timestamp
+	})
+	if feed.MaxEntries > 0 && len(entries) > feed.MaxEntries {
+		entries = entries[:feed.MaxEntries]
+	}
+	return entries
+}
+
+// getAuthors returns all the authors of the feed. For aggregate feeds, the authors of every source are included.
+// The caller must hold the update lock of the feed.
+func (feed *FeedConfig) getAuthors() []JSONFeedAuthor {
+	if !feed.IsAggregate() {
+		allAuthors := make([]JSONFeedAuthor, 0, len(feed.authors))
+		for _, author := range feed.authors {
+			allAuthors = append(allAuthors, author)
+		}
+		return allAuthors
+	}
+	seen := make(map[id.UserID]struct{})
+	var allAuthors []JSONFeedAuthor
+	for _, source := range feed.sources {
+		source.updateLock.RLock()
+		for userID, author := range source.authors {
+			if _, alreadySeen := seen[userID]; !alreadySeen {
+				seen[userID] = struct{}{}
+				allAuthors = append(allAuthors, author)
+			}
+		}
+		source.updateLock.RUnlock()
+	}
+	return allAuthors
+}
+
+// regenerateAggregates regenerates all aggregate feeds that include the given source feed.
+// The caller must not hold the update lock of the source feed.
+func (fs *FeedServ) regenerateAggregates(source *FeedConfig, log zerolog.Logger) {
+	for _, aggregate := range source.aggregates {
+		aggLog := log.With().Str("aggregate_feed_id", aggregate.id).Logger()
+		aggregate.updateLock.Lock()
+		fs.regenerateFeed(aggregate, aggLog)
+		aggregate.updateLock.Unlock()
+		if err := fs.purgeCloudflareCache(aggregate); err != nil {
+			aggLog.Error().Err(err).Msg("Failed to purge Cloudflare cache")
+		}
+	}
+}
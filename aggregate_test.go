@@ -0,0 +1,41 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/rs/zerolog"
+
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/id"
+)
+
+func TestAggregateRoomSourceSkipsPrivateFeed(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(`{"room_id":"!room:example.com"}`))
+	}))
+	defer server.Close()
+	cli, err := mautrix.NewClient(server.URL, "@feedserv:example.com", "token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	log := zerolog.Nop()
+	roomID := id.RoomID("!room:example.com")
+	private := makeTestFeed("/private", roomID)
+	private.Private = true
+	aggregate := &FeedConfig{id: "/all", Sources: []string{roomID.String()}, MaxEntries: 10, Private: true}
+	fs := &FeedServ{Log: &log, Client: cli, Config: &Config{
+		Feeds:         map[string]*FeedConfig{"/private": private, "/all": aggregate},
+		feedsByRoomID: map[id.RoomID][]*FeedConfig{roomID: {private}},
+	}}
+
+	fs.prepareAggregateFeed(aggregate)
+	if len(aggregate.sources) != 1 {
+		t.Fatalf("expected 1 source, got %d", len(aggregate.sources))
+	} else if source := aggregate.sources[0]; source == private {
+		t.Error("aggregate reused the private feed of the room")
+	} else if !source.hidden || source.RoomID != roomID {
+		t.Errorf("unexpected source %+v", source)
+	}
+}
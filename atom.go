@@ -0,0 +1,47 @@
+package main
+
+import (
+	"encoding/xml"
+	"io"
+
+	"github.com/gorilla/feeds"
+)
+
+// atomFeedXML is a replacement for feeds.AtomFeed that supports language attributes on the feed and entries.
+type atomFeedXML struct {
+	XMLName xml.Name `xml:"feed"`
+	Lang    string   `xml:"xml:lang,attr,omitempty"`
+	*feeds.AtomFeed
+	Entries []*atomEntry `xml:"entry"`
+}
+
+type atomEntry struct {
+	XMLName xml.Name `xml:"entry"`
+	Lang    string   `xml:"xml:lang,attr,omitempty"`
+	*feeds.AtomEntry
+}
+
+// writeAtom writes the given feed in Atom format. The entry languages must be in the same order as the feed items.
+func writeAtom(w io.Writer, gorillaFeed *feeds.Feed, language string, entryLanguages []string) error {
+	atomFeed := (&feeds.Atom{Feed: gorillaFeed}).AtomFeed()
+	entries := make([]*atomEntry, len(atomFeed.Entries))
+	for i, entry := range atomFeed.Entries {
+		entries[i] = &atomEntry{AtomEntry: entry}
+		if entryLanguages[i] != language {
+			entries[i].Lang = entryLanguages[i]
+		}
+	}
+	return feeds.WriteXML(&atomXMLFeed{&atomFeedXML{
+		Lang:     language,
+		AtomFeed: atomFeed,
+		Entries:  entries,
+	}}, w)
+}
+
+type atomXMLFeed struct {
+	feed *atomFeedXML
+}
+
+func (axf *atomXMLFeed) FeedXml() any {
+	return axf.feed
+}
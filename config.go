@@ -1,7 +1,11 @@
 package main
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
+	"html/template"
+	"io"
 	"os"
 	"sync"
 	"time"
@@ -20,18 +24,45 @@ type Config struct {
 	UserID        id.UserID `yaml:"user_id"`
 	Password      string    `yaml:"password"`
 
+	LoginType   string      `yaml:"login_type"`
+	LoginToken  string      `yaml:"login_token"`
+	AccessToken string      `yaml:"access_token"`
+	DeviceID    id.DeviceID `yaml:"device_id"`
+	SessionPath string      `yaml:"session_path"`
+
+	AppServiceRegistration string `yaml:"appservice_registration"`
+
 	LogConfig zeroconfig.Config `yaml:"logging"`
 
 	ListenAddress string `yaml:"listen_address"`
 	PublicURL     string `yaml:"public_url"`
 
+	Timeouts              HTTPTimeoutConfig `yaml:"timeouts"`
+	MaxConcurrentRequests int               `yaml:"max_concurrent_requests"`
+	TrustedProxies        []string          `yaml:"trusted_proxies"`
+	TrustCloudflareHeader bool              `yaml:"trust_cloudflare_header"`
+	RateLimit             RateLimitConfig   `yaml:"rate_limit"`
+	TLS                   TLSConfig         `yaml:"tls"`
+	ShutdownTimeout       time.Duration     `yaml:"shutdown_timeout"`
+
+	HTMLTemplate string `yaml:"html_template"`
+
+	MediaProxy  MediaProxyConfig  `yaml:"media_proxy"`
+	ActivityPub ActivityPubConfig `yaml:"activitypub"`
+	SMTP        SMTPConfig        `yaml:"smtp"`
+
+	AdminToken string `yaml:"admin_token"`
+
 	CloudflareZoneID string `yaml:"cloudflare_zone_id"`
 	CloudflareToken  string `yaml:"cloudflare_token"`
 
+	Ingest []*IngestConfig `yaml:"ingest"`
+
 	Feeds         map[string]*FeedConfig `yaml:"feeds"`
-	feedsByRoomID map[id.RoomID]*FeedConfig
+	feedsByRoomID map[id.RoomID][]*FeedConfig
 
 	homeserverDomain string
+	ignoredEnv       []string
 }
 
 type FeedConfig struct {
@@ -41,24 +72,67 @@ type FeedConfig struct {
 	Homepage   string       `yaml:"homepage"`
 	Language   string       `yaml:"language"`
 
-	id          string
-	title       string
-	description string
-	icon        string
-	iconMXC     id.ContentURI
-	authors     map[id.UserID]JSONFeedAuthor
-	powers      *event.PowerLevelsEventContent
+	Languages      []string `yaml:"languages"`
+	DetectLanguage bool     `yaml:"detect_language"`
+
+	Sources []string `yaml:"sources"`
+	Private bool     `yaml:"private"`
+
+	MemberAccess bool `yaml:"member_access"`
+
+	Title       string              `yaml:"title"`
+	Description string              `yaml:"description"`
+	Icon        id.ContentURIString `yaml:"icon"`
+	Filter      *FeedFilter         `yaml:"filter"`
+
+	Podcast    PodcastConfig       `yaml:"podcast"`
+	GroupMedia MediaGroupingConfig `yaml:"group_media"`
+
+	HTML         bool   `yaml:"html"`
+	HTMLTemplate string `yaml:"html_template"`
+
+	Digest DigestConfig `yaml:"digest"`
+
+	ExpireWhenStale bool `yaml:"expire_when_stale"`
 
-	entries    *util.RingBuffer[id.EventID, *event.Event]
-	lastUpdate time.Time
-	updateLock sync.RWMutex
+	id            string
+	hidden        bool
+	previousRooms []id.RoomID
+	sources       []*FeedConfig
+	aggregates    []*FeedConfig
+	title         string
+	description   string
+	icon          string
+	iconMXC       id.ContentURI
+	authors       map[id.UserID]JSONFeedAuthor
+	members       map[id.UserID]struct{}
+	powers        *event.PowerLevelsEventContent
+	joinRule      event.JoinRule
+	staleReason   string
+	staleSince    time.Time
 
+	htmlTemplate *template.Template
+
+	entries      *util.RingBuffer[id.EventID, *event.Event]
+	groupedMedia map[id.EventID][]*event.Event
+	polls        map[id.EventID]*pollState
+	lastUpdate   time.Time
+	updateLock   sync.RWMutex
+
+	feedOutput
+	languageOutputs map[string]*feedOutput
+}
+
+// feedOutput contains the generated feed in every format.
+type feedOutput struct {
 	rss      []byte
 	rssHash  string
 	atom     []byte
 	atomHash string
 	json     []byte
 	jsonHash string
+	html     []byte
+	htmlHash string
 }
 
 func loadConfig() (*Config, error) {
@@ -66,23 +140,50 @@ func loadConfig() (*Config, error) {
 	if cfgPath == "" {
 		cfgPath = "config.yaml"
 	}
-	file, err := os.Open(cfgPath)
+	data, err := os.ReadFile(cfgPath)
 	if err != nil {
 		return nil, fmt.Errorf("failed to read config: %w", err)
 	}
+	var root yaml.Node
+	if err = yaml.Unmarshal(data, &root); err != nil {
+		return nil, fmt.Errorf("failed to parse config: %w", err)
+	} else if interpolated, err := interpolateEnv(&root); err != nil {
+		return nil, fmt.Errorf("failed to interpolate config: %w", err)
+	} else if interpolated {
+		// Re-encoding changes line numbers, so it's only done when necessary
+		if data, err = yaml.Marshal(&root); err != nil {
+			return nil, fmt.Errorf("failed to re-encode interpolated config: %w", err)
+		}
+	}
 	var config Config
-	err = yaml.NewDecoder(file).Decode(&config)
-	if err != nil {
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	// An empty file is allowed so that everything can be configured with environment variables
+	if err = decoder.Decode(&config); err != nil && !errors.Is(err, io.EOF) {
 		return nil, fmt.Errorf("failed to parse config: %w", err)
 	}
-	if passwordEnv := os.Getenv("FEEDSERV_PASSWORD"); passwordEnv != "" {
-		config.Password = passwordEnv
-	} else if passwordFileEnv := os.Getenv("FEEDSERV_PASSWORD_FILE"); passwordFileEnv != "" {
-		pwBytes, err := os.ReadFile(passwordFileEnv)
-		if err != nil {
-			return nil, fmt.Errorf("failed to read password from file: %w", err)
-		}
-		config.Password = string(pwBytes)
+	config.ignoredEnv, err = config.applyEnvOverrides()
+	if err != nil {
+		return nil, err
+	}
+	setDefaultDuration(&config.Timeouts.ReadHeader, 10*time.Second)
+	setDefaultDuration(&config.Timeouts.Read, 30*time.Second)
+	setDefaultDuration(&config.Timeouts.Write, 60*time.Second)
+	setDefaultDuration(&config.Timeouts.Idle, 120*time.Second)
+	setDefaultDuration(&config.ShutdownTimeout, 30*time.Second)
+	if err = config.normalize(); err != nil {
+		return nil, fmt.Errorf("invalid config: %w", err)
+	} else if err = config.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid config:\n%w", err)
 	}
 	return &config, nil
 }
+
+// setDefaultDuration sets the duration to the default value if it's not set. Negative values disable the timeout.
+func setDefaultDuration(duration *time.Duration, defaultValue time.Duration) {
+	if *duration == 0 {
+		*duration = defaultValue
+	} else if *duration < 0 {
+		*duration = 0
+	}
+}
@@ -0,0 +1,444 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	_ "embed"
+	"errors"
+	"fmt"
+	htmltemplate "html/template"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"net/textproto"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	texttemplate "text/template"
+	"time"
+
+	"github.com/rs/zerolog"
+
+	"maunium.net/go/mautrix"
+)
+
+const (
+	digestAccountDataType = "com.beeper.feedserv.digest"
+
+	maxDigestSentIDs = 1000
+	// digestGracePeriod is how far before the previous run entries are still considered,
+	// so that messages which arrive late over federation are included in the next digest.
+	digestGracePeriod = 24 * time.Hour
+)
+
+//go:embed templates/digest.html
+var defaultDigestHTMLTemplate string
+
+//go:embed templates/digest.txt
+var defaultDigestTextTemplate string
+
+type SMTPConfig struct {
+	Host        string `yaml:"host"`
+	Port        int    `yaml:"port"`
+	Username    string `yaml:"username"`
+	Password    string `yaml:"password"`
+	From        string `yaml:"from"`
+	ImplicitTLS bool   `yaml:"implicit_tls"`
+}
+
+type DigestConfig struct {
+	Enabled      bool     `yaml:"enabled"`
+	Schedule     string   `yaml:"schedule"`
+	Time         string   `yaml:"time"`
+	Weekday      string   `yaml:"weekday"`
+	Timezone     string   `yaml:"timezone"`
+	Recipients   []string `yaml:"recipients"`
+	Subject      string   `yaml:"subject"`
+	HTMLTemplate string   `yaml:"html_template"`
+	TextTemplate string   `yaml:"text_template"`
+
+	days     int
+	hour     int
+	minute   int
+	weekday  time.Weekday
+	location *time.Location
+	htmlTpl  *htmltemplate.Template
+	textTpl  *texttemplate.Template
+}
+
+type digestFeedState struct {
+	LastRun time.Time `json:"last_run"`
+	SentIDs []string  `json:"sent_ids"`
+}
+
+type digestState struct {
+	Feeds map[string]*digestFeedState `json:"feeds"`
+}
+
+type digestTemplateData struct {
+	Subject string
+	FeedURL string
+	Since   *time.Time
+	Feed    *JSONFeed
+}
+
+// Digester sends periodic email digests of new feed entries.
+type Digester struct {
+	fs   *FeedServ
+	SMTP *SMTPConfig
+	Log  zerolog.Logger
+
+	feeds     []*FeedConfig
+	state     digestState
+	stateLock sync.Mutex
+}
+
+var weekdays = map[string]time.Weekday{
+	"sunday": time.Sunday, "monday": time.Monday, "tuesday": time.Tuesday, "wednesday": time.Wednesday,
+	"thursday": time.Thursday, "friday": time.Friday, "saturday": time.Saturday,
+}
+
+func (cfg *DigestConfig) prepare(fs *FeedServ) (err error) {
+	switch cfg.Schedule {
+	case "", "daily":
+		cfg.days = 1
+	case "weekly":
+		cfg.days = 7
+		var ok bool
+		if cfg.Weekday == "" {
+			cfg.weekday = time.Monday
+		} else if cfg.weekday, ok = weekdays[strings.ToLower(cfg.Weekday)]; !ok {
+			return fmt.Errorf("invalid weekday %q", cfg.Weekday)
+		}
+	default:
+		return fmt.Errorf("invalid schedule %q (must be daily or weekly)", cfg.Schedule)
+	}
+	if cfg.Time == "" {
+		cfg.Time = "08:00"
+	}
+	parsedTime, err := time.Parse("15:04", cfg.Time)
+	if err != nil {
+		return fmt.Errorf("invalid time %q: %w", cfg.Time, err)
+	}
+	cfg.hour, cfg.minute = parsedTime.Hour(), parsedTime.Minute()
+	cfg.location = time.UTC
+	if cfg.Timezone != "" {
+		if cfg.location, err = time.LoadLocation(cfg.Timezone); err != nil {
+			return fmt.Errorf("invalid timezone: %w", err)
+		}
+	}
+	if len(cfg.Recipients) == 0 {
+		return fmt.Errorf("no recipients")
+	}
+	funcs := map[string]any{
+		"sanitizeHTML": fs.sanitizeHTML,
+		"formatTime": func(ts *time.Time) string {
+			if ts == nil {
+				return ""
+			}
+			return ts.In(cfg.location).Format("2006-01-02 15:04 MST")
+		},
+	}
+	// The template files are read and parsed directly, as ParseFiles would name the templates after the files
+	htmlSource, err := readTemplateSource(cfg.HTMLTemplate, defaultDigestHTMLTemplate)
+	if err == nil {
+		cfg.htmlTpl, err = htmltemplate.New("digest.html").Funcs(funcs).Parse(htmlSource)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to load HTML template: %w", err)
+	}
+	textSource, err := readTemplateSource(cfg.TextTemplate, defaultDigestTextTemplate)
+	if err == nil {
+		cfg.textTpl, err = texttemplate.New("digest.txt").Funcs(funcs).Parse(textSource)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to load text template: %w", err)
+	}
+	return nil
+}
+
+// readTemplateSource returns the contents of the template file at the given path, or the default template if the path is empty.
+func readTemplateSource(path, defaultTemplate string) (string, error) {
+	if path == "" {
+		return defaultTemplate, nil
+	}
+	data, err := os.ReadFile(path)
+	return string(data), err
+}
+
+// previousRun returns the latest scheduled digest time that is not after now.
+func (cfg *DigestConfig) previousRun(now time.Time) time.Time {
+	now = now.In(cfg.location)
+	scheduled := time.Date(now.Year(), now.Month(), now.Day(), cfg.hour, cfg.minute, 0, 0, cfg.location)
+	if cfg.days == 7 {
+		scheduled = scheduled.AddDate(0, 0, -((int(scheduled.Weekday()) - int(cfg.weekday) + 7) % 7))
+	}
+	if scheduled.After(now) {
+		scheduled = scheduled.AddDate(0, 0, -cfg.days)
+	}
+	return scheduled
+}
+
+func NewDigester(fs *FeedServ, log zerolog.Logger) (*Digester, error) {
+	d := &Digester{
+		fs:   fs,
+		SMTP: &fs.Config.SMTP,
+		Log:  log,
+	}
+	for feedID, feed := range fs.Config.Feeds {
+		if !feed.Digest.Enabled {
+			continue
+		}
+		if err := feed.Digest.prepare(fs); err != nil {
+			return nil, fmt.Errorf("invalid digest config in %s: %w", feedID, err)
+		}
+		d.feeds = append(d.feeds, feed)
+	}
+	if len(d.feeds) == 0 {
+		return nil, nil
+	} else if d.SMTP.Host == "" || d.SMTP.From == "" {
+		return nil, fmt.Errorf("smtp host and from address must be configured to send digests")
+	}
+	if d.SMTP.Port == 0 {
+		d.SMTP.Port = 587
+		if d.SMTP.ImplicitTLS {
+			d.SMTP.Port = 465
+		}
+	}
+	err := fs.Client.GetAccountData(digestAccountDataType, &d.state)
+	if err != nil && !errors.Is(err, mautrix.MNotFound) {
+		return nil, fmt.Errorf("failed to load digest state: %w", err)
+	}
+	if d.state.Feeds == nil {
+		d.state.Feeds = make(map[string]*digestFeedState)
+	}
+	return d, nil
+}
+
+// Run sends the digests of every feed on their schedules until the context is canceled.
+func (d *Digester) Run(ctx context.Context) {
+	var wg sync.WaitGroup
+	wg.Add(len(d.feeds))
+	for _, feed := range d.feeds {
+		go func(feed *FeedConfig) {
+			defer wg.Done()
+			d.runFeed(ctx, feed)
+		}(feed)
+	}
+	wg.Wait()
+}
+
+func (d *Digester) runFeed(ctx context.Context, feed *FeedConfig) {
+	log := d.Log.With().Str("feed_id", feed.id).Logger()
+	for {
+		now := time.Now()
+		previous := feed.Digest.previousRun(now)
+		state := d.getFeedState(feed)
+		if state.LastRun.IsZero() {
+			// Don't send a digest of old entries when the digest is first enabled
+			state.LastRun = now
+			if err := d.saveFeedState(feed, state); err != nil {
+				log.Err(err).Msg("Failed to save digest state")
+			}
+		} else if state.LastRun.Before(previous) {
+			if err := d.sendDigest(feed, &state, log); err != nil {
+				log.Err(err).Msg("Failed to send digest")
+			} else {
+				state.LastRun = now
+				if err = d.saveFeedState(feed, state); err != nil {
+					log.Err(err).Msg("Failed to save digest state")
+				}
+			}
+		}
+		next := previous.AddDate(0, 0, feed.Digest.days)
+		log.Debug().Time("next_run", next).Msg("Waiting for next digest")
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(time.Until(next)):
+		}
+	}
+}
+
+func (d *Digester) getFeedState(feed *FeedConfig) digestFeedState {
+	d.stateLock.Lock()
+	defer d.stateLock.Unlock()
+	if state, ok := d.state.Feeds[feed.id]; ok {
+		return *state
+	}
+	return digestFeedState{}
+}
+
+func (d *Digester) saveFeedState(feed *FeedConfig, state digestFeedState) error {
+	d.stateLock.Lock()
+	defer d.stateLock.Unlock()
+	if len(state.SentIDs) > maxDigestSentIDs {
+		state.SentIDs = state.SentIDs[len(state.SentIDs)-maxDigestSentIDs:]
+	}
+	d.state.Feeds[feed.id] = &state
+	return d.fs.Client.SetAccountData(digestAccountDataType, &d.state)
+}
+
+// sendDigest sends an email containing the entries that were added since the last digest.
+// The IDs of the sent entries are added to the state.
+func (d *Digester) sendDigest(feed *FeedConfig, state *digestFeedState, log zerolog.Logger) error {
+	sent := make(map[string]struct{}, len(state.SentIDs))
+	for _, entryID := range state.SentIDs {
+		sent[entryID] = struct{}{}
+	}
+	cutoff := state.LastRun.Add(-digestGracePeriod).UnixMilli()
+	feed.updateLock.RLock()
+	var entries []feedEntry
+	for _, entry := range feed.getEntries() {
+		if _, alreadySent := sent[entry.ID.String()]; !alreadySent && entry.Timestamp > cutoff {
+			entries = append(entries, entry)
+		}
+	}
+	jsonFeed := d.fs.buildJSONFeed(feed, feed.id, entries, feed.Language)
+	feed.updateLock.RUnlock()
+	if len(entries) == 0 {
+		log.Debug().Msg("No new entries for digest")
+		return nil
+	}
+
+	subject := feed.Digest.Subject
+	if subject == "" {
+		subject = fmt.Sprintf("%s: %d new entries", jsonFeed.Title, len(entries))
+		if len(entries) == 1 {
+			subject = fmt.Sprintf("%s: 1 new entry", jsonFeed.Title)
+		}
+	}
+	data := &digestTemplateData{
+		Subject: subject,
+		FeedURL: d.fs.Config.PublicURL + feed.id,
+		Since:   &state.LastRun,
+		Feed:    jsonFeed,
+	}
+	var htmlBody, textBody bytes.Buffer
+	if err := feed.Digest.htmlTpl.Execute(&htmlBody, data); err != nil {
+		return fmt.Errorf("failed to render HTML digest: %w", err)
+	} else if err = feed.Digest.textTpl.Execute(&textBody, data); err != nil {
+		return fmt.Errorf("failed to render text digest: %w", err)
+	}
+	message, err := d.buildMessage(feed.Digest.Recipients, subject, textBody.Bytes(), htmlBody.Bytes())
+	if err != nil {
+		return err
+	}
+	if err = d.sendMail(feed.Digest.Recipients, message); err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		state.SentIDs = append(state.SentIDs, entry.ID.String())
+	}
+	log.Info().Int("entry_count", len(entries)).Int("recipient_count", len(feed.Digest.Recipients)).Msg("Sent digest")
+	return nil
+}
+
+func (d *Digester) buildMessage(recipients []string, subject string, text, html []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	writer := multipart.NewWriter(&buf)
+	headers := []string{
+		"From: " + d.SMTP.From,
+		"To: " + strings.Join(recipients, ", "),
+		"Subject: " + mime.QEncoding.Encode("utf-8", subject),
+		"Date: " + time.Now().Format(time.RFC1123Z),
+		"Message-ID: <" + randomID() + "@feedserv>",
+		"MIME-Version: 1.0",
+		"Content-Type: multipart/alternative; boundary=" + writer.Boundary(),
+	}
+	buf.WriteString(strings.Join(headers, "\r\n") + "\r\n\r\n")
+	for _, part := range []struct {
+		mime string
+		body []byte
+	}{{"text/plain; charset=utf-8", text}, {"text/html; charset=utf-8", html}} {
+		partWriter, err := writer.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {part.mime},
+			"Content-Transfer-Encoding": {"quoted-printable"},
+		})
+		if err != nil {
+			return nil, err
+		}
+		qpWriter := quotedprintable.NewWriter(partWriter)
+		if _, err = qpWriter.Write(part.body); err != nil {
+			return nil, err
+		} else if err = qpWriter.Close(); err != nil {
+			return nil, err
+		}
+	}
+	if err := writer.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// envelopeAddresses returns the bare addresses of the sender and recipients for the SMTP envelope,
+// as the configured addresses may include display names like "Feedserv <feedserv@example.com>".
+func (d *Digester) envelopeAddresses(recipients []string) (from string, to []string, err error) {
+	fromAddr, err := mail.ParseAddress(d.SMTP.From)
+	if err != nil {
+		return "", nil, fmt.Errorf("invalid from address: %w", err)
+	}
+	to = make([]string, len(recipients))
+	for i, recipient := range recipients {
+		toAddr, err := mail.ParseAddress(recipient)
+		if err != nil {
+			return "", nil, fmt.Errorf("invalid recipient %q: %w", recipient, err)
+		}
+		to[i] = toAddr.Address
+	}
+	return fromAddr.Address, to, nil
+}
+
+func (d *Digester) sendMail(recipients []string, message []byte) error {
+	from, recipients, err := d.envelopeAddresses(recipients)
+	if err != nil {
+		return err
+	}
+	addr := net.JoinHostPort(d.SMTP.Host, strconv.Itoa(d.SMTP.Port))
+	var auth smtp.Auth
+	if d.SMTP.Username != "" {
+		auth = smtp.PlainAuth("", d.SMTP.Username, d.SMTP.Password, d.SMTP.Host)
+	}
+	if !d.SMTP.ImplicitTLS {
+		// SendMail uses STARTTLS automatically if the server supports it
+		return smtp.SendMail(addr, auth, from, recipients, message)
+	}
+	conn, err := tls.Dial("tcp", addr, &tls.Config{ServerName: d.SMTP.Host})
+	if err != nil {
+		return fmt.Errorf("failed to connect to SMTP server: %w", err)
+	}
+	client, err := smtp.NewClient(conn, d.SMTP.Host)
+	if err != nil {
+		_ = conn.Close()
+		return fmt.Errorf("failed to initialize SMTP client: %w", err)
+	}
+	defer client.Close()
+	if auth != nil {
+		if err = client.Auth(auth); err != nil {
+			return fmt.Errorf("failed to authenticate: %w", err)
+		}
+	}
+	if err = client.Mail(from); err != nil {
+		return err
+	}
+	for _, recipient := range recipients {
+		if err = client.Rcpt(recipient); err != nil {
+			return err
+		}
+	}
+	dataWriter, err := client.Data()
+	if err != nil {
+		return err
+	}
+	if _, err = dataWriter.Write(message); err != nil {
+		return err
+	} else if err = dataWriter.Close(); err != nil {
+		return err
+	}
+	return client.Quit()
+}
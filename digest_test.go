@@ -0,0 +1,114 @@
+package main
+
+import (
+	"bytes"
+	"net"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestDigestPrepareCustomTemplateFileNames(t *testing.T) {
+	dir := t.TempDir()
+	htmlPath := filepath.Join(dir, "newsletter.html")
+	textPath := filepath.Join(dir, "newsletter.txt")
+	if err := os.WriteFile(htmlPath, []byte(`<h1>{{ .Subject }}</h1>`), 0600); err != nil {
+		t.Fatal(err)
+	} else if err = os.WriteFile(textPath, []byte(`# {{ .Subject }}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	cfg := &DigestConfig{Recipients: []string{"user@example.com"}, HTMLTemplate: htmlPath, TextTemplate: textPath}
+	if err := cfg.prepare(&FeedServ{Config: &Config{}}); err != nil {
+		t.Fatal(err)
+	}
+	data := &digestTemplateData{Subject: "Example", Feed: &JSONFeed{}}
+	var htmlBody, textBody bytes.Buffer
+	if err := cfg.htmlTpl.Execute(&htmlBody, data); err != nil {
+		t.Fatal(err)
+	} else if htmlBody.String() != "<h1>Example</h1>" {
+		t.Errorf("unexpected HTML body %q", htmlBody.String())
+	}
+	if err := cfg.textTpl.Execute(&textBody, data); err != nil {
+		t.Fatal(err)
+	} else if textBody.String() != "# Example" {
+		t.Errorf("unexpected text body %q", textBody.String())
+	}
+}
+
+func TestDigestPrepareMissingTemplate(t *testing.T) {
+	cfg := &DigestConfig{Recipients: []string{"user@example.com"}, HTMLTemplate: filepath.Join(t.TempDir(), "missing.html")}
+	if err := cfg.prepare(&FeedServ{Config: &Config{}}); err == nil {
+		t.Error("expected an error for a missing template file")
+	}
+}
+
+// runFakeSMTPServer accepts one SMTP session and returns the MAIL FROM and RCPT TO commands it received.
+func runFakeSMTPServer(t *testing.T, listener net.Listener) <-chan []string {
+	commands := make(chan []string, 1)
+	go func() {
+		var received []string
+		defer func() {
+			commands <- received
+		}()
+		conn, err := listener.Accept()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer conn.Close()
+		text := textproto.NewConn(conn)
+		_ = text.PrintfLine("220 localhost ESMTP")
+		inData := false
+		for {
+			line, err := text.ReadLine()
+			if err != nil {
+				return
+			}
+			switch command := strings.ToUpper(line); {
+			case inData:
+				if line == "." {
+					inData = false
+					_ = text.PrintfLine("250 Queued")
+				}
+			case strings.HasPrefix(command, "EHLO"), strings.HasPrefix(command, "HELO"):
+				_ = text.PrintfLine("250 localhost")
+			case strings.HasPrefix(command, "MAIL FROM:"), strings.HasPrefix(command, "RCPT TO:"):
+				received = append(received, line)
+				_ = text.PrintfLine("250 OK")
+			case command == "DATA":
+				inData = true
+				_ = text.PrintfLine("354 Go ahead")
+			case command == "QUIT":
+				_ = text.PrintfLine("221 Bye")
+				return
+			default:
+				_ = text.PrintfLine("250 OK")
+			}
+		}
+	}()
+	return commands
+}
+
+func TestSendMailUsesBareEnvelopeAddresses(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	commands := runFakeSMTPServer(t, listener)
+	host, portStr, _ := net.SplitHostPort(listener.Addr().String())
+	port, _ := strconv.Atoi(portStr)
+	d := &Digester{SMTP: &SMTPConfig{Host: host, Port: port, From: "Feedserv <feedserv@example.com>"}}
+
+	err = d.sendMail([]string{"Some User <user@example.com>", "other@example.com"}, []byte("Subject: Test\r\n\r\nHello\r\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"MAIL FROM:<feedserv@example.com>", "RCPT TO:<user@example.com>", "RCPT TO:<other@example.com>"}
+	if received := <-commands; strings.Join(received, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("unexpected envelope commands:\n%s", strings.Join(received, "\n"))
+	}
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	envPrefix        = "FEEDSERV_"
+	envFileSuffix    = "_FILE"
+	envPathSeparator = "__"
+)
+
+// envConfigPathVar is the only FEEDSERV_ variable that isn't a config override.
+const envConfigPathVar = "FEEDSERV_CONFIG_PATH"
+
+var envReferenceRegex = regexp.MustCompile(`\$?\$\{([A-Za-z_][A-Za-z0-9_]*)}`)
+
+// interpolateEnv replaces ${VAR} references in the scalar values of the parsed config file with the values of
+// environment variables. Comments aren't affected. References can be escaped as $${VAR}, and referencing an
+// unset variable is an error. Unquoted values are resolved again, so that e.g. numbers can be interpolated too.
+func interpolateEnv(node *yaml.Node) (changed bool, err error) {
+	if node.Kind == yaml.ScalarNode && strings.Contains(node.Value, "${") {
+		var missing []string
+		node.Value = envReferenceRegex.ReplaceAllStringFunc(node.Value, func(match string) string {
+			if match[1] == '$' {
+				return match[1:]
+			}
+			name := match[2 : len(match)-1]
+			value, ok := os.LookupEnv(name)
+			if !ok {
+				missing = append(missing, name)
+			}
+			return value
+		})
+		if len(missing) > 0 {
+			return false, fmt.Errorf("line %d references unset environment variables: %s", node.Line, strings.Join(missing, ", "))
+		}
+		if node.Style == 0 {
+			node.Tag = ""
+		}
+		return true, nil
+	}
+	for _, child := range node.Content {
+		childChanged, err := interpolateEnv(child)
+		if err != nil {
+			return false, err
+		}
+		changed = changed || childChanged
+	}
+	return changed, nil
+}
+
+// applyEnvOverrides sets config values from FEEDSERV_ environment variables. The variable name is the
+// uppercased path to the key with levels separated by double underscores, e.g. FEEDSERV_SMTP__PASSWORD
+// or FEEDSERV_FEEDS__EXAMPLE__MAX_ENTRIES. Values that aren't strings are parsed as YAML, so entire
+// sections like FEEDSERV_FEEDS can be set too. If the variable has the _FILE suffix, the value is read
+// from the file at that path instead, which is useful for secrets mounted as files.
+//
+// Variables that don't match any key are returned rather than treated as errors, because some environments
+// (like Kubernetes services) add their own variables with the same prefix.
+func (cfg *Config) applyEnvOverrides() (unknown []string, err error) {
+	values := make(map[string]string)
+	var names []string
+	for _, env := range os.Environ() {
+		name, value, _ := strings.Cut(env, "=")
+		if !strings.HasPrefix(name, envPrefix) || name == envConfigPathVar {
+			continue
+		}
+		names = append(names, name)
+		values[name] = value
+	}
+	// Sort so that nested keys are applied after the sections containing them
+	sort.Strings(names)
+	for _, name := range names {
+		value := values[name]
+		key := strings.TrimPrefix(name, envPrefix)
+		if fileKey, isFile := strings.CutSuffix(key, envFileSuffix); isFile {
+			if _, hasPlain := values[envPrefix+fileKey]; hasPlain {
+				continue
+			}
+			fileData, err := os.ReadFile(value)
+			if err != nil {
+				return nil, fmt.Errorf("failed to read %s: %w", name, err)
+			}
+			key = fileKey
+			value = strings.TrimRight(string(fileData), "\r\n")
+		}
+		path := strings.Split(strings.ToLower(key), envPathSeparator)
+		found, err := setConfigValue(reflect.ValueOf(cfg).Elem(), path, value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid value in %s: %w", name, err)
+		} else if !found {
+			unknown = append(unknown, name)
+		}
+	}
+	return unknown, nil
+}
+
+// findYAMLField finds the struct field with the given YAML key, including fields of inlined structs.
+func findYAMLField(target reflect.Value, key string) (reflect.Value, bool) {
+	targetType := target.Type()
+	for i := 0; i < targetType.NumField(); i++ {
+		field := targetType.Field(i)
+		if !field.IsExported() {
+			continue
+		}
+		name, opts, _ := strings.Cut(field.Tag.Get("yaml"), ",")
+		if name == key {
+			return target.Field(i), true
+		} else if name == "" && strings.Contains(opts, "inline") && field.Type.Kind() == reflect.Struct {
+			if inlineField, ok := findYAMLField(target.Field(i), key); ok {
+				return inlineField, true
+			}
+		}
+	}
+	return reflect.Value{}, false
+}
+
+// setConfigValue sets the value at the given path inside target, which must be addressable.
+// Map keys are matched case-insensitively and without the leading slash of feed IDs, and slice items by index.
+func setConfigValue(target reflect.Value, path []string, value string) (bool, error) {
+	for target.Kind() == reflect.Pointer {
+		if target.IsNil() {
+			target.Set(reflect.New(target.Type().Elem()))
+		}
+		target = target.Elem()
+	}
+	if len(path) == 0 {
+		if target.Kind() == reflect.String {
+			target.SetString(value)
+			return true, nil
+		}
+		return true, yaml.Unmarshal([]byte(value), target.Addr().Interface())
+	}
+	switch target.Kind() {
+	case reflect.Struct:
+		field, ok := findYAMLField(target, path[0])
+		if !ok {
+			return false, nil
+		}
+		return setConfigValue(field, path[1:], value)
+	case reflect.Map:
+		if target.Type().Key().Kind() != reflect.String {
+			return false, nil
+		}
+		iter := target.MapRange()
+		for iter.Next() {
+			mapKey := iter.Key()
+			if !strings.EqualFold(strings.TrimPrefix(mapKey.String(), "/"), path[0]) {
+				continue
+			}
+			// Map values aren't addressable, so modify a copy and put it back
+			item := reflect.New(target.Type().Elem()).Elem()
+			item.Set(iter.Value())
+			found, err := setConfigValue(item, path[1:], value)
+			if found && err == nil {
+				target.SetMapIndex(mapKey, item)
+			}
+			return found, err
+		}
+		return false, nil
+	case reflect.Slice:
+		index, err := strconv.Atoi(path[0])
+		if err != nil || index < 0 || index >= target.Len() {
+			return false, nil
+		}
+		return setConfigValue(target.Index(index), path[1:], value)
+	default:
+		return false, nil
+	}
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"gopkg.in/yaml.v3"
+)
+
+func TestInterpolateEnv(t *testing.T) {
+	t.Setenv("TEST_HOMESERVER", "https://matrix.example.com")
+	t.Setenv("TEST_MAX_ENTRIES", "42")
+	input := `# Comments with ${UNSET_VARIABLE} are ignored
+homeserver_url: ${TEST_HOMESERVER}
+password: "$${NOT_INTERPOLATED}"
+feeds:
+    /news:
+        room_id: "!news:example.com"
+        max_entries: ${TEST_MAX_ENTRIES}
+`
+	var root yaml.Node
+	if err := yaml.Unmarshal([]byte(input), &root); err != nil {
+		t.Fatal(err)
+	}
+	changed, err := interpolateEnv(&root)
+	if err != nil {
+		t.Fatal(err)
+	} else if !changed {
+		t.Fatal("interpolateEnv didn't report any changes")
+	}
+	var cfg Config
+	if err = root.Decode(&cfg); err != nil {
+		t.Fatal(err)
+	} else if cfg.HomeserverURL != "https://matrix.example.com" {
+		t.Errorf("unexpected homeserver_url %q", cfg.HomeserverURL)
+	} else if cfg.Password != "${NOT_INTERPOLATED}" {
+		t.Errorf("escaped reference was changed to %q", cfg.Password)
+	} else if cfg.Feeds["/news"].MaxEntries != 42 {
+		t.Errorf("interpolated number wasn't decoded, got %d", cfg.Feeds["/news"].MaxEntries)
+	}
+
+	if err = yaml.Unmarshal([]byte("password: ${TEST_UNSET_VARIABLE}"), &root); err != nil {
+		t.Fatal(err)
+	} else if _, err = interpolateEnv(&root); err == nil || !strings.Contains(err.Error(), "TEST_UNSET_VARIABLE") {
+		t.Errorf("unset variable wasn't reported, got %v", err)
+	}
+}
+
+func TestSetConfigValue(t *testing.T) {
+	cfg := Config{Feeds: map[string]*FeedConfig{
+		"/news": {RoomID: "!news:example.com", MaxEntries: 10, Languages: []string{"en", "fi"}},
+	}}
+	tests := []struct {
+		path     string
+		value    string
+		found    bool
+		hasError bool
+	}{
+		{"password", "hunter2", true, false},
+		{"rate_limit__rate", "2.5", true, false},
+		{"smtp__port", "465", true, false},
+		{"feeds__news__max_entries", "50", true, false},
+		{"feeds__news__languages__1", "sv", true, false},
+		{"feeds__news__languages__5", "sv", false, false},
+		{"feeds__missing__max_entries", "50", false, false},
+		{"no_such_key", "value", false, false},
+		{"smtp__port", "not a number", true, true},
+	}
+	for _, test := range tests {
+		found, err := setConfigValue(reflect.ValueOf(&cfg).Elem(), strings.Split(test.path, envPathSeparator), test.value)
+		if found != test.found || (err != nil) != test.hasError {
+			t.Errorf("%s: got found=%t err=%v, expected found=%t error=%t", test.path, found, err, test.found, test.hasError)
+		}
+	}
+	if cfg.Password != "hunter2" || cfg.RateLimit.Rate != 2.5 || cfg.SMTP.Port != 465 {
+		t.Errorf("top-level values weren't set: %q %f %d", cfg.Password, cfg.RateLimit.Rate, cfg.SMTP.Port)
+	}
+	news := cfg.Feeds["/news"]
+	if news.MaxEntries != 50 || strings.Join(news.Languages, ",") != "en,sv" || news.RoomID != "!news:example.com" {
+		t.Errorf("feed values weren't set correctly: %+v", news)
+	}
+}
+
+func TestApplyEnvOverrides(t *testing.T) {
+	secretPath := filepath.Join(t.TempDir(), "token")
+	if err := os.WriteFile(secretPath, []byte("from-file\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("FEEDSERV_ADMIN_TOKEN_FILE", secretPath)
+	t.Setenv("FEEDSERV_PASSWORD", "plain")
+	t.Setenv("FEEDSERV_PASSWORD_FILE", filepath.Join(t.TempDir(), "ignored"))
+	t.Setenv("FEEDSERV_FEEDS", `{"/news": {"room_id": "!news:example.com", "max_entries": 10}}`)
+	t.Setenv("FEEDSERV_FEEDS__NEWS__MAX_ENTRIES", "25")
+	t.Setenv("FEEDSERV_SERVICE_PORT", "tcp://10.0.0.1:80")
+	t.Setenv("FEEDSERV_CONFIG_PATH", "config.yaml")
+	var cfg Config
+	unknown, err := cfg.applyEnvOverrides()
+	if err != nil {
+		t.Fatal(err)
+	} else if cfg.AdminToken != "from-file" {
+		t.Errorf("_FILE variable wasn't read, got %q", cfg.AdminToken)
+	} else if cfg.Password != "plain" {
+		t.Errorf("plain variable didn't take precedence over _FILE, got %q", cfg.Password)
+	} else if feed := cfg.Feeds["/news"]; feed == nil || feed.MaxEntries != 25 {
+		t.Errorf("nested override wasn't applied after its section: %+v", feed)
+	} else if strings.Join(unknown, ",") != "FEEDSERV_SERVICE_PORT" {
+		t.Errorf("unexpected unknown variables %v", unknown)
+	}
+
+	t.Setenv("FEEDSERV_SMTP__PORT", "not a number")
+	if _, err = cfg.applyEnvOverrides(); err == nil || !strings.Contains(err.Error(), "FEEDSERV_SMTP__PORT") {
+		t.Errorf("invalid value wasn't reported, got %v", err)
+	}
+}
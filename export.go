@@ -0,0 +1,207 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+// exportDebounce is how long the exporter waits after a change before writing files,
+// so that bursts of events don't cause a rewrite for every single event.
+const exportDebounce = 2 * time.Second
+
+// FeedExporter writes feeds into a directory as static files, so that they can be served without feedserv.
+type FeedExporter struct {
+	fs  *FeedServ
+	Dir string
+	Log zerolog.Logger
+
+	changed     map[*FeedConfig]struct{}
+	changedLock sync.Mutex
+	changeCh    chan struct{}
+	written     map[string][32]byte
+}
+
+func NewFeedExporter(fs *FeedServ, dir string, log zerolog.Logger) (*FeedExporter, error) {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, err
+	}
+	if err = os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create output directory: %w", err)
+	}
+	return &FeedExporter{
+		fs:       fs,
+		Dir:      dir,
+		Log:      log,
+		changed:  make(map[*FeedConfig]struct{}),
+		changeCh: make(chan struct{}, 1),
+		written:  make(map[string][32]byte),
+	}, nil
+}
+
+// MarkChanged queues the given feed to be written on the next export. The caller must hold the update lock of the feed.
+func (exp *FeedExporter) MarkChanged(feed *FeedConfig) {
+	if feed.hidden || feed.Private {
+		return
+	}
+	exp.changedLock.Lock()
+	exp.changed[feed] = struct{}{}
+	exp.changedLock.Unlock()
+	select {
+	case exp.changeCh <- struct{}{}:
+	default:
+	}
+}
+
+// Run writes changed feeds until the context is canceled.
+func (exp *FeedExporter) Run(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-exp.changeCh:
+		}
+		select {
+		case <-ctx.Done():
+		case <-time.After(exportDebounce):
+		}
+		exp.Flush()
+	}
+}
+
+// Flush writes the feeds that have changed since the previous export.
+func (exp *FeedExporter) Flush() {
+	exp.changedLock.Lock()
+	changed := exp.changed
+	exp.changed = make(map[*FeedConfig]struct{})
+	exp.changedLock.Unlock()
+	if len(changed) == 0 {
+		return
+	}
+	for feed := range changed {
+		if err := exp.ExportFeed(feed); err != nil {
+			exp.Log.Err(err).Str("feed_id", feed.id).Msg("Failed to export feed")
+		}
+	}
+	if err := exp.ExportIndex(); err != nil {
+		exp.Log.Err(err).Msg("Failed to export feed index")
+	}
+}
+
+// ExportAll writes every feed and the feed index.
+func (exp *FeedExporter) ExportAll() error {
+	for _, feed := range exp.fs.Config.Feeds {
+		if feed.Private {
+			exp.Log.Warn().Str("feed_id", feed.id).Msg("Not exporting private feed")
+			continue
+		} else if err := exp.ExportFeed(feed); err != nil {
+			return fmt.Errorf("failed to export %s: %w", feed.id, err)
+		}
+	}
+	if err := exp.ExportIndex(); err != nil {
+		return fmt.Errorf("failed to export feed index: %w", err)
+	}
+	return nil
+}
+
+// ExportIndex writes the feed index as index.json and feeds.opml.
+func (exp *FeedExporter) ExportIndex() error {
+	indexData, err := json.Marshal(exp.fs.buildFeedIndex())
+	if err != nil {
+		return err
+	} else if err = exp.writeFile("/index.json", indexData); err != nil {
+		return err
+	}
+	var buf bytes.Buffer
+	if err = writeOPML(&buf, exp.fs.buildOPML()); err != nil {
+		return err
+	}
+	return exp.writeFile("/feeds.opml", buf.Bytes())
+}
+
+// ExportFeed writes every format of the given feed, including per-language sub-feeds.
+func (exp *FeedExporter) ExportFeed(feed *FeedConfig) error {
+	files := make(map[string][]byte)
+	addOutput := func(feedPath string, output *feedOutput) {
+		files[feedPath+".json"] = output.json
+		files[feedPath+".rss"] = output.rss
+		files[feedPath+".atom"] = output.atom
+		if feed.HTML {
+			files[feedPath+".html"] = output.html
+		}
+	}
+	feed.updateLock.RLock()
+	addOutput(feed.id, &feed.feedOutput)
+	for lang, output := range feed.languageOutputs {
+		addOutput(feed.id+"."+lang, output)
+	}
+	feed.updateLock.RUnlock()
+	count := 0
+	for filePath, data := range files {
+		if data == nil {
+			continue
+		}
+		if written, err := exp.writeFileIfChanged(filePath, data); err != nil {
+			return err
+		} else if written {
+			count++
+		}
+	}
+	if count > 0 {
+		exp.Log.Debug().Str("feed_id", feed.id).Int("file_count", count).Msg("Exported feed")
+	}
+	return nil
+}
+
+func (exp *FeedExporter) writeFileIfChanged(filePath string, data []byte) (bool, error) {
+	hash := sha256.Sum256(data)
+	if existing, ok := exp.written[filePath]; ok && existing == hash {
+		return false, nil
+	}
+	if err := exp.writeFile(filePath, data); err != nil {
+		return false, err
+	}
+	exp.written[filePath] = hash
+	return true, nil
+}
+
+// writeFile atomically replaces the file at the given feed path by writing to a temporary file and renaming it.
+func (exp *FeedExporter) writeFile(feedPath string, data []byte) error {
+	target := filepath.Join(exp.Dir, filepath.FromSlash(feedPath))
+	if !strings.HasPrefix(target, exp.Dir+string(filepath.Separator)) {
+		return fmt.Errorf("path %q is outside the output directory", feedPath)
+	}
+	dir := filepath.Dir(target)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(dir, "."+filepath.Base(target)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(data)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chmod(tmp.Name(), 0644)
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), target)
+	}
+	if err != nil {
+		_ = os.Remove(tmp.Name())
+		return fmt.Errorf("failed to write %s: %w", target, err)
+	}
+	return nil
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+type FeedFilter struct {
+	Senders       []id.UserID         `yaml:"senders"`
+	MsgTypes      []event.MessageType `yaml:"msgtypes"`
+	MinPowerLevel *int                `yaml:"min_power_level"`
+}
+
+// Matches checks whether the given event should be included in the feed.
+// A nil filter matches everything. Edits and redactions are always let through,
+// as they only apply if the original event is already in the feed. The caller
+// must hold the update lock of the feed.
+func (filter *FeedFilter) Matches(feed *FeedConfig, evt *event.Event) bool {
+	if filter == nil {
+		return true
+	}
+	content := evt.Content.AsMessage()
+	if content.RelatesTo.GetReplaceID() != "" || isPollUpdate(evt.Type) || evt.Type == event.EventRedaction {
+		return true
+	}
+	if len(filter.Senders) > 0 && !contains(filter.Senders, evt.Sender) {
+		return false
+	}
+	if len(filter.MsgTypes) > 0 && !contains(filter.MsgTypes, getFilterMsgType(evt)) {
+		return false
+	}
+	if filter.MinPowerLevel != nil {
+		if feed.powers.GetUserLevel(evt.Sender) < *filter.MinPowerLevel {
+			return false
+		}
+	}
+	return true
+}
+
+// getFilterMsgType returns the msgtype of the event for filtering. Event types without
+// msgtypes use pseudo-msgtypes: stickers are m.sticker and polls are m.poll.
+func getFilterMsgType(evt *event.Event) event.MessageType {
+	switch {
+	case evt.Type == event.EventSticker:
+		return "m.sticker"
+	case isPollStart(evt.Type):
+		return "m.poll"
+	default:
+		return evt.Content.AsMessage().MsgType
+	}
+}
+
+func contains[T comparable](list []T, item T) bool {
+	for _, listItem := range list {
+		if listItem == item {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog"
+	"golang.org/x/net/html"
+
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+	"maunium.net/go/mautrix/util"
+)
+
+type MediaGroupingConfig struct {
+	Enabled bool          `yaml:"enabled"`
+	Window  time.Duration `yaml:"window"`
+}
+
+type entryAttachment struct {
+	Media     *entryMedia
+	Thumbnail *entryMedia
+}
+
+func isMediaMessage(content *event.MessageEventContent) bool {
+	switch content.MsgType {
+	case event.MsgImage, event.MsgVideo, event.MsgAudio, event.MsgFile:
+		return content.URL != ""
+	default:
+		return false
+	}
+}
+
+// tryGroupMedia attaches a media message to the latest entry in the feed if it's a text message sent by
+// the same user within the grouping window. It returns the ID of the entry the event was grouped into, or
+// an empty string if the event should be added as a separate entry. The caller must hold the update lock of the feed.
+func (feed *FeedConfig) tryGroupMedia(log zerolog.Logger, evt *event.Event) id.EventID {
+	if !feed.GroupMedia.Enabled || !isMediaMessage(evt.Content.AsMessage()) {
+		return ""
+	}
+	var latest *event.Event
+	_ = feed.entries.Iter(func(_ id.EventID, val *event.Event) error {
+		latest = val
+		return util.StopIteration
+	})
+	if latest == nil || latest.Type != event.EventMessage || isMediaMessage(latest.Content.AsMessage()) ||
+		latest.Sender != evt.Sender || latest.Unsigned.RedactedBecause != nil {
+		return ""
+	}
+	lastTS := latest.Timestamp
+	if group := feed.groupedMedia[latest.ID]; len(group) > 0 {
+		lastTS = group[len(group)-1].Timestamp
+	}
+	if time.Duration(evt.Timestamp-lastTS)*time.Millisecond > feed.GroupMedia.Window {
+		return ""
+	}
+	feed.groupedMedia[latest.ID] = append(feed.groupedMedia[latest.ID], evt)
+	log.Debug().Str("group_event_id", latest.ID.String()).Msg("Grouped media message into previous entry")
+	return latest.ID
+}
+
+// findGroupedMedia finds a media message that was grouped into an entry. It returns the ID of the entry
+// and the index of the event in the group, or an empty ID if the event isn't grouped into any entry.
+// The caller must hold the update lock of the feed.
+func (feed *FeedConfig) findGroupedMedia(evtID id.EventID) (id.EventID, int) {
+	for parentID, group := range feed.groupedMedia {
+		for i, evt := range group {
+			if evt.ID == evtID {
+				return parentID, i
+			}
+		}
+	}
+	return "", -1
+}
+
+// pruneGroupedMedia removes grouped media whose parent entry has fallen out of the feed.
+// The caller must hold the update lock of the feed.
+func (feed *FeedConfig) pruneGroupedMedia() {
+	for parentID := range feed.groupedMedia {
+		if !feed.entries.Contains(parentID) {
+			delete(feed.groupedMedia, parentID)
+		}
+	}
+}
+
+// getEntryAttachments returns all media files of an entry, including any grouped media messages.
+func (fs *FeedServ) getEntryAttachments(entry feedEntry) []entryAttachment {
+	var attachments []entryAttachment
+	content := entry.Content.AsMessage()
+	if entry.Type == event.EventSticker {
+		stickerContent := *content
+		stickerContent.MsgType = event.MsgImage
+		content = &stickerContent
+	}
+	if media, thumbnail := fs.getEntryMedia(content); media != nil {
+		attachments = append(attachments, entryAttachment{Media: media, Thumbnail: thumbnail})
+	}
+	for _, evt := range entry.media {
+		if media, thumbnail := fs.getEntryMedia(evt.Content.AsMessage()); media != nil {
+			attachments = append(attachments, entryAttachment{Media: media, Thumbnail: thumbnail})
+		}
+	}
+	return attachments
+}
+
+// renderEntryHTML returns the HTML body of an entry. If the entry has grouped media messages,
+// they're appended to the body as inline images or links.
+func (fs *FeedServ) renderEntryHTML(entry feedEntry, rendered renderedContent, escapeFallback bool) string {
+	body := rendered.HTML
+	if body == "" && (escapeFallback || len(entry.media) > 0) {
+		body = escapeHTMLText(rendered.Text)
+	}
+	if len(entry.media) == 0 {
+		return body
+	}
+	var buf strings.Builder
+	buf.WriteString(body)
+	for _, evt := range entry.media {
+		media, _ := fs.getEntryMedia(evt.Content.AsMessage())
+		if media == nil {
+			continue
+		}
+		title := media.Title
+		if title == "" {
+			title = evt.Content.AsMessage().Body
+		}
+		if media.MsgType == event.MsgImage {
+			_, _ = fmt.Fprintf(&buf, `<p><img src="%s" alt="%s"></p>`, html.EscapeString(media.URL), html.EscapeString(title))
+		} else {
+			_, _ = fmt.Fprintf(&buf, `<p><a href="%s">%s</a></p>`, html.EscapeString(media.URL), html.EscapeString(title))
+		}
+	}
+	return buf.String()
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+func makeTestImage(roomID id.RoomID, evtID id.EventID, sender id.UserID, timestamp int64) *event.Event {
+	evt := makeTestMessage(roomID, evtID, sender, &event.MessageEventContent{MsgType: event.MsgImage, Body: "image.png", URL: "mxc://example.com/image"})
+	evt.Timestamp = timestamp
+	return evt
+}
+
+func TestGroupMediaIntoTextEntry(t *testing.T) {
+	log := zerolog.Nop()
+	feed := makeTestFeed("/test", "!room:example.com")
+	feed.GroupMedia = MediaGroupingConfig{Enabled: true, Window: 2 * time.Minute}
+	sender := id.UserID("@author:example.com")
+	text := makeTestMessage(feed.RoomID, "$text", sender, &event.MessageEventContent{MsgType: event.MsgText, Body: "Screenshots"})
+
+	feed.pushEvent(log, text)
+	if change, entryID := feed.pushEvent(log, makeTestImage(feed.RoomID, "$image1", sender, text.Timestamp+1000)); change != feedChangeUpdate || entryID != "$text" {
+		t.Fatalf("expected image to be grouped into text entry, got %v %s", change, entryID)
+	}
+	if change, _ := feed.pushEvent(log, makeTestImage(feed.RoomID, "$other", "@other:example.com", text.Timestamp+2000)); change != feedChangeAdd {
+		t.Fatalf("expected image from another user to be a separate entry, got %v", change)
+	}
+	// The latest entry is now an image, which other images must not be grouped into
+	if change, _ := feed.pushEvent(log, makeTestImage(feed.RoomID, "$image2", "@other:example.com", text.Timestamp+3000)); change != feedChangeAdd {
+		t.Fatalf("expected image after media entry to be a separate entry, got %v", change)
+	}
+	if group := feed.groupedMedia["$text"]; len(group) != 1 || group[0].ID != "$image1" {
+		t.Errorf("unexpected group: %v", group)
+	}
+	if _, ok := feed.groupedMedia["$other"]; ok {
+		t.Error("media was grouped into a media entry")
+	}
+}
+
+func TestEditAndRedactGroupedMedia(t *testing.T) {
+	log := zerolog.Nop()
+	feed := makeTestFeed("/test", "!room:example.com")
+	feed.GroupMedia = MediaGroupingConfig{Enabled: true, Window: 2 * time.Minute}
+	sender := id.UserID("@author:example.com")
+	text := makeTestMessage(feed.RoomID, "$text", sender, &event.MessageEventContent{MsgType: event.MsgText, Body: "Screenshots"})
+	feed.pushEvent(log, text)
+	feed.pushEvent(log, makeTestImage(feed.RoomID, "$image1", sender, text.Timestamp+1000))
+	feed.pushEvent(log, makeTestImage(feed.RoomID, "$image2", sender, text.Timestamp+2000))
+
+	edit := makeTestMessage(feed.RoomID, "$edit", sender, &event.MessageEventContent{
+		MsgType:    event.MsgImage,
+		Body:       "* renamed.png",
+		NewContent: &event.MessageEventContent{MsgType: event.MsgImage, Body: "renamed.png", URL: "mxc://example.com/renamed"},
+		RelatesTo:  &event.RelatesTo{Type: event.RelReplace, EventID: "$image1"},
+	})
+	if change, entryID := feed.pushEvent(log, edit); change != feedChangeUpdate || entryID != "$text" {
+		t.Fatalf("expected edit to update the grouped entry, got %v %s", change, entryID)
+	} else if body := feed.groupedMedia["$text"][0].Content.AsMessage().Body; body != "renamed.png" {
+		t.Errorf("edit not applied to grouped media: %q", body)
+	}
+
+	unauthorized := &event.Event{ID: "$redaction1", RoomID: feed.RoomID, Type: event.EventRedaction, Sender: "@other:example.com", Redacts: "$image1"}
+	if change, _ := feed.pushEvent(log, unauthorized); change != feedChangeNone {
+		t.Errorf("redaction by other user without power was applied: %v", change)
+	}
+	redaction := &event.Event{ID: "$redaction2", RoomID: feed.RoomID, Type: event.EventRedaction, Sender: sender, Redacts: "$image1"}
+	if change, entryID := feed.pushEvent(log, redaction); change != feedChangeUpdate || entryID != "$text" {
+		t.Fatalf("expected redaction to update the grouped entry, got %v %s", change, entryID)
+	}
+	if group := feed.groupedMedia["$text"]; len(group) != 1 || group[0].ID != "$image2" {
+		t.Errorf("redacted media wasn't removed from group: %v", group)
+	}
+	if evt, _ := feed.entries.Get("$text"); evt.Unsigned.RedactedBecause != nil {
+		t.Error("redacting grouped media redacted the whole entry")
+	}
+}
@@ -6,6 +6,7 @@ require (
 	github.com/gorilla/feeds v1.1.1
 	github.com/rs/zerolog v1.29.0
 	go.mau.fi/zeroconfig v0.1.2
+	golang.org/x/crypto v0.7.0
 	golang.org/x/net v0.8.0
 	gopkg.in/yaml.v3 v3.0.1
 	maunium.net/go/mautrix v0.15.1-0.20230405144343-a47718edca66
@@ -13,6 +14,8 @@ require (
 
 require (
 	github.com/coreos/go-systemd/v22 v22.3.3-0.20220203105225-a9a7ef127534 // indirect
+	github.com/gorilla/mux v1.8.0 // indirect
+	github.com/gorilla/websocket v1.5.0 // indirect
 	github.com/kr/pretty v0.3.1 // indirect
 	github.com/mattn/go-colorable v0.1.12 // indirect
 	github.com/mattn/go-isatty v0.0.14 // indirect
@@ -20,8 +23,8 @@ require (
 	github.com/tidwall/match v1.1.1 // indirect
 	github.com/tidwall/pretty v1.2.0 // indirect
 	github.com/tidwall/sjson v1.2.5 // indirect
-	golang.org/x/crypto v0.7.0 // indirect
 	golang.org/x/sys v0.6.0 // indirect
+	golang.org/x/text v0.8.0 // indirect
 	gopkg.in/natefinch/lumberjack.v2 v2.2.1 // indirect
 	maunium.net/go/maulogger/v2 v2.4.1 // indirect
 )
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	healthPath  = "/_feedserv/health"
+	metricsPath = "/_feedserv/metrics"
+)
+
+type respHealth struct {
+	Status        string                    `json:"status"`
+	UptimeSeconds int64                     `json:"uptime_seconds"`
+	Feeds         map[string]respFeedHealth `json:"feeds"`
+}
+
+type respFeedHealth struct {
+	Stale       bool       `json:"stale"`
+	StaleReason string     `json:"stale_reason,omitempty"`
+	StaleSince  *time.Time `json:"stale_since,omitempty"`
+	LastUpdate  time.Time  `json:"last_update"`
+}
+
+// sortedFeeds returns all feeds, including hidden aggregate sources, sorted by ID.
+func (fs *FeedServ) sortedFeeds() []*FeedConfig {
+	var feeds []*FeedConfig
+	seen := make(map[*FeedConfig]struct{})
+	for _, feed := range fs.Config.Feeds {
+		feeds = append(feeds, feed)
+		for _, source := range feed.sources {
+			if _, alreadySeen := seen[source]; source.hidden && !alreadySeen {
+				seen[source] = struct{}{}
+				feeds = append(feeds, source)
+			}
+		}
+	}
+	sort.Slice(feeds, func(i, j int) bool {
+		return feeds[i].id < feeds[j].id
+	})
+	return feeds
+}
+
+// isListed returns true if the feed can be shown in the health and metrics endpoints without authentication.
+// Private feeds and room IDs used directly as aggregate sources aren't listed.
+func (feed *FeedConfig) isListed() bool {
+	return !feed.Private && !feed.hidden
+}
+
+// serveHealth reports whether feedserv is in all the listed feed rooms.
+// The status code is always 200 while the server is running, as stale feeds aren't fixed by restarting.
+func (fs *FeedServ) serveHealth(w http.ResponseWriter, _ *http.Request) {
+	resp := respHealth{
+		Status:        "ok",
+		UptimeSeconds: int64(time.Since(fs.startTime).Seconds()),
+		Feeds:         make(map[string]respFeedHealth),
+	}
+	for _, feed := range fs.sortedFeeds() {
+		if !feed.isListed() {
+			continue
+		}
+		feed.updateLock.RLock()
+		feedHealth := respFeedHealth{
+			Stale:       feed.staleReason != "",
+			StaleReason: feed.staleReason,
+			LastUpdate:  feed.lastUpdate,
+		}
+		if feedHealth.Stale {
+			staleSince := feed.staleSince
+			feedHealth.StaleSince = &staleSince
+			resp.Status = "degraded"
+		}
+		feed.updateLock.RUnlock()
+		resp.Feeds[feed.id] = feedHealth
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	writeJSON(w, http.StatusOK, &resp)
+}
+
+var metricLabelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// serveMetrics serves metrics in the Prometheus text format. If the admin token is set, it's required,
+// otherwise only the listed feeds are included.
+func (fs *FeedServ) serveMetrics(w http.ResponseWriter, r *http.Request) {
+	if fs.Config.AdminToken != "" {
+		_, token, _ := strings.Cut(r.Header.Get("Authorization"), " ")
+		if subtle.ConstantTimeCompare([]byte(token), []byte(fs.Config.AdminToken)) != 1 {
+			writeError(w, http.StatusUnauthorized, "Invalid admin token")
+			return
+		}
+	}
+	var buf strings.Builder
+	writeMetric := func(name, help string) {
+		_, _ = fmt.Fprintf(&buf, "# HELP %s %s\n# TYPE %s gauge\n", name, help, name)
+	}
+	writeMetric("feedserv_uptime_seconds", "Time since feedserv was started.")
+	_, _ = fmt.Fprintf(&buf, "feedserv_uptime_seconds %d\n", int64(time.Since(fs.startTime).Seconds()))
+	if fs.ActivityPub != nil {
+		writeMetric("feedserv_activitypub_queue_length", "Number of ActivityPub deliveries waiting to be sent.")
+		_, _ = fmt.Fprintf(&buf, "feedserv_activitypub_queue_length %d\n", len(fs.ActivityPub.deliveries))
+	}
+
+	type feedMetrics struct {
+		label      string
+		stale      int
+		entries    int
+		lastUpdate int64
+	}
+	var metrics []feedMetrics
+	for _, feed := range fs.sortedFeeds() {
+		if fs.Config.AdminToken == "" && !feed.isListed() {
+			continue
+		}
+		feed.updateLock.RLock()
+		m := feedMetrics{
+			label:      metricLabelEscaper.Replace(feed.id),
+			lastUpdate: feed.lastUpdate.Unix(),
+		}
+		if feed.staleReason != "" {
+			m.stale = 1
+		}
+		if feed.entries != nil {
+			m.entries = feed.entries.Size()
+		}
+		feed.updateLock.RUnlock()
+		metrics = append(metrics, m)
+	}
+	writeMetric("feedserv_feed_stale", "Whether the feed isn't being updated because feedserv isn't in the room.")
+	for _, m := range metrics {
+		_, _ = fmt.Fprintf(&buf, "feedserv_feed_stale{feed=\"%s\"} %d\n", m.label, m.stale)
+	}
+	writeMetric("feedserv_feed_entries", "Number of entries stored for the feed.")
+	for _, m := range metrics {
+		_, _ = fmt.Fprintf(&buf, "feedserv_feed_entries{feed=\"%s\"} %d\n", m.label, m.entries)
+	}
+	writeMetric("feedserv_feed_last_update_timestamp_seconds", "Time when the feed was last regenerated.")
+	for _, m := range metrics {
+		_, _ = fmt.Fprintf(&buf, "feedserv_feed_last_update_timestamp_seconds{feed=\"%s\"} %d\n", m.label, m.lastUpdate)
+	}
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	_, _ = w.Write([]byte(buf.String()))
+}
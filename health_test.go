@@ -0,0 +1,84 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func makeTestHealthServer() *FeedServ {
+	public := makeTestFeed("/public", "!public:example.com")
+	private := makeTestFeed("/private", "!private:example.com")
+	private.Private = true
+	private.staleReason = staleReasonKicked
+	hiddenSource := makeTestFeed("!hidden:example.com", "!hidden:example.com")
+	hiddenSource.hidden = true
+	hiddenSource.staleReason = staleReasonBanned
+	aggregate := &FeedConfig{id: "/all", sources: []*FeedConfig{public, hiddenSource}}
+	return &FeedServ{
+		startTime: time.Now(),
+		Config: &Config{Feeds: map[string]*FeedConfig{
+			"/public":  public,
+			"/private": private,
+			"/all":     aggregate,
+		}},
+	}
+}
+
+func TestHealthOnlyIncludesListedFeeds(t *testing.T) {
+	fs := makeTestHealthServer()
+	rec := httptest.NewRecorder()
+	fs.serveHealth(rec, httptest.NewRequest(http.MethodGet, healthPath, nil))
+	var resp respHealth
+	if err := json.NewDecoder(rec.Body).Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+	// The stale private feed and hidden source must not affect the status either
+	if resp.Status != "ok" {
+		t.Errorf("expected status ok, got %s", resp.Status)
+	}
+	if len(resp.Feeds) != 2 {
+		t.Errorf("expected only /public and /all, got %v", resp.Feeds)
+	}
+
+	fs.Config.Feeds["/public"].staleReason = staleReasonLeft
+	rec = httptest.NewRecorder()
+	fs.serveHealth(rec, httptest.NewRequest(http.MethodGet, healthPath, nil))
+	if err := json.NewDecoder(rec.Body).Decode(&resp); err != nil {
+		t.Fatal(err)
+	} else if resp.Status != "degraded" {
+		t.Errorf("expected status degraded, got %s", resp.Status)
+	}
+}
+
+func TestMetricsHidePrivateFeedsWithoutAdminToken(t *testing.T) {
+	fs := makeTestHealthServer()
+	getMetrics := func(token string) string {
+		req := httptest.NewRequest(http.MethodGet, metricsPath, nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		rec := httptest.NewRecorder()
+		fs.serveMetrics(rec, req)
+		body, _ := io.ReadAll(rec.Body)
+		return string(body)
+	}
+
+	metrics := getMetrics("")
+	if !strings.Contains(metrics, `feed="/public"`) {
+		t.Error("public feed missing from metrics")
+	}
+	if strings.Contains(metrics, `feed="/private"`) || strings.Contains(metrics, `feed="!hidden:example.com"`) {
+		t.Errorf("metrics without admin token include unlisted feeds:\n%s", metrics)
+	}
+
+	fs.Config.AdminToken = "secret"
+	metrics = getMetrics("secret")
+	if !strings.Contains(metrics, `feed="/private"`) || !strings.Contains(metrics, `feed="!hidden:example.com"`) {
+		t.Errorf("metrics with admin token don't include all feeds:\n%s", metrics)
+	}
+}
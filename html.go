@@ -0,0 +1,195 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	_ "embed"
+	"fmt"
+	"html/template"
+	"os"
+	"strings"
+	"time"
+
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+
+	"maunium.net/go/mautrix/id"
+)
+
+const HTMLMime = "text/html; charset=utf-8"
+
+//go:embed templates/feed.html
+var defaultHTMLTemplate string
+
+type htmlAlternate struct {
+	Name string
+	Mime string
+	URL  string
+}
+
+type htmlPageData struct {
+	Feed       *JSONFeed
+	Alternates []htmlAlternate
+}
+
+func (fs *FeedServ) loadHTMLTemplate(path string) (*template.Template, error) {
+	tpl := template.New("feed.html").Funcs(template.FuncMap{
+		"sanitizeHTML": fs.sanitizeHTML,
+		"hasPrefix":    strings.HasPrefix,
+		"formatTime": func(ts *time.Time) string {
+			if ts == nil {
+				return ""
+			}
+			return ts.Format("2006-01-02 15:04 MST")
+		},
+	})
+	if path == "" {
+		return tpl.Parse(defaultHTMLTemplate)
+	}
+	// ParseFiles would name the template after the file, so the contents are parsed into the feed.html template instead
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read HTML template: %w", err)
+	}
+	return tpl.Parse(string(data))
+}
+
+func (fs *FeedServ) generateHTMLPage(feed *FeedConfig, feedPath string, jsonFeed *JSONFeed) ([]byte, string, error) {
+	data := &htmlPageData{Feed: jsonFeed}
+	for _, format := range feedFormats {
+		data.Alternates = append(data.Alternates, htmlAlternate{
+			Name: format.Name,
+			Mime: format.Mime,
+			URL:  fs.Config.PublicURL + feedPath + format.Ext,
+		})
+	}
+	var buf bytes.Buffer
+	err := feed.htmlTemplate.Execute(&buf, data)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to render HTML page: %w", err)
+	}
+	return buf.Bytes(), fmt.Sprintf(`"%x"`, sha256.Sum256(buf.Bytes())), nil
+}
+
+var allowedHTMLTags = map[atom.Atom]struct{}{
+	atom.Font: {}, atom.Del: {}, atom.H1: {}, atom.H2: {}, atom.H3: {}, atom.H4: {}, atom.H5: {}, atom.H6: {},
+	atom.Blockquote: {}, atom.P: {}, atom.A: {}, atom.Ul: {}, atom.Ol: {}, atom.Sup: {}, atom.Sub: {},
+	atom.Li: {}, atom.B: {}, atom.I: {}, atom.U: {}, atom.Strong: {}, atom.Em: {}, atom.Strike: {}, atom.S: {},
+	atom.Code: {}, atom.Hr: {}, atom.Br: {}, atom.Div: {}, atom.Table: {}, atom.Thead: {}, atom.Tbody: {},
+	atom.Tr: {}, atom.Th: {}, atom.Td: {}, atom.Caption: {}, atom.Pre: {}, atom.Span: {}, atom.Img: {},
+	atom.Details: {}, atom.Summary: {},
+}
+
+var droppedHTMLTags = map[atom.Atom]struct{}{
+	atom.Script: {}, atom.Style: {}, atom.Iframe: {}, atom.Object: {}, atom.Embed: {}, atom.Head: {}, atom.Title: {},
+}
+
+func isSafeURL(url string, allowMXC bool) bool {
+	lower := strings.ToLower(url)
+	return strings.HasPrefix(lower, "https://") || strings.HasPrefix(lower, "http://") ||
+		strings.HasPrefix(lower, "mailto:") || (allowMXC && strings.HasPrefix(lower, "mxc://"))
+}
+
+// sanitizeHTML strips everything except the tags and attributes allowed in Matrix formatted bodies,
+// so that message content can be embedded in the HTML page directly. Inline mxc:// images are
+// converted into media download URLs.
+func (fs *FeedServ) sanitizeHTML(input string) template.HTML {
+	nodes, err := html.ParseFragment(strings.NewReader(input), &html.Node{Type: html.ElementNode, Data: "div", DataAtom: atom.Div})
+	if err != nil {
+		return template.HTML(template.HTMLEscapeString(input))
+	}
+	var buf bytes.Buffer
+	for _, node := range nodes {
+		fs.writeSanitizedNode(&buf, node)
+	}
+	return template.HTML(buf.String())
+}
+
+// rewriteInlineMedia converts the mxc:// URLs of inline images into media download URLs without otherwise changing the HTML.
+func (fs *FeedServ) rewriteInlineMedia(input string) string {
+	if !strings.Contains(strings.ToLower(input), "mxc://") {
+		return input
+	}
+	var buf strings.Builder
+	tokenizer := html.NewTokenizer(strings.NewReader(input))
+	for {
+		tokenType := tokenizer.Next()
+		if tokenType == html.ErrorToken {
+			return buf.String()
+		}
+		// Token() lowercases the tag name in place, so the raw token has to be copied first
+		raw := string(tokenizer.Raw())
+		if tokenType != html.StartTagToken && tokenType != html.SelfClosingTagToken {
+			buf.WriteString(raw)
+			continue
+		}
+		token := tokenizer.Token()
+		rewritten := false
+		for i, attr := range token.Attr {
+			if token.DataAtom == atom.Img && attr.Key == "src" && strings.HasPrefix(strings.ToLower(attr.Val), "mxc://") {
+				token.Attr[i].Val = fs.mediaURL(id.ContentURIString(attr.Val).ParseOrIgnore())
+				rewritten = true
+			}
+		}
+		if rewritten {
+			buf.WriteString(token.String())
+		} else {
+			buf.WriteString(raw)
+		}
+	}
+}
+
+func (fs *FeedServ) writeSanitizedNode(buf *bytes.Buffer, node *html.Node) {
+	switch node.Type {
+	case html.TextNode:
+		buf.WriteString(html.EscapeString(node.Data))
+		return
+	case html.ElementNode:
+	default:
+		return
+	}
+	if _, dropped := droppedHTMLTags[node.DataAtom]; dropped || node.Data == "mx-reply" {
+		return
+	}
+	_, allowed := allowedHTMLTags[node.DataAtom]
+	if allowed {
+		buf.WriteByte('<')
+		buf.WriteString(node.Data)
+		for _, attr := range node.Attr {
+			var value string
+			switch {
+			case node.DataAtom == atom.A && attr.Key == "href" && isSafeURL(attr.Val, false):
+				value = attr.Val
+			case node.DataAtom == atom.Img && attr.Key == "src" && isSafeURL(attr.Val, true):
+				value = attr.Val
+				if strings.HasPrefix(strings.ToLower(value), "mxc://") {
+					value = fs.mediaURL(id.ContentURIString(value).ParseOrIgnore())
+				}
+			case node.DataAtom == atom.Img && (attr.Key == "alt" || attr.Key == "title" || attr.Key == "width" || attr.Key == "height"):
+				value = attr.Val
+			case node.DataAtom == atom.Ol && attr.Key == "start":
+				value = attr.Val
+			case node.DataAtom == atom.Code && attr.Key == "class" && strings.HasPrefix(attr.Val, "language-"):
+				value = attr.Val
+			default:
+				continue
+			}
+			_, _ = fmt.Fprintf(buf, ` %s="%s"`, attr.Key, html.EscapeString(value))
+		}
+		if node.DataAtom == atom.A {
+			buf.WriteString(` rel="nofollow noopener"`)
+		}
+		buf.WriteByte('>')
+		if node.DataAtom == atom.Br || node.DataAtom == atom.Hr || node.DataAtom == atom.Img {
+			return
+		}
+	}
+	for child := node.FirstChild; child != nil; child = child.NextSibling {
+		fs.writeSanitizedNode(buf, child)
+	}
+	if allowed {
+		buf.WriteString("</")
+		buf.WriteString(node.Data)
+		buf.WriteByte('>')
+	}
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLoadHTMLTemplateCustomFileName(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "branding.html")
+	err := os.WriteFile(path, []byte(`<h1>{{ .Feed.Title }}</h1>`), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fs := &FeedServ{Config: &Config{}}
+	tpl, err := fs.loadHTMLTemplate(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	feed := &FeedConfig{htmlTemplate: tpl}
+	page, _, err := fs.generateHTMLPage(feed, "/example", &JSONFeed{Title: "Example"})
+	if err != nil {
+		t.Fatal(err)
+	} else if string(page) != "<h1>Example</h1>" {
+		t.Errorf("unexpected page %q", page)
+	}
+}
+
+func TestLoadHTMLTemplateDefault(t *testing.T) {
+	fs := &FeedServ{Config: &Config{}}
+	if _, err := fs.loadHTMLTemplate(""); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRewriteInlineMedia(t *testing.T) {
+	fs := &FeedServ{Config: &Config{PublicURL: "https://feeds.example.com"}}
+	fs.MediaProxy = &MediaProxy{}
+	input := `<p>Look: <IMG src="mxc://example.com/abc" alt="cat"> <a href="mxc://example.com/def">link</a></p>`
+	expected := `<p>Look: <img src="https://feeds.example.com/_feedserv/media/example.com/abc" alt="cat"> <a href="mxc://example.com/def">link</a></p>`
+	if output := fs.rewriteInlineMedia(input); output != expected {
+		t.Errorf("unexpected output %q", output)
+	}
+	noMedia := `<p>Hello <b>world</b></p>`
+	if output := fs.rewriteInlineMedia(noMedia); output != noMedia {
+		t.Errorf("HTML without media was changed to %q", output)
+	}
+}
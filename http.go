@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"net/http"
 	"path"
+	"strconv"
 	"strings"
 	"time"
 )
@@ -21,13 +22,108 @@ func writeError(w http.ResponseWriter, status int, error string, args ...any) {
 	_ = json.NewEncoder(w).Encode(map[string]any{"error": fmt.Sprintf(error, args...)})
 }
 
+func writeJSON(w http.ResponseWriter, status int, data any) {
+	w.Header().Add("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(data)
+}
+
+var feedFormats = []struct {
+	Name string
+	Ext  string
+	Mime string
+}{
+	{"JSON Feed", ".json", JSONFeedMime},
+	{"RSS", ".rss", RSSMime},
+	{"Atom", ".atom", AtomMime},
+}
+
+// negotiateFeedMime picks the feed format for the extensionless feed path based on the Accept header.
+// JSON Feed is used if the client doesn't express a preference for any supported format.
+// HTML is only considered if the feed has an HTML page enabled.
+func negotiateFeedMime(accept string, allowHTML bool) string {
+	best := JSONFeedMime
+	bestQuality := 0.0
+	for _, part := range strings.Split(accept, ",") {
+		params := strings.Split(part, ";")
+		mediaType := strings.ToLower(strings.TrimSpace(params[0]))
+		quality := 1.0
+		for _, param := range params[1:] {
+			key, value, _ := strings.Cut(strings.TrimSpace(param), "=")
+			if strings.ToLower(key) == "q" {
+				if parsed, err := strconv.ParseFloat(value, 64); err == nil {
+					quality = parsed
+				}
+			}
+		}
+		var mime string
+		switch mediaType {
+		case JSONFeedMime, "application/json":
+			mime = JSONFeedMime
+		case RSSMime, "application/xml", "text/xml":
+			// Many RSS and Atom readers only ask for generic XML, which RSS is the most widely supported kind of
+			mime = RSSMime
+		case AtomMime:
+			mime = AtomMime
+		case "text/html", "application/xhtml+xml":
+			if !allowHTML {
+				continue
+			}
+			mime = HTMLMime
+		default:
+			continue
+		}
+		if quality > bestQuality {
+			best = mime
+			bestQuality = quality
+		}
+	}
+	return best
+}
+
+func (fs *FeedServ) addAlternateLinks(w http.ResponseWriter, feed *FeedConfig, feedPath string) {
+	for _, format := range feedFormats {
+		w.Header().Add("Link", fmt.Sprintf(`<%s%s%s>; rel="alternate"; type="%s"`, fs.Config.PublicURL, feedPath, format.Ext, format.Mime))
+	}
+	if feed.HTML {
+		w.Header().Add("Link", fmt.Sprintf(`<%s%s.html>; rel="alternate"; type="text/html"`, fs.Config.PublicURL, feedPath))
+	}
+}
+
 func (fs *FeedServ) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if fs.MediaProxy != nil && strings.HasPrefix(r.URL.Path, mediaProxyPrefix) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			w.Header().Add("Allow", "GET, HEAD")
+			writeError(w, http.StatusMethodNotAllowed, "Unsupported method %q", r.Method)
+			return
+		}
+		fs.MediaProxy.ServeHTTP(w, r)
+		return
+	}
+	if fs.ActivityPub != nil && (strings.HasPrefix(r.URL.Path, activityPubPrefix) || r.URL.Path == webFingerPath) {
+		fs.ActivityPub.ServeHTTP(w, r)
+		return
+	}
+	if r.URL.Path == healthPath {
+		fs.serveHealth(w, r)
+		return
+	} else if r.URL.Path == metricsPath {
+		fs.serveMetrics(w, r)
+		return
+	}
+	if fs.Tokens != nil && (r.URL.Path == adminTokensPath || strings.HasPrefix(r.URL.Path, adminTokensPath+"/")) {
+		fs.Tokens.ServeAdmin(w, r)
+		return
+	} else if fs.Tokens != nil && r.URL.Path == openIDSubscribePath {
+		fs.Tokens.ServeOpenID(w, r)
+		return
+	}
 	start := time.Now()
 	feedPath := strings.ToLower(r.URL.Path)
 	log := fs.Log.With().
 		Str("feed_path", feedPath).
 		Str("method", r.Method).
-		Str("cloudflare_remote_ip", r.Header.Get("CF-Connecting-IP")).
+		Str("remote_ip", fs.clientIP(r)).
 		Logger()
 	if r.Method != http.MethodGet && r.Method != http.MethodHead {
 		log.Warn().Msg("Requested with incorrect HTTP method")
@@ -35,51 +131,104 @@ func (fs *FeedServ) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		writeError(w, http.StatusMethodNotAllowed, "Unsupported method %q", r.Method)
 		return
 	}
+	switch feedPath {
+	case "/", "/index.json":
+		fs.serveIndex(w, r)
+		log.Debug().Dur("duration", time.Since(start)).Msg("Served feed index")
+		return
+	case "/feeds.opml":
+		fs.serveOPML(w, r)
+		log.Debug().Dur("duration", time.Since(start)).Msg("Served OPML export")
+		return
+	}
 	ext := path.Ext(feedPath)
-	feedPath = feedPath[:len(feedPath)-len(ext)]
-	var mime string
 	switch ext {
-	case ".json", "":
-		mime = JSONFeedMime
-	case ".rss":
-		mime = RSSMime
-	case ".atom":
-		mime = AtomMime
+	case ".json", ".rss", ".atom", ".html":
+		feedPath = feedPath[:len(feedPath)-len(ext)]
 	default:
-		log.Warn().Msg("Requested unsupported feed type")
-		writeError(w, http.StatusNotFound, "Unsupported feed type %q", ext)
-		return
+		ext = ""
 	}
 
+	var language string
 	feed, ok := fs.Config.Feeds[feedPath]
+	if !ok {
+		if langExt := path.Ext(feedPath); len(langExt) > 1 {
+			language = langExt[1:]
+			feed, ok = fs.Config.Feeds[feedPath[:len(feedPath)-len(langExt)]]
+		}
+	}
 	if !ok {
 		log.Warn().Msg("Requested unknown feed")
 		writeError(w, http.StatusNotFound, "Feed %q not found", feedPath)
 		return
 	}
 
+	if !fs.authorizeFeed(w, r, feed) {
+		log.Warn().Msg("Unauthorized request to private feed")
+		return
+	}
+
+	var mime string
+	switch ext {
+	case "":
+		mime = negotiateFeedMime(r.Header.Get("Accept"), feed.HTML)
+		w.Header().Add("Vary", "Accept")
+	case ".json":
+		mime = JSONFeedMime
+	case ".rss":
+		mime = RSSMime
+	case ".atom":
+		mime = AtomMime
+	case ".html":
+		if !feed.HTML {
+			log.Warn().Msg("Requested HTML page of feed without HTML enabled")
+			writeError(w, http.StatusNotFound, "Unsupported feed type %q", ext)
+			return
+		}
+		mime = HTMLMime
+	}
+
 	feed.updateLock.RLock()
+	output := &feed.feedOutput
+	if language != "" {
+		output, ok = feed.languageOutputs[language]
+		if !ok {
+			feed.updateLock.RUnlock()
+			log.Warn().Str("language", language).Msg("Requested unknown language of feed")
+			writeError(w, http.StatusNotFound, "Feed %q has no entries in language %q", feed.id, language)
+			return
+		}
+	}
 	var data []byte
 	var hash string
 	lastMod := feed.lastUpdate
 	switch mime {
 	case JSONFeedMime:
-		data = feed.json
-		hash = feed.jsonHash
+		data = output.json
+		hash = output.jsonHash
 	case RSSMime:
-		data = feed.rss
-		hash = feed.rssHash
+		data = output.rss
+		hash = output.rssHash
 	case AtomMime:
-		data = feed.atom
-		hash = feed.atomHash
+		data = output.atom
+		hash = output.atomHash
+	case HTMLMime:
+		data = output.html
+		hash = output.htmlHash
 	default:
 		panic(fmt.Errorf("incorrect mime %q", mime))
 	}
 	feed.updateLock.RUnlock()
 
+	fs.addAlternateLinks(w, feed, feedPath)
 	w.Header().Add("Last-Modified", lastMod.Format(http.TimeFormat))
 	w.Header().Add("ETag", hash)
-	w.Header().Add("Cache-Control", "public, max-age=60, s-maxage=60, stale-while-revalidate=60, stale-if-error=86400")
+	if feed.Private {
+		w.Header().Add("Cache-Control", "private, max-age=60")
+		w.Header().Add("Vary", "Authorization")
+	} else {
+		w.Header().Add("Cache-Control", "public, max-age=60, s-maxage=60, stale-while-revalidate=60, stale-if-error=86400")
+	}
 
 	if r.Header.Get("If-None-Match") == hash {
 		w.WriteHeader(http.StatusNotModified)
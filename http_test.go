@@ -0,0 +1,36 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestNegotiateFeedMime(t *testing.T) {
+	tests := []struct {
+		accept    string
+		allowHTML bool
+		expected  string
+	}{
+		{"", false, JSONFeedMime},
+		{"*/*", true, JSONFeedMime},
+		{"application/rss+xml", false, RSSMime},
+		{"Application/Atom+XML", false, AtomMime},
+		{"application/json", false, JSONFeedMime},
+		{"application/rss+xml;q=0.5, application/atom+xml;q=0.9", false, AtomMime},
+		{"application/atom+xml;q=0.9, application/rss+xml", false, RSSMime},
+		{"text/html,application/xhtml+xml,application/xml;q=0.9,*/*;q=0.8", true, HTMLMime},
+		{"text/html,application/xhtml+xml,application/xml;q=0.9,*/*;q=0.8", false, RSSMime},
+		{"application/xml", false, RSSMime},
+		{"text/xml", true, RSSMime},
+		{"application/xml;q=0.5, application/atom+xml", false, AtomMime},
+		{"text/xml;q=0.5, application/json", false, JSONFeedMime},
+		{"text/html;q=0.5, application/rss+xml;q=0.8", true, RSSMime},
+		{"application/rss+xml;q=0", false, JSONFeedMime},
+		{"application/rss+xml;q=invalid", false, RSSMime},
+		{"image/png", false, JSONFeedMime},
+	}
+	for _, test := range tests {
+		if mime := negotiateFeedMime(test.accept, test.allowHTML); mime != test.expected {
+			t.Errorf("negotiateFeedMime(%q, %t) = %q, expected %q", test.accept, test.allowHTML, mime, test.expected)
+		}
+	}
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// maxSignatureClockSkew is the maximum difference between the Date header of a signed request and the local time.
+const maxSignatureClockSkew = 12 * time.Hour
+
+var defaultSignedHeaders = []string{"(request-target)", "host", "date", "digest"}
+
+// loadOrGenerateKey reads an RSA private key from the given PEM file, or generates a new one if the file doesn't exist.
+func loadOrGenerateKey(path string) (*rsa.PrivateKey, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		key, err := rsa.GenerateKey(rand.Reader, 2048)
+		if err != nil {
+			return nil, fmt.Errorf("failed to generate key: %w", err)
+		}
+		der, err := x509.MarshalPKCS8PrivateKey(key)
+		if err != nil {
+			return nil, fmt.Errorf("failed to marshal key: %w", err)
+		}
+		err = os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0600)
+		if err != nil {
+			return nil, fmt.Errorf("failed to save key: %w", err)
+		}
+		return key, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to read key: %w", err)
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM data found in %s", path)
+	}
+	var key any
+	if block.Type == "RSA PRIVATE KEY" {
+		key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	} else {
+		key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse key: %w", err)
+	}
+	rsaKey, ok := key.(*rsa.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("unsupported key type %T", key)
+	}
+	return rsaKey, nil
+}
+
+func encodePublicKey(key *rsa.PublicKey) (string, error) {
+	der, err := x509.MarshalPKIXPublicKey(key)
+	if err != nil {
+		return "", err
+	}
+	return string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})), nil
+}
+
+func parsePublicKey(data string) (*rsa.PublicKey, error) {
+	block, _ := pem.Decode([]byte(data))
+	if block == nil {
+		return nil, fmt.Errorf("no PEM data found")
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	rsaKey, ok := key.(*rsa.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("unsupported key type %T", key)
+	}
+	return rsaKey, nil
+}
+
+func makeDigest(body []byte) string {
+	hash := sha256.Sum256(body)
+	return "SHA-256=" + base64.StdEncoding.EncodeToString(hash[:])
+}
+
+func buildSigningString(r *http.Request, headers []string) (string, error) {
+	lines := make([]string, len(headers))
+	for i, header := range headers {
+		var value string
+		switch header {
+		case "(request-target)":
+			value = strings.ToLower(r.Method) + " " + r.URL.RequestURI()
+		case "host":
+			value = r.Host
+			if value == "" {
+				value = r.URL.Host
+			}
+		default:
+			values := r.Header.Values(header)
+			if len(values) == 0 {
+				return "", fmt.Errorf("signed header %q is missing", header)
+			}
+			value = strings.Join(values, ", ")
+		}
+		lines[i] = header + ": " + value
+	}
+	return strings.Join(lines, "\n"), nil
+}
+
+// signRequest adds the Date, Digest and Signature headers to an outgoing request
+// as defined in draft-cavage-http-signatures, which is what the fediverse uses.
+func signRequest(r *http.Request, body []byte, keyID string, key *rsa.PrivateKey) error {
+	r.Header.Set("Date", time.Now().UTC().Format(http.TimeFormat))
+	headers := defaultSignedHeaders
+	if body != nil {
+		r.Header.Set("Digest", makeDigest(body))
+	} else {
+		headers = headers[:3]
+	}
+	signingString, err := buildSigningString(r, headers)
+	if err != nil {
+		return err
+	}
+	hash := sha256.Sum256([]byte(signingString))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, hash[:])
+	if err != nil {
+		return fmt.Errorf("failed to sign request: %w", err)
+	}
+	r.Header.Set("Signature", fmt.Sprintf(
+		`keyId="%s",algorithm="rsa-sha256",headers="%s",signature="%s"`,
+		keyID, strings.Join(headers, " "), base64.StdEncoding.EncodeToString(signature),
+	))
+	return nil
+}
+
+type parsedSignature struct {
+	KeyID     string
+	Headers   []string
+	Signature []byte
+}
+
+func parseSignatureHeader(header string) (*parsedSignature, error) {
+	var sig parsedSignature
+	for _, part := range strings.Split(header, ",") {
+		key, value, ok := strings.Cut(strings.TrimSpace(part), "=")
+		if !ok {
+			continue
+		}
+		value = strings.Trim(value, `"`)
+		switch key {
+		case "keyId":
+			sig.KeyID = value
+		case "headers":
+			sig.Headers = strings.Fields(strings.ToLower(value))
+		case "signature":
+			var err error
+			sig.Signature, err = base64.StdEncoding.DecodeString(value)
+			if err != nil {
+				return nil, fmt.Errorf("invalid signature encoding: %w", err)
+			}
+		}
+	}
+	if sig.KeyID == "" || len(sig.Signature) == 0 {
+		return nil, fmt.Errorf("signature header is missing keyId or signature")
+	} else if len(sig.Headers) == 0 {
+		sig.Headers = []string{"date"}
+	}
+	return &sig, nil
+}
+
+// verifyRequestSignature checks the HTTP signature of an incoming request against the given public key.
+// The body digest and date must also be signed, so that signatures can't be replayed with different content.
+func verifyRequestSignature(r *http.Request, body []byte, sig *parsedSignature, key *rsa.PublicKey) error {
+	if !contains(sig.Headers, "(request-target)") || !contains(sig.Headers, "digest") || !contains(sig.Headers, "date") {
+		return fmt.Errorf("signature must cover (request-target), date and digest")
+	}
+	date, err := http.ParseTime(r.Header.Get("Date"))
+	if err != nil {
+		return fmt.Errorf("invalid date header: %w", err)
+	} else if diff := time.Since(date); diff > maxSignatureClockSkew || diff < -maxSignatureClockSkew {
+		return fmt.Errorf("date header is too far from current time")
+	}
+	algorithm, digest, _ := strings.Cut(r.Header.Get("Digest"), "=")
+	_, expectedDigest, _ := strings.Cut(makeDigest(body), "=")
+	if !strings.EqualFold(algorithm, "SHA-256") || digest != expectedDigest {
+		return fmt.Errorf("body digest doesn't match")
+	}
+	signingString, err := buildSigningString(r, sig.Headers)
+	if err != nil {
+		return err
+	}
+	hash := sha256.Sum256([]byte(signingString))
+	return rsa.VerifyPKCS1v15(key, crypto.SHA256, hash[:], sig.Signature)
+}
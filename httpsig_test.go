@@ -0,0 +1,115 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHTTPSignatureRoundTrip(t *testing.T) {
+	body := []byte(`{"type":"Follow"}`)
+	keyPath := filepath.Join(t.TempDir(), "key.pem")
+	key, err := loadOrGenerateKey(keyPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := httptest.NewRequest(http.MethodPost, "https://example.com/inbox", bytes.NewReader(body))
+	if err = signRequest(req, body, "https://remote.example/users/a#main-key", key); err != nil {
+		t.Fatal(err)
+	}
+	sig, err := parseSignatureHeader(req.Header.Get("Signature"))
+	if err != nil {
+		t.Fatal(err)
+	} else if sig.KeyID != "https://remote.example/users/a#main-key" {
+		t.Errorf("unexpected key ID %q", sig.KeyID)
+	}
+	// The public key goes through the same encoding as the actor document
+	publicKeyPEM, err := encodePublicKey(&key.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	publicKey, err := parsePublicKey(publicKeyPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = verifyRequestSignature(req, body, sig, publicKey); err != nil {
+		t.Errorf("valid signature was rejected: %v", err)
+	}
+	// Loading the key again must return the saved key rather than generating a new one
+	reloaded, err := loadOrGenerateKey(keyPath)
+	if err != nil {
+		t.Fatal(err)
+	} else if !reloaded.Equal(key) {
+		t.Error("reloaded key doesn't match the generated key")
+	}
+}
+
+func TestHTTPSignatureRejectsTampering(t *testing.T) {
+	body := []byte(`{"type":"Follow"}`)
+	tests := []struct {
+		name   string
+		modify func(req *http.Request, sig *parsedSignature) []byte
+	}{
+		{"modified body", func(req *http.Request, sig *parsedSignature) []byte {
+			return []byte(`{"type":"Undo"}`)
+		}},
+		{"modified path", func(req *http.Request, sig *parsedSignature) []byte {
+			req.URL.Path = "/other/inbox"
+			return body
+		}},
+		{"old date", func(req *http.Request, sig *parsedSignature) []byte {
+			req.Header.Set("Date", time.Now().Add(-24*time.Hour).UTC().Format(http.TimeFormat))
+			return body
+		}},
+		{"digest not signed", func(req *http.Request, sig *parsedSignature) []byte {
+			sig.Headers = []string{"(request-target)", "host", "date"}
+			return body
+		}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			key, err := loadOrGenerateKey(filepath.Join(t.TempDir(), "key.pem"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			req := httptest.NewRequest(http.MethodPost, "https://example.com/inbox", bytes.NewReader(body))
+			if err = signRequest(req, body, "https://remote.example/users/a#main-key", key); err != nil {
+				t.Fatal(err)
+			}
+			sig, err := parseSignatureHeader(req.Header.Get("Signature"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			receivedBody := test.modify(req, sig)
+			if err = verifyRequestSignature(req, receivedBody, sig, &key.PublicKey); err == nil {
+				t.Error("tampered request was accepted")
+			}
+		})
+	}
+}
+
+func TestParseSignatureHeader(t *testing.T) {
+	sig, err := parseSignatureHeader(`keyId="https://remote.example/users/a#main-key",algorithm="rsa-sha256",headers="(request-target) Host Date",signature="c2lnbmF0dXJl"`)
+	if err != nil {
+		t.Fatal(err)
+	} else if strings.Join(sig.Headers, " ") != "(request-target) host date" {
+		t.Errorf("unexpected headers %q", sig.Headers)
+	} else if string(sig.Signature) != "signature" {
+		t.Errorf("unexpected signature %q", sig.Signature)
+	}
+	sig, err = parseSignatureHeader(`keyId="key",signature="c2lnbmF0dXJl"`)
+	if err != nil {
+		t.Fatal(err)
+	} else if strings.Join(sig.Headers, " ") != "date" {
+		t.Errorf("headers should default to date, got %q", sig.Headers)
+	}
+	for _, invalid := range []string{`keyId="key"`, `signature="c2lnbmF0dXJl"`, `keyId="key",signature="!!!"`} {
+		if _, err = parseSignatureHeader(invalid); err == nil {
+			t.Errorf("invalid header %q was accepted", invalid)
+		}
+	}
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"io"
+	"net/http"
+	"sort"
+	"time"
+)
+
+const OPMLMime = "text/x-opml"
+
+type FeedIndex struct {
+	Feeds []FeedIndexEntry `json:"feeds"`
+}
+
+type FeedIndexEntry struct {
+	ID          string            `json:"id"`
+	Title       string            `json:"title"`
+	Description string            `json:"description,omitempty"`
+	Homepage    string            `json:"home_page_url,omitempty"`
+	Icon        string            `json:"icon,omitempty"`
+	Language    string            `json:"language,omitempty"`
+	Languages   []string          `json:"languages,omitempty"`
+	URLs        map[string]string `json:"urls"`
+}
+
+type opmlDocument struct {
+	XMLName xml.Name `xml:"opml"`
+	Version string   `xml:"version,attr"`
+	Head    opmlHead `xml:"head"`
+	Body    opmlBody `xml:"body"`
+}
+
+type opmlHead struct {
+	Title       string `xml:"title"`
+	DateCreated string `xml:"dateCreated"`
+}
+
+type opmlBody struct {
+	Outlines []opmlOutline `xml:"outline"`
+}
+
+type opmlOutline struct {
+	Type        string `xml:"type,attr"`
+	Text        string `xml:"text,attr"`
+	Title       string `xml:"title,attr"`
+	Description string `xml:"description,attr,omitempty"`
+	Language    string `xml:"language,attr,omitempty"`
+	XMLURL      string `xml:"xmlUrl,attr"`
+	HTMLURL     string `xml:"htmlUrl,attr,omitempty"`
+}
+
+func (fs *FeedServ) buildFeedIndex() *FeedIndex {
+	index := &FeedIndex{Feeds: make([]FeedIndexEntry, 0, len(fs.Config.Feeds))}
+	for feedID, feed := range fs.Config.Feeds {
+		if feed.Private {
+			continue
+		}
+		feed.updateLock.RLock()
+		entry := FeedIndexEntry{
+			ID:          feedID,
+			Title:       feed.title,
+			Description: feed.description,
+			Homepage:    feed.Homepage,
+			Icon:        feed.icon,
+			Language:    feed.Language,
+			URLs:        make(map[string]string, len(feedFormats)+1),
+		}
+		for lang := range feed.languageOutputs {
+			entry.Languages = append(entry.Languages, lang)
+		}
+		feed.updateLock.RUnlock()
+		sort.Strings(entry.Languages)
+		if entry.Title == "" {
+			entry.Title = feedID
+		}
+		for _, format := range feedFormats {
+			entry.URLs[format.Ext[1:]] = fs.Config.PublicURL + feedID + format.Ext
+		}
+		if feed.HTML {
+			entry.URLs["html"] = fs.Config.PublicURL + feedID + ".html"
+		}
+		index.Feeds = append(index.Feeds, entry)
+	}
+	sort.Slice(index.Feeds, func(i, j int) bool {
+		return index.Feeds[i].ID < index.Feeds[j].ID
+	})
+	return index
+}
+
+func (fs *FeedServ) serveIndex(w http.ResponseWriter, r *http.Request) {
+	w.Header().Add("Content-Type", "application/json")
+	w.Header().Add("Cache-Control", "public, max-age=60, s-maxage=60")
+	w.WriteHeader(http.StatusOK)
+	if r.Method != http.MethodHead {
+		_ = json.NewEncoder(w).Encode(fs.buildFeedIndex())
+	}
+}
+
+func (fs *FeedServ) buildOPML() *opmlDocument {
+	index := fs.buildFeedIndex()
+	doc := &opmlDocument{
+		Version: "2.0",
+		Head: opmlHead{
+			Title:       "feedserv feeds",
+			DateCreated: time.Now().UTC().Format(time.RFC1123Z),
+		},
+	}
+	for _, entry := range index.Feeds {
+		htmlURL := entry.Homepage
+		if htmlURL == "" {
+			htmlURL = entry.URLs["html"]
+		}
+		doc.Body.Outlines = append(doc.Body.Outlines, opmlOutline{
+			Type:        "rss",
+			Text:        entry.Title,
+			Title:       entry.Title,
+			Description: entry.Description,
+			Language:    entry.Language,
+			XMLURL:      entry.URLs["rss"],
+			HTMLURL:     htmlURL,
+		})
+	}
+	return doc
+}
+
+func writeOPML(w io.Writer, doc *opmlDocument) error {
+	if _, err := w.Write([]byte(xml.Header)); err != nil {
+		return err
+	}
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "  ")
+	return enc.Encode(doc)
+}
+
+func (fs *FeedServ) serveOPML(w http.ResponseWriter, r *http.Request) {
+	doc := fs.buildOPML()
+	w.Header().Add("Content-Type", OPMLMime)
+	w.Header().Add("Content-Disposition", `inline; filename="feeds.opml"`)
+	w.Header().Add("Cache-Control", "public, max-age=60, s-maxage=60")
+	w.WriteHeader(http.StatusOK)
+	if r.Method != http.MethodHead {
+		_ = writeOPML(w, doc)
+	}
+}
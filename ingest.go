@@ -0,0 +1,457 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"html"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+	xhtml "golang.org/x/net/html"
+
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+const (
+	ingestAccountDataType = "com.beeper.feedserv.ingest"
+
+	defaultIngestInterval = 15 * time.Minute
+	maxIngestFeedSize     = 10 * 1024 * 1024
+	maxIngestSeenItems    = 1000
+	maxIngestSummaryLen   = 500
+)
+
+type IngestConfig struct {
+	URL       string        `yaml:"url"`
+	RoomAlias id.RoomAlias  `yaml:"room_alias"`
+	RoomID    id.RoomID     `yaml:"room_id"`
+	Interval  time.Duration `yaml:"interval"`
+	Notice    bool          `yaml:"notice"`
+	Summary   bool          `yaml:"summary"`
+	Backfill  int           `yaml:"backfill"`
+}
+
+type ingestSourceState struct {
+	ETag         string   `json:"etag,omitempty"`
+	LastModified string   `json:"last_modified,omitempty"`
+	Seen         []string `json:"seen"`
+}
+
+type ingestState struct {
+	Sources map[string]*ingestSourceState `json:"sources"`
+}
+
+// ingestItem is a single item of an external feed in any of the supported formats.
+type ingestItem struct {
+	ID      string
+	Title   string
+	URL     string
+	Summary string
+}
+
+type ingestRSSItem struct {
+	GUID        string `xml:"guid"`
+	Title       string `xml:"title"`
+	Link        string `xml:"link"`
+	Description string `xml:"description"`
+}
+
+type ingestRSS struct {
+	Channel struct {
+		Items []ingestRSSItem `xml:"item"`
+	} `xml:"channel"`
+	// RSS 1.0 (RDF) feeds have items at the top level
+	Items []ingestRSSItem `xml:"item"`
+}
+
+type ingestAtom struct {
+	Entries []struct {
+		ID    string `xml:"id"`
+		Title string `xml:"title"`
+		Links []struct {
+			Href string `xml:"href,attr"`
+			Rel  string `xml:"rel,attr"`
+		} `xml:"link"`
+		Summary string `xml:"summary"`
+		Content string `xml:"content"`
+	} `xml:"entry"`
+}
+
+// FeedIngester polls external RSS, Atom and JSON feeds and posts new items into Matrix rooms.
+type FeedIngester struct {
+	Config []*IngestConfig
+	Client *mautrix.Client
+	Log    zerolog.Logger
+
+	http      *http.Client
+	state     ingestState
+	stateLock sync.Mutex
+}
+
+func NewFeedIngester(cfg []*IngestConfig, cli *mautrix.Client, log zerolog.Logger) (*FeedIngester, error) {
+	fi := &FeedIngester{
+		Config: cfg,
+		Client: cli,
+		Log:    log,
+		http:   &http.Client{Timeout: 30 * time.Second},
+	}
+	err := cli.GetAccountData(ingestAccountDataType, &fi.state)
+	if err != nil && !errors.Is(err, mautrix.MNotFound) {
+		return nil, fmt.Errorf("failed to load ingest state: %w", err)
+	}
+	if fi.state.Sources == nil {
+		fi.state.Sources = make(map[string]*ingestSourceState)
+	}
+	for _, source := range cfg {
+		if source.URL == "" {
+			return nil, fmt.Errorf("ingest source is missing URL")
+		}
+		if source.Interval <= 0 {
+			source.Interval = defaultIngestInterval
+		}
+		if source.RoomID == "" && source.RoomAlias != "" {
+			resp, err := cli.ResolveAlias(source.RoomAlias)
+			if err != nil {
+				return nil, fmt.Errorf("failed to resolve room alias %s: %w", source.RoomAlias, err)
+			}
+			source.RoomID = resp.RoomID
+		} else if source.RoomID == "" {
+			return nil, fmt.Errorf("ingest source %s is missing room", source.URL)
+		}
+		if _, err = cli.JoinRoomByID(source.RoomID); err != nil {
+			log.Warn().Err(err).Str("room_id", source.RoomID.String()).Msg("Error joining ingest room")
+		}
+	}
+	return fi, nil
+}
+
+// HasRoom returns true if any external feed is ingested into the given room.
+func (fi *FeedIngester) HasRoom(roomID id.RoomID) bool {
+	for _, source := range fi.Config {
+		if source.RoomID == roomID {
+			return true
+		}
+	}
+	return false
+}
+
+// Run polls every configured source on its own interval until the context is canceled.
+func (fi *FeedIngester) Run(ctx context.Context) {
+	var wg sync.WaitGroup
+	wg.Add(len(fi.Config))
+	for _, source := range fi.Config {
+		go func(source *IngestConfig) {
+			defer wg.Done()
+			log := fi.Log.With().Str("ingest_url", source.URL).Str("room_id", source.RoomID.String()).Logger()
+			ticker := time.NewTicker(source.Interval)
+			defer ticker.Stop()
+			for {
+				if err := fi.poll(ctx, source, log); err != nil && !errors.Is(err, context.Canceled) {
+					log.Err(err).Msg("Failed to poll external feed")
+				}
+				select {
+				case <-ctx.Done():
+					return
+				case <-ticker.C:
+				}
+			}
+		}(source)
+	}
+	wg.Wait()
+}
+
+func (fi *FeedIngester) getSourceState(url string) ingestSourceState {
+	fi.stateLock.Lock()
+	defer fi.stateLock.Unlock()
+	if state, ok := fi.state.Sources[url]; ok {
+		return *state
+	}
+	return ingestSourceState{}
+}
+
+func (fi *FeedIngester) saveSourceState(url string, state ingestSourceState) error {
+	fi.stateLock.Lock()
+	defer fi.stateLock.Unlock()
+	if len(state.Seen) > maxIngestSeenItems {
+		state.Seen = state.Seen[len(state.Seen)-maxIngestSeenItems:]
+	}
+	fi.state.Sources[url] = &state
+	return fi.Client.SetAccountData(ingestAccountDataType, &fi.state)
+}
+
+func (fi *FeedIngester) poll(ctx context.Context, source *IngestConfig, log zerolog.Logger) error {
+	state := fi.getSourceState(source.URL)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, source.URL, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("User-Agent", "feedserv/"+Commit)
+	req.Header.Set("Accept", strings.Join([]string{JSONFeedMime, AtomMime, RSSMime, "application/xml;q=0.9", "*/*;q=0.8"}, ", "))
+	if state.ETag != "" {
+		req.Header.Set("If-None-Match", state.ETag)
+	}
+	if state.LastModified != "" {
+		req.Header.Set("If-Modified-Since", state.LastModified)
+	}
+	resp, err := fi.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotModified {
+		log.Debug().Msg("External feed not modified")
+		return nil
+	} else if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status code %d", resp.StatusCode)
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxIngestFeedSize))
+	if err != nil {
+		return fmt.Errorf("failed to read feed: %w", err)
+	}
+	items, err := parseExternalFeed(data)
+	if err != nil {
+		return err
+	}
+
+	firstPoll := state.Seen == nil
+	seen := make(map[string]struct{}, len(state.Seen))
+	for _, itemID := range state.Seen {
+		seen[itemID] = struct{}{}
+	}
+	// Feeds list the newest items first, so go through them in reverse to post in chronological order
+	var newItems []ingestItem
+	for i := len(items) - 1; i >= 0; i-- {
+		if _, alreadySeen := seen[items[i].ID]; !alreadySeen && items[i].ID != "" {
+			seen[items[i].ID] = struct{}{}
+			newItems = append(newItems, items[i])
+		}
+	}
+	if state.Seen == nil {
+		state.Seen = []string{}
+	}
+	for i, item := range newItems {
+		if firstPoll && i < len(newItems)-source.Backfill {
+			state.Seen = append(state.Seen, item.ID)
+			continue
+		}
+		if err = fi.postItem(source, item); err != nil {
+			log.Err(err).Str("item_id", item.ID).Msg("Failed to post external feed item")
+			break
+		}
+		log.Info().Str("item_id", item.ID).Msg("Posted external feed item")
+		state.Seen = append(state.Seen, item.ID)
+	}
+	state.ETag = resp.Header.Get("ETag")
+	state.LastModified = resp.Header.Get("Last-Modified")
+	if err != nil {
+		// Don't save the cache headers if posting failed, so the feed is fetched again next time
+		state.ETag, state.LastModified = "", ""
+	}
+	if saveErr := fi.saveSourceState(source.URL, state); saveErr != nil {
+		return fmt.Errorf("failed to save ingest state: %w", saveErr)
+	}
+	return nil
+}
+
+func (fi *FeedIngester) postItem(source *IngestConfig, item ingestItem) error {
+	content := &event.MessageEventContent{
+		MsgType: event.MsgText,
+		Format:  event.FormatHTML,
+	}
+	if source.Notice {
+		content.MsgType = event.MsgNotice
+	}
+	title := item.Title
+	if title == "" {
+		title = item.URL
+	}
+	if item.URL != "" {
+		content.Body = fmt.Sprintf("%s\n%s", title, item.URL)
+		content.FormattedBody = fmt.Sprintf(`<a href="%s"><strong>%s</strong></a>`, html.EscapeString(item.URL), html.EscapeString(title))
+	} else {
+		content.Body = title
+		content.FormattedBody = fmt.Sprintf("<strong>%s</strong>", html.EscapeString(title))
+	}
+	if summary := summarizeHTML(item.Summary); source.Summary && summary != "" {
+		content.Body += "\n\n" + summary
+		content.FormattedBody += "<br>" + escapeHTMLText(summary)
+	}
+	_, err := fi.Client.SendMessageEvent(source.RoomID, event.EventMessage, content)
+	return err
+}
+
+// summarizeHTML converts the HTML description of an external item into shortened plain text.
+func summarizeHTML(input string) string {
+	doc, err := xhtml.Parse(strings.NewReader(input))
+	if err != nil {
+		return ""
+	}
+	var buf strings.Builder
+	var walk func(node *xhtml.Node)
+	walk = func(node *xhtml.Node) {
+		if node.Type == xhtml.TextNode {
+			buf.WriteString(node.Data)
+		} else if node.Type == xhtml.ElementNode && (node.Data == "script" || node.Data == "style") {
+			return
+		}
+		for child := node.FirstChild; child != nil; child = child.NextSibling {
+			walk(child)
+		}
+		if node.Type == xhtml.ElementNode && (node.Data == "p" || node.Data == "br" || node.Data == "div") {
+			buf.WriteByte(' ')
+		}
+	}
+	walk(doc)
+	text := strings.Join(strings.Fields(buf.String()), " ")
+	if runes := []rune(text); len(runes) > maxIngestSummaryLen {
+		text = strings.TrimSpace(string(runes[:maxIngestSummaryLen])) + "…"
+	}
+	return text
+}
+
+// parseExternalFeed parses a JSON Feed, Atom or RSS document into a list of items in document order.
+func parseExternalFeed(data []byte) ([]ingestItem, error) {
+	trimmed := bytes.TrimSpace(data)
+	if len(trimmed) > 0 && trimmed[0] == '{' {
+		var jsonFeed JSONFeed
+		if err := json.Unmarshal(trimmed, &jsonFeed); err != nil {
+			return nil, fmt.Errorf("failed to parse JSON feed: %w", err)
+		}
+		items := make([]ingestItem, len(jsonFeed.Items))
+		for i, item := range jsonFeed.Items {
+			summary := item.HTML
+			if summary == "" {
+				summary = html.EscapeString(item.Text)
+			}
+			if item.Summary != "" {
+				summary = html.EscapeString(item.Summary)
+			}
+			items[i] = ingestItem{ID: item.ID, Title: item.Title, URL: item.URL, Summary: summary}
+		}
+		return fillItemIDs(items), nil
+	}
+	rootName, err := getXMLRootName(trimmed)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse feed: %w", err)
+	}
+	switch rootName {
+	case "feed":
+		var atom ingestAtom
+		if err = decodeXML(trimmed, &atom); err != nil {
+			return nil, fmt.Errorf("failed to parse Atom feed: %w", err)
+		}
+		items := make([]ingestItem, len(atom.Entries))
+		for i, entry := range atom.Entries {
+			var link string
+			for _, entryLink := range entry.Links {
+				if entryLink.Rel == "" || entryLink.Rel == "alternate" {
+					link = entryLink.Href
+					break
+				}
+			}
+			summary := entry.Summary
+			if summary == "" {
+				summary = entry.Content
+			}
+			items[i] = ingestItem{ID: entry.ID, Title: strings.TrimSpace(entry.Title), URL: link, Summary: summary}
+		}
+		return fillItemIDs(items), nil
+	case "rss", "RDF":
+		var rss ingestRSS
+		if err = decodeXML(trimmed, &rss); err != nil {
+			return nil, fmt.Errorf("failed to parse RSS feed: %w", err)
+		}
+		rssItems := append(rss.Channel.Items, rss.Items...)
+		items := make([]ingestItem, len(rssItems))
+		for i, item := range rssItems {
+			items[i] = ingestItem{
+				ID:      strings.TrimSpace(item.GUID),
+				Title:   strings.TrimSpace(item.Title),
+				URL:     strings.TrimSpace(item.Link),
+				Summary: item.Description,
+			}
+		}
+		return fillItemIDs(items), nil
+	default:
+		return nil, fmt.Errorf("unsupported feed format with root element %q", rootName)
+	}
+}
+
+// fillItemIDs uses the URL or title as the ID for items that don't have an explicit ID.
+func fillItemIDs(items []ingestItem) []ingestItem {
+	for i := range items {
+		if items[i].ID == "" {
+			items[i].ID = items[i].URL
+		}
+		if items[i].ID == "" {
+			items[i].ID = items[i].Title
+		}
+	}
+	return items
+}
+
+// latin1Reader converts ISO-8859-1 text to UTF-8.
+type latin1Reader struct {
+	input io.ByteReader
+}
+
+func (lr *latin1Reader) Read(p []byte) (n int, err error) {
+	for n+1 < len(p) {
+		var b byte
+		b, err = lr.input.ReadByte()
+		if err != nil {
+			return
+		}
+		if b < 0x80 {
+			p[n] = b
+			n++
+		} else {
+			p[n], p[n+1] = 0xc0|b>>6, 0x80|b&0x3f
+			n += 2
+		}
+	}
+	return
+}
+
+func newXMLDecoder(data []byte) *xml.Decoder {
+	decoder := xml.NewDecoder(bytes.NewReader(data))
+	decoder.CharsetReader = func(label string, input io.Reader) (io.Reader, error) {
+		switch strings.ToLower(label) {
+		case "utf-8", "us-ascii", "ascii":
+			return input, nil
+		case "iso-8859-1", "latin1", "latin-1":
+			return &latin1Reader{input: bufio.NewReader(input)}, nil
+		default:
+			return nil, fmt.Errorf("unsupported charset %q", label)
+		}
+	}
+	return decoder
+}
+
+func decodeXML(data []byte, into any) error {
+	return newXMLDecoder(data).Decode(into)
+}
+
+func getXMLRootName(data []byte) (string, error) {
+	decoder := newXMLDecoder(data)
+	for {
+		token, err := decoder.Token()
+		if err != nil {
+			return "", err
+		}
+		if start, ok := token.(xml.StartElement); ok {
+			return start.Name.Local, nil
+		}
+	}
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/rs/zerolog"
+
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/id"
+)
+
+func TestParseExternalFeed(t *testing.T) {
+	tests := []struct {
+		name     string
+		data     string
+		expected []ingestItem
+	}{
+		{"JSON feed", `{"version":"https://jsonfeed.org/version/1.1","items":[
+			{"id":"1","title":"First","url":"https://example.com/1","content_text":"a < b"},
+			{"title":"Second","url":"https://example.com/2","summary":"Short","content_html":"<p>Long</p>"}
+		]}`, []ingestItem{
+			{ID: "1", Title: "First", URL: "https://example.com/1", Summary: "a &lt; b"},
+			{ID: "https://example.com/2", Title: "Second", URL: "https://example.com/2", Summary: "Short"},
+		}},
+		{"Atom feed", `<?xml version="1.0" encoding="utf-8"?>
+			<feed xmlns="http://www.w3.org/2005/Atom"><entry>
+				<id>urn:1</id><title> First </title>
+				<link rel="enclosure" href="https://example.com/1.mp3"/><link href="https://example.com/1"/>
+				<content>Content</content>
+			</entry></feed>`, []ingestItem{
+			{ID: "urn:1", Title: "First", URL: "https://example.com/1", Summary: "Content"},
+		}},
+		{"RSS feed", `<?xml version="1.0"?><rss version="2.0"><channel>
+				<item><guid>1</guid><title>First</title><link>https://example.com/1</link><description>Desc</description></item>
+				<item><title>No link</title></item>
+			</channel></rss>`, []ingestItem{
+			{ID: "1", Title: "First", URL: "https://example.com/1", Summary: "Desc"},
+			{ID: "No link", Title: "No link"},
+		}},
+		{"RSS 1.0 feed", `<rdf:RDF xmlns:rdf="http://www.w3.org/1999/02/22-rdf-syntax-ns#" xmlns="http://purl.org/rss/1.0/">
+				<item><title>First</title><link>https://example.com/1</link></item>
+			</rdf:RDF>`, []ingestItem{
+			{ID: "https://example.com/1", Title: "First", URL: "https://example.com/1"},
+		}},
+		{"Latin-1 RSS feed", "<?xml version=\"1.0\" encoding=\"ISO-8859-1\"?><rss><channel><item><guid>1</guid><title>Caf\xe9</title></item></channel></rss>", []ingestItem{
+			{ID: "1", Title: "Café"},
+		}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			items, err := parseExternalFeed([]byte(test.data))
+			if err != nil {
+				t.Fatal(err)
+			} else if len(items) != len(test.expected) {
+				t.Fatalf("expected %d items, got %d: %+v", len(test.expected), len(items), items)
+			}
+			for i, item := range items {
+				if item != test.expected[i] {
+					t.Errorf("item %d: expected %+v, got %+v", i, test.expected[i], item)
+				}
+			}
+		})
+	}
+	for _, invalid := range []string{`<html><body>Not a feed</body></html>`, `{"items": 5}`, `not a feed`} {
+		if _, err := parseExternalFeed([]byte(invalid)); err == nil {
+			t.Errorf("invalid feed %q was accepted", invalid)
+		}
+	}
+}
+
+// fakeIngestServer serves an external RSS feed with an ETag and the Matrix endpoints used by the ingester.
+type fakeIngestServer struct {
+	t        *testing.T
+	lock     sync.Mutex
+	feedETag string
+	feed     string
+	fetches  int
+	notMod   int
+	posted   []string
+}
+
+func (fis *fakeIngestServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	fis.lock.Lock()
+	defer fis.lock.Unlock()
+	switch {
+	case r.URL.Path == "/feed.xml":
+		fis.fetches++
+		if r.Header.Get("If-None-Match") == fis.feedETag {
+			fis.notMod++
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", fis.feedETag)
+		_, _ = w.Write([]byte(fis.feed))
+	case strings.Contains(r.URL.Path, "/account_data/"):
+		_, _ = w.Write([]byte(`{}`))
+	case strings.Contains(r.URL.Path, "/send/m.room.message/"):
+		var content struct {
+			Body string `json:"body"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&content); err != nil {
+			fis.t.Error(err)
+		}
+		fis.posted = append(fis.posted, content.Body)
+		_, _ = w.Write([]byte(`{"event_id":"$event"}`))
+	default:
+		fis.t.Errorf("unexpected request to %s", r.URL.Path)
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func (fis *fakeIngestServer) setFeed(etag string, titles ...string) {
+	fis.lock.Lock()
+	defer fis.lock.Unlock()
+	fis.feedETag = etag
+	var items strings.Builder
+	// Newest items are listed first
+	for i := len(titles) - 1; i >= 0; i-- {
+		items.WriteString("<item><guid>" + titles[i] + "</guid><title>" + titles[i] + "</title></item>")
+	}
+	fis.feed = `<rss version="2.0"><channel>` + items.String() + `</channel></rss>`
+}
+
+func TestFeedIngesterConditionalPoll(t *testing.T) {
+	fis := &fakeIngestServer{t: t}
+	server := httptest.NewServer(fis)
+	defer server.Close()
+	cli, err := mautrix.NewClient(server.URL, "@feedserv:example.com", "token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	source := &IngestConfig{URL: server.URL + "/feed.xml", RoomID: "!room:example.com", Backfill: 1}
+	fi := &FeedIngester{
+		Config: []*IngestConfig{source},
+		Client: cli,
+		Log:    zerolog.Nop(),
+		http:   server.Client(),
+		state:  ingestState{Sources: make(map[string]*ingestSourceState)},
+	}
+	poll := func() {
+		if err := fi.poll(context.Background(), source, fi.Log); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	fis.setFeed(`"v1"`, "one", "two", "three")
+	poll()
+	if strings.Join(fis.posted, ",") != "three" {
+		t.Fatalf("expected only the newest item to be backfilled, got %q", fis.posted)
+	} else if state := fi.getSourceState(source.URL); state.ETag != `"v1"` || len(state.Seen) != 3 {
+		t.Fatalf("unexpected state after first poll: %+v", state)
+	}
+
+	poll()
+	if fis.notMod != 1 {
+		t.Errorf("expected the second poll to be a conditional request, got %d not modified responses", fis.notMod)
+	} else if len(fis.posted) != 1 {
+		t.Errorf("unchanged feed posted items: %q", fis.posted)
+	}
+
+	fis.setFeed(`"v2"`, "one", "two", "three", "four", "five")
+	poll()
+	if strings.Join(fis.posted, ",") != "three,four,five" {
+		t.Errorf("expected new items to be posted in order, got %q", fis.posted)
+	} else if state := fi.getSourceState(source.URL); state.ETag != `"v2"` {
+		t.Errorf("ETag wasn't updated: %+v", state)
+	}
+}
+
+func TestFeedIngesterHasRoom(t *testing.T) {
+	fi := &FeedIngester{Config: []*IngestConfig{{RoomID: "!ingest:example.com"}}}
+	if !fi.HasRoom("!ingest:example.com") {
+		t.Error("ingest room not found")
+	} else if fi.HasRoom(id.RoomID("!other:example.com")) {
+		t.Error("unrelated room was reported as an ingest room")
+	}
+}
+
+func TestSyncFilterIncludesIngestRooms(t *testing.T) {
+	fs := &FeedServ{
+		Config: &Config{feedsByRoomID: map[id.RoomID][]*FeedConfig{
+			"!feed:example.com": {makeTestFeed("/feed", "!feed:example.com")},
+		}},
+		Ingester: &FeedIngester{Config: []*IngestConfig{
+			{RoomID: "!ingest:example.com"},
+			{RoomID: "!ingest:example.com"},
+			{RoomID: "!feed:example.com"},
+		}},
+	}
+	rooms := fs.syncFilterRooms()
+	if len(rooms) != 2 || !contains(rooms, "!feed:example.com") || !contains(rooms, "!ingest:example.com") {
+		t.Errorf("unexpected sync filter rooms %v", rooms)
+	}
+}
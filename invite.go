@@ -15,8 +15,9 @@ func (fs *FeedServ) HandleInvite(_ mautrix.EventSource, evt *event.Event) {
 		Str("event_id", evt.ID.String()).
 		Str("action", "invite").
 		Logger()
-	_, allowed := fs.Config.feedsByRoomID[evt.RoomID]
-	if !allowed {
+	isFeedRoom := len(fs.Config.feedsByRoomID[evt.RoomID]) > 0
+	isIngestRoom := fs.Ingester != nil && fs.Ingester.HasRoom(evt.RoomID)
+	if !isFeedRoom && !isIngestRoom {
 		log.Info().Msg("Rejecting invite to non-feed room")
 		_, err := fs.Client.LeaveRoom(evt.RoomID)
 		if err != nil {
@@ -25,12 +26,15 @@ func (fs *FeedServ) HandleInvite(_ mautrix.EventSource, evt *event.Event) {
 			log.Debug().Msg("Rejected invite")
 		}
 	} else {
-		log.Info().Msg("Accepting invite to feed room")
+		log.Info().Bool("ingest_room", isIngestRoom).Msg("Accepting invite to feed room")
 		_, err := fs.Client.JoinRoomByID(evt.RoomID)
 		if err != nil {
 			log.Err(err).Msg("Failed to accept invite")
 		} else {
 			log.Debug().Msg("Accepted invite")
+			if isFeedRoom {
+				fs.refreshRoomState(evt.RoomID, log)
+			}
 		}
 	}
 }
@@ -8,7 +8,6 @@ import (
 
 	"maunium.net/go/mautrix/event"
 	"maunium.net/go/mautrix/id"
-	"maunium.net/go/mautrix/util"
 )
 
 const JSONFeedVersion = "https://jsonfeed.org/version/1.1"
@@ -54,6 +53,16 @@ type JSONFeedItem struct {
 
 	MatrixEvent      *event.Event     `json:"_matrix_event,omitempty"`
 	MatrixEventExtra MatrixEventExtra `json:"_matrix_event_extra,omitempty"`
+	Source           *FeedSource      `json:"_feedserv_source,omitempty"`
+	Geo              *geoPoint        `json:"_geo,omitempty"`
+}
+
+// FeedSource describes the feed that an item in an aggregate feed originally came from.
+type FeedSource struct {
+	FeedID  string    `json:"feed_id,omitempty"`
+	Title   string    `json:"title,omitempty"`
+	RoomID  id.RoomID `json:"room_id"`
+	FeedURL string    `json:"feed_url,omitempty"`
 }
 
 type MatrixEventExtra struct {
@@ -79,14 +88,21 @@ type JSONFeedAttachment struct {
 	Title    string `json:"title,omitempty"`
 	Size     int    `json:"size_in_bytes,omitempty"`
 	Duration int    `json:"duration_in_seconds,omitempty"`
+
+	Width  int `json:"_width,omitempty"`
+	Height int `json:"_height,omitempty"`
 }
 
-func (fs *FeedServ) generateJSONFeed(feed *FeedConfig) ([]byte, string, error) {
-	feedURL := fs.Config.PublicURL + feed.id + ".json"
-	allAuthors := make([]JSONFeedAuthor, 0, len(feed.authors))
-	for _, author := range feed.authors {
-		allAuthors = append(allAuthors, author)
+func marshalJSONFeed(jsonFeed *JSONFeed) ([]byte, string, error) {
+	jsonData, err := json.Marshal(jsonFeed)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to marshal JSON feed: %w", err)
 	}
+	return jsonData, fmt.Sprintf(`"%x"`, sha256.Sum256(jsonData)), nil
+}
+
+func (fs *FeedServ) buildJSONFeed(feed *FeedConfig, feedPath string, entries []feedEntry, language string) *JSONFeed {
+	feedURL := fs.Config.PublicURL + feedPath + ".json"
 	jsonFeed := &JSONFeed{
 		Version:     JSONFeedVersion,
 		Title:       feed.title,
@@ -94,53 +110,78 @@ func (fs *FeedServ) generateJSONFeed(feed *FeedConfig) ([]byte, string, error) {
 		Icon:        feed.icon,
 		MatrixIcon:  MatrixIcon{URI: feed.iconMXC},
 		Homepage:    feed.Homepage,
-		Language:    feed.Language,
+		Language:    language,
 		FeedURL:     feedURL,
-		Authors:     allAuthors,
+		Authors:     feed.getAuthors(),
+		Expired:     feed.ExpireWhenStale && feed.staleReason != "",
 	}
-	jsonFeed.Items, _ = util.MapRingBuffer(feed.entries, func(evtID id.EventID, evt *event.Event) (JSONFeedItem, error) {
-		content := evt.Content.AsMessage()
+	jsonFeed.Items = make([]JSONFeedItem, len(entries))
+	for i, evt := range entries {
+		rendered := fs.renderContent(evt)
 		ts := time.UnixMilli(evt.Timestamp).UTC()
 		var attachments []JSONFeedAttachment
-		if content.URL != "" {
+		var image, bannerImage string
+		for _, attachment := range fs.getEntryAttachments(evt) {
+			media := attachment.Media
 			attachments = append(attachments, JSONFeedAttachment{
-				URL:      fs.Media.GetDownloadURL(content.URL.ParseOrIgnore()),
-				MimeType: content.GetInfo().MimeType,
-				Title:    content.FileName,
-				Size:     content.GetInfo().Size,
-				Duration: content.GetInfo().Duration,
+				URL:      media.URL,
+				MimeType: media.MimeType,
+				Title:    media.Title,
+				Size:     media.Size,
+				Duration: media.Duration / 1000,
+				Width:    media.Width,
+				Height:   media.Height,
 			})
+			if media.MsgType == event.MsgImage && bannerImage == "" {
+				bannerImage = media.URL
+			}
+			if attachment.Thumbnail != nil && image == "" {
+				image = attachment.Thumbnail.URL
+			}
 		}
 		var editedAt *time.Time
 		if !evt.Mautrix.EditedAt.IsZero() {
 			editedAt = &evt.Mautrix.EditedAt
 		}
-		author, ok := feed.authors[evt.Sender]
 		var authors []JSONFeedAuthor
-		if ok {
-			authors = []JSONFeedAuthor{author}
+		if evt.hasAuthor {
+			authors = []JSONFeedAuthor{evt.author}
+		}
+		var source *FeedSource
+		if feed.IsAggregate() {
+			source = &FeedSource{
+				FeedID:  evt.source.id,
+				Title:   evt.source.title,
+				RoomID:  evt.RoomID,
+				FeedURL: fs.Config.PublicURL + evt.source.id + ".json",
+			}
+			if evt.source.hidden {
+				source.FeedURL = ""
+			}
 		}
-		return JSONFeedItem{
+		jsonFeed.Items[i] = JSONFeedItem{
 			ID:   evt.ID.String(),
 			URL:  evt.RoomID.EventURI(evt.ID, fs.Config.homeserverDomain).MatrixToURL(),
-			Text: content.Body,
-			HTML: content.FormattedBody,
+			Text: rendered.Text,
+			HTML: fs.renderEntryHTML(evt, rendered, false),
 
+			Language: evt.language,
+
+			Image:       image,
+			BannerImage: bannerImage,
 			Attachments: attachments,
 			Authors:     authors,
 
 			DatePublished: &ts,
 			DateModified:  editedAt,
 
-			MatrixEvent: evt,
+			MatrixEvent: evt.Event,
 			MatrixEventExtra: MatrixEventExtra{
 				LastEditID: evt.Mautrix.LastEditID,
 			},
-		}, nil
-	})
-	jsonData, err := json.Marshal(jsonFeed)
-	if err != nil {
-		return nil, "", fmt.Errorf("failed to marshal JSON feed: %w", err)
+			Source: source,
+			Geo:    rendered.Geo,
+		}
 	}
-	return jsonData, fmt.Sprintf(`"%x"`, sha256.Sum256(jsonData)), nil
+	return jsonFeed
 }
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"regexp"
+	"strings"
+	"unicode"
+
+	"maunium.net/go/mautrix/event"
+)
+
+// languageFields are custom fields in message content that can be used to set the language of an entry.
+var languageFields = []string{"com.beeper.feedserv.language", "m.feedserv.language"}
+
+var languageCodeRegex = regexp.MustCompile(`^[a-z]{2,3}(-[a-z0-9]{2,8})*$`)
+
+// stopwords contains very common words of each supported language for simple language detection.
+var stopwords = map[string]map[string]struct{}{
+	"en": makeWordSet("the and is are was were to of in that it for on with as this be have you not but from they will"),
+	"fi": makeWordSet("ja on ei se että oli ovat ole mutta kun niin myös tai jos hän mitä kuin tämä nyt vain sitä"),
+	"sv": makeWordSet("och är det att som en ett på med för inte av till har jag den om men var de vi kan"),
+	"de": makeWordSet("und der die das ist nicht zu ein eine mit den auf für sich von dem auch es wir ich sind"),
+	"fr": makeWordSet("le la les et est une un des pour pas que qui dans du sur avec ce il nous sont"),
+	"es": makeWordSet("el la los las y es que de en un una por con para no se del al lo como pero"),
+	"nl": makeWordSet("de het een en is van dat niet op te in met voor zijn ook maar er we ik"),
+	"it": makeWordSet("il lo la gli le e è di che un una per non con del della sono anche ma come"),
+	"pt": makeWordSet("o a os as e é de que um uma para não com do da em no na por mas"),
+}
+
+func makeWordSet(words string) map[string]struct{} {
+	set := make(map[string]struct{})
+	for _, word := range strings.Fields(words) {
+		set[word] = struct{}{}
+	}
+	return set
+}
+
+// detectLanguage guesses the language of the given text by counting common words of each candidate language.
+// An empty string is returned if the text doesn't clearly match any single language.
+func detectLanguage(text string, candidates []string) string {
+	if len(candidates) == 0 {
+		candidates = make([]string, 0, len(stopwords))
+		for lang := range stopwords {
+			candidates = append(candidates, lang)
+		}
+	}
+	words := strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && r != '\''
+	})
+	scores := make(map[string]int, len(candidates))
+	for _, word := range words {
+		for _, lang := range candidates {
+			if _, ok := stopwords[lang][word]; ok {
+				scores[lang]++
+			}
+		}
+	}
+	best, bestScore, tied := "", 0, false
+	for lang, score := range scores {
+		if score > bestScore {
+			best, bestScore, tied = lang, score, false
+		} else if score == bestScore {
+			tied = true
+		}
+	}
+	if bestScore < 2 || tied {
+		return ""
+	}
+	return best
+}
+
+// getEntryLanguage returns the language of an event, either from the explicit content field
+// or by detecting it from the message body if detection is enabled for the feed.
+func (feed *FeedConfig) getEntryLanguage(evt *event.Event) string {
+	for _, field := range languageFields {
+		if lang, ok := evt.Content.Raw[field].(string); ok {
+			if lang = strings.ToLower(lang); languageCodeRegex.MatchString(lang) {
+				return lang
+			}
+		}
+	}
+	if feed.DetectLanguage {
+		if lang := detectLanguage(evt.Content.AsMessage().Body, feed.Languages); lang != "" {
+			return lang
+		}
+	}
+	return ""
+}
+
+// getLanguages returns the languages for which sub-feeds should be generated:
+// all configured languages and any languages found in the given entries.
+func (feed *FeedConfig) getLanguages(entries []feedEntry) []string {
+	seen := make(map[string]struct{})
+	var languages []string
+	add := func(lang string) {
+		if _, alreadySeen := seen[lang]; lang != "" && !alreadySeen {
+			seen[lang] = struct{}{}
+			languages = append(languages, lang)
+		}
+	}
+	for _, lang := range feed.Languages {
+		add(strings.ToLower(lang))
+	}
+	for _, entry := range entries {
+		add(entry.language)
+	}
+	return languages
+}
+
+func filterEntriesByLanguage(entries []feedEntry, lang string) []feedEntry {
+	filtered := make([]feedEntry, 0, len(entries))
+	for _, entry := range entries {
+		if entry.language == lang {
+			filtered = append(filtered, entry)
+		}
+	}
+	return filtered
+}
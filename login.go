@@ -0,0 +1,178 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/rs/zerolog"
+
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/appservice"
+	"maunium.net/go/mautrix/id"
+)
+
+const (
+	LoginTypePassword = "password"
+	LoginTypeJWT      = "jwt"
+	LoginTypeSSO      = "sso"
+
+	authTypeJWT mautrix.AuthType = "org.matrix.login.jwt"
+
+	defaultDeviceID = "feedserv"
+)
+
+// savedSession is the access token and device stored in the session file after logging in,
+// so that restarts reuse the same device instead of logging in again.
+type savedSession struct {
+	HomeserverURL string      `json:"homeserver_url"`
+	UserID        id.UserID   `json:"user_id"`
+	DeviceID      id.DeviceID `json:"device_id"`
+	AccessToken   string      `json:"access_token"`
+}
+
+func makeClient(cfg *Config, log *zerolog.Logger) (*mautrix.Client, error) {
+	cli, err := mautrix.NewClient(cfg.HomeserverURL, "", "")
+	if err != nil {
+		return nil, fmt.Errorf("failed to initialize client: %w", err)
+	}
+	cli.Log = log.With().Str("component", "matrix").Logger()
+	if cfg.AppServiceRegistration != "" {
+		err = loginAppService(cli, cfg, log)
+	} else if cfg.AccessToken != "" {
+		cli.AccessToken = cfg.AccessToken
+		cli.DeviceID = cfg.DeviceID
+		err = checkAccessToken(cli)
+	} else {
+		err = loginWithSession(cli, cfg, log)
+	}
+	if err != nil {
+		return nil, err
+	}
+	cfg.homeserverDomain = cli.UserID.Homeserver()
+	return cli, nil
+}
+
+func checkAccessToken(cli *mautrix.Client) error {
+	resp, err := cli.Whoami()
+	if err != nil {
+		return fmt.Errorf("failed to check access token: %w", err)
+	}
+	cli.UserID = resp.UserID
+	if cli.DeviceID == "" {
+		cli.DeviceID = resp.DeviceID
+	}
+	return nil
+}
+
+// loginAppService uses the as_token of an appservice registration. The bot acts as the user_id
+// in the config if it's set (registering it if necessary), and as the sender_localpart user otherwise.
+func loginAppService(cli *mautrix.Client, cfg *Config, log *zerolog.Logger) error {
+	reg, err := appservice.LoadRegistration(cfg.AppServiceRegistration)
+	if err != nil {
+		return fmt.Errorf("failed to load appservice registration: %w", err)
+	}
+	cli.AccessToken = reg.AppToken
+	if err = checkAccessToken(cli); err != nil {
+		return err
+	}
+	if cfg.UserID == "" || cfg.UserID == cli.UserID {
+		return nil
+	}
+	localpart, _, err := cfg.UserID.Parse()
+	if err != nil {
+		return fmt.Errorf("invalid user ID: %w", err)
+	}
+	_, _, err = cli.Register(&mautrix.ReqRegister{
+		Username:     localpart,
+		Type:         mautrix.AuthTypeAppservice,
+		InhibitLogin: true,
+	})
+	if err != nil && !errors.Is(err, mautrix.MUserInUse) {
+		return fmt.Errorf("failed to register appservice user: %w", err)
+	} else if err == nil {
+		log.Info().Str("user_id", cfg.UserID.String()).Msg("Registered appservice bot user")
+	}
+	cli.UserID = cfg.UserID
+	cli.SetAppServiceUserID = true
+	return nil
+}
+
+func loginWithSession(cli *mautrix.Client, cfg *Config, log *zerolog.Logger) error {
+	if cfg.SessionPath != "" {
+		var session savedSession
+		data, err := os.ReadFile(cfg.SessionPath)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("failed to read session file: %w", err)
+		} else if err == nil {
+			if err = json.Unmarshal(data, &session); err != nil {
+				return fmt.Errorf("failed to parse session file: %w", err)
+			}
+		}
+		if session.AccessToken != "" && session.HomeserverURL == cfg.HomeserverURL &&
+			(cfg.UserID == "" || session.UserID == cfg.UserID) {
+			cli.AccessToken = session.AccessToken
+			cli.DeviceID = session.DeviceID
+			err = checkAccessToken(cli)
+			if err == nil {
+				log.Debug().Str("device_id", cli.DeviceID.String()).Msg("Using saved session")
+				return nil
+			} else if !errors.Is(err, mautrix.MUnknownToken) {
+				return err
+			}
+			log.Warn().Msg("Saved session is no longer valid, logging in again")
+			cli.AccessToken = ""
+		}
+	}
+	deviceID := cfg.DeviceID
+	if deviceID == "" {
+		deviceID = defaultDeviceID
+	}
+	req := &mautrix.ReqLogin{
+		DeviceID:                 deviceID,
+		InitialDeviceDisplayName: "feedserv",
+		StoreCredentials:         true,
+	}
+	switch cfg.LoginType {
+	case LoginTypePassword, "":
+		req.Type = mautrix.AuthTypePassword
+		req.Identifier = mautrix.UserIdentifier{
+			Type: mautrix.IdentifierTypeUser,
+			User: cfg.UserID.String(),
+		}
+		req.Password = cfg.Password
+	case LoginTypeJWT:
+		req.Type = authTypeJWT
+		req.Token = cfg.LoginToken
+	case LoginTypeSSO:
+		if cfg.LoginToken == "" {
+			ssoURL := cli.BuildURLWithQuery(mautrix.ClientURLPath{"v3", "login", "sso", "redirect"}, map[string]string{
+				"redirectUrl": cfg.PublicURL,
+			})
+			return fmt.Errorf("login_token is required for SSO login: log in at %s and copy the loginToken parameter from the URL you're redirected to", ssoURL)
+		}
+		req.Type = mautrix.AuthTypeToken
+		req.Token = cfg.LoginToken
+	default:
+		return fmt.Errorf("unknown login type %q", cfg.LoginType)
+	}
+	_, err := cli.Login(req)
+	if err != nil {
+		return fmt.Errorf("failed to log in: %w", err)
+	}
+	if cfg.SessionPath != "" {
+		data, err := json.Marshal(&savedSession{
+			HomeserverURL: cfg.HomeserverURL,
+			UserID:        cli.UserID,
+			DeviceID:      cli.DeviceID,
+			AccessToken:   cli.AccessToken,
+		})
+		if err != nil {
+			return err
+		} else if err = os.WriteFile(cfg.SessionPath, data, 0600); err != nil {
+			return fmt.Errorf("failed to save session: %w", err)
+		}
+	}
+	return nil
+}
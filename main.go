@@ -2,11 +2,14 @@ package main
 
 import (
 	"errors"
+	"flag"
 	"fmt"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
 	"runtime"
+	"strings"
 	"sync"
 	"syscall"
 	"time"
@@ -20,28 +23,104 @@ import (
 	"maunium.net/go/mautrix/util"
 )
 
-func makeClient(cfg *Config, log *zerolog.Logger) (*mautrix.Client, error) {
-	cli, err := mautrix.NewClient(cfg.HomeserverURL, "", "")
-	if err != nil {
-		return nil, fmt.Errorf("failed to initialize client: %w", err)
-	}
-	cli.Log = log.With().Str("component", "matrix").Logger()
-	_, err = cli.Login(&mautrix.ReqLogin{
-		Type: mautrix.AuthTypePassword,
-		Identifier: mautrix.UserIdentifier{
-			Type: mautrix.IdentifierTypeUser,
-			User: cfg.UserID.String(),
-		},
-		Password:                 cfg.Password,
-		DeviceID:                 "feedserv",
-		InitialDeviceDisplayName: "feedserv",
-		StoreCredentials:         true,
-	})
+func (fs *FeedServ) prepareRoomFeed(feed *FeedConfig) {
+	log := fs.Log
+	if feed.RoomID == "" && feed.RoomAlias != "" {
+		resp, err := fs.Client.ResolveAlias(feed.RoomAlias)
+		if err != nil {
+			log.Fatal().
+				Str("room_alias", feed.RoomAlias.String()).
+				Str("feed_id", feed.id).
+				Msg("Failed to resolve room ID for feed")
+		}
+		feed.RoomID = resp.RoomID
+		log.Debug().
+			Str("room_alias", feed.RoomAlias.String()).
+			Str("room_id", feed.RoomID.String()).
+			Str("feed_id", feed.id).
+			Msg("Resolved room ID for feed")
+	}
+	if roomID, previousRooms := fs.followRoomUpgrades(feed.RoomID); roomID != feed.RoomID {
+		log.Debug().
+			Str("old_room_id", feed.RoomID.String()).
+			Str("room_id", roomID.String()).
+			Str("feed_id", feed.id).
+			Msg("Using replacement room of upgraded feed room")
+		feed.RoomID = roomID
+		feed.previousRooms = previousRooms
+	}
+	_, err := fs.Client.JoinRoomByID(feed.RoomID)
 	if err != nil {
-		return nil, fmt.Errorf("failed to log in: %w", err)
+		log.Warn().Str("feed_id", feed.id).Err(err).Msg("Error joining room, feed will be stale")
+		feed.staleReason = staleReasonJoinFailed
+		feed.staleSince = time.Now().UTC()
+		// Forbidden means the room is private or feedserv is banned, so retrying won't help
+		if !errors.Is(err, mautrix.MForbidden) {
+			fs.queueRejoin(feed.RoomID)
+		}
+	}
+	feed.entries = util.NewRingBuffer[id.EventID, *event.Event](feed.MaxEntries)
+	feed.groupedMedia = make(map[id.EventID][]*event.Event)
+	feed.polls = make(map[id.EventID]*pollState)
+	// The room state is only fetched after joining, so stale feeds start with empty state
+	feed.powers = &event.PowerLevelsEventContent{}
+	feed.authors = make(map[id.UserID]JSONFeedAuthor)
+	feed.members = make(map[id.UserID]struct{})
+	feed.lastUpdate = time.Now().UTC()
+	fs.applyMetadataOverrides(feed)
+	fs.Config.feedsByRoomID[feed.RoomID] = append(fs.Config.feedsByRoomID[feed.RoomID], feed)
+}
+
+func (fs *FeedServ) applyMetadataOverrides(feed *FeedConfig) {
+	feed.title = feed.Title
+	feed.description = feed.Description
+	if feed.Icon != "" {
+		feed.iconMXC = feed.Icon.ParseOrIgnore()
+		feed.icon = fs.mediaURL(feed.iconMXC)
+	}
+}
+
+func (fs *FeedServ) prepareAggregateFeed(feed *FeedConfig) {
+	fs.applyMetadataOverrides(feed)
+	if feed.title == "" {
+		feed.title = feed.id
+	}
+	for _, sourceID := range feed.Sources {
+		var source *FeedConfig
+		if strings.HasPrefix(sourceID, "!") {
+			roomID, _ := fs.followRoomUpgrades(id.RoomID(sourceID))
+			hasPrivateFeed := false
+			for _, existing := range fs.Config.feedsByRoomID[roomID] {
+				if existing.Private {
+					// Private feeds must not be reused, as their entries and media would become accessible without a token
+					hasPrivateFeed = true
+				} else if existing.Filter == nil && source == nil {
+					source = existing
+				}
+			}
+			if hasPrivateFeed && !feed.Private {
+				// The validation only catches private feeds configured with a room ID rather than an alias
+				fs.Log.Fatal().
+					Str("feed_id", feed.id).
+					Str("source_room_id", roomID.String()).
+					Msg("Room of aggregate source has a private feed, so it can't be included in a public aggregate feed")
+			}
+			if source == nil {
+				source = &FeedConfig{
+					RoomID:     id.RoomID(sourceID),
+					MaxEntries: feed.MaxEntries,
+					id:         sourceID,
+					hidden:     true,
+				}
+				fs.prepareRoomFeed(source)
+			}
+		} else {
+			// The config validation ensures that the source exists and isn't an aggregate
+			source = fs.Config.Feeds[sourceID]
+		}
+		feed.sources = append(feed.sources, source)
+		source.aggregates = append(source.aggregates, feed)
 	}
-	cfg.homeserverDomain = cli.UserID.Homeserver()
-	return cli, nil
 }
 
 type FeedServ struct {
@@ -49,6 +128,23 @@ type FeedServ struct {
 	Client *mautrix.Client
 	Media  *mautrix.Client
 	Log    *zerolog.Logger
+
+	MediaProxy  *MediaProxy
+	ActivityPub *ActivityPub
+	Ingester    *FeedIngester
+	Digester    *Digester
+	Exporter    *FeedExporter
+	Tokens      *FeedTokens
+	RateLimiter *RateLimiter
+
+	trustedProxies []*net.IPNet
+	certReloader   *certReloader
+	roomUpgrades   roomUpgradeStore
+	rejoins        map[id.RoomID]*rejoinState
+	rejoinLock     sync.Mutex
+	// restartSync is only used from the sync goroutine, so it doesn't need a lock.
+	restartSync context.CancelFunc
+	startTime   time.Time
 }
 
 var (
@@ -57,10 +153,29 @@ var (
 )
 
 func main() {
+	var exportDir string
+	var exportWatch bool
+	if len(os.Args) > 1 && os.Args[1] == "export" {
+		flags := flag.NewFlagSet("export", flag.ExitOnError)
+		flags.StringVar(&exportDir, "out", "", "Directory to write the feed files to")
+		flags.BoolVar(&exportWatch, "watch", false, "Keep running and rewrite the files when feeds change")
+		_ = flags.Parse(os.Args[2:])
+		if exportDir == "" {
+			_, _ = fmt.Fprintln(os.Stderr, "Usage: feedserv export --out <dir> [--watch]")
+			os.Exit(2)
+		}
+	}
 	cfg, err := loadConfig()
 	if err != nil {
 		_, _ = fmt.Fprintln(os.Stderr, err)
 		os.Exit(1)
+	} else if len(os.Args) > 1 && os.Args[1] == "check-config" {
+		if err = (&FeedServ{Config: cfg}).checkFiles(); err != nil {
+			_, _ = fmt.Fprintf(os.Stderr, "invalid config:\n%v\n", err)
+			os.Exit(1)
+		}
+		fmt.Println("Config OK")
+		return
 	}
 	log, err := cfg.LogConfig.Compile()
 	if err != nil {
@@ -72,6 +187,9 @@ func main() {
 		Str("feedserv_commit", Commit).
 		Str("build_time", BuildTime).
 		Msg("Initializing feedserv")
+	if len(cfg.ignoredEnv) > 0 {
+		log.Warn().Strs("env_vars", cfg.ignoredEnv).Msg("Ignoring environment variables that don't match any config key")
+	}
 	cli, err := makeClient(cfg, log)
 	if err != nil {
 		log.Fatal().Err(err).Msg("Failed to initialize mautrix client")
@@ -86,70 +204,128 @@ func main() {
 		Client: cli,
 		Media:  mediaCli,
 		Log:    log,
+
+		startTime: time.Now(),
+	}
+	// The media proxy, ActivityPub, ingesting and digests need a running server, so they're disabled when exporting
+	serverMode := exportDir == ""
+	if cfg.MediaProxy.Enabled && serverMode {
+		fs.MediaProxy, err = NewMediaProxy(&cfg.MediaProxy, fs, log.With().Str("component", "media proxy").Logger())
+		if err != nil {
+			log.Fatal().Err(err).Msg("Failed to initialize media proxy")
+		}
+	}
+
+	if err = fs.loadRoomUpgrades(); err != nil {
+		log.Fatal().Err(err).Msg("Failed to load room upgrades")
 	}
 
 	var wg sync.WaitGroup
-	cfg.feedsByRoomID = make(map[id.RoomID]*FeedConfig)
-	wg.Add(len(cfg.Feeds))
-	allowedRoomIDs := make([]id.RoomID, 0, len(cfg.Feeds))
+	cfg.feedsByRoomID = make(map[id.RoomID][]*FeedConfig)
+	var aggregateFeeds []*FeedConfig
 	log.Info().Msg("Preparing feeds")
 	for feedID, feed := range cfg.Feeds {
-		if feed.RoomID == "" && feed.RoomAlias != "" {
-			resp, err := fs.Client.ResolveAlias(feed.RoomAlias)
+		feed.id = feedID
+		feed.lastUpdate = time.Now().UTC()
+		if feed.HTML {
+			templatePath := feed.HTMLTemplate
+			if templatePath == "" {
+				templatePath = cfg.HTMLTemplate
+			}
+			feed.htmlTemplate, err = fs.loadHTMLTemplate(templatePath)
 			if err != nil {
-				log.Fatal().
-					Str("room_alias", feed.RoomAlias.String()).
-					Str("feed_id", feedID).
-					Msg("Failed to resolve room ID for feed")
+				log.Fatal().Err(err).Str("feed_id", feedID).Msg("Failed to load HTML template")
 			}
-			feed.RoomID = resp.RoomID
-			log.Debug().
-				Str("room_alias", feed.RoomAlias.String()).
-				Str("room_id", feed.RoomID.String()).
-				Str("feed_id", feedID).
-				Msg("Resolved room ID for feed")
 		}
-		_, err = fs.Client.JoinRoomByID(feed.RoomID)
+		if feed.IsAggregate() {
+			aggregateFeeds = append(aggregateFeeds, feed)
+		} else {
+			fs.prepareRoomFeed(feed)
+		}
+	}
+	for _, feed := range aggregateFeeds {
+		fs.prepareAggregateFeed(feed)
+	}
+	if cfg.ActivityPub.Enabled && serverMode {
+		fs.ActivityPub, err = NewActivityPub(&cfg.ActivityPub, fs, log.With().Str("component", "activitypub").Logger())
 		if err != nil {
-			log.Warn().Str("feed_id", feedID).Err(err).Msg("Error joining room")
+			log.Fatal().Err(err).Msg("Failed to initialize ActivityPub")
+		}
+	}
+	hasPrivateFeeds := false
+	for _, feed := range cfg.Feeds {
+		hasPrivateFeeds = hasPrivateFeeds || feed.Private
+	}
+	if hasPrivateFeeds || cfg.AdminToken != "" {
+		fs.Tokens, err = NewFeedTokens(fs, log.With().Str("component", "tokens").Logger())
+		if err != nil {
+			log.Fatal().Err(err).Msg("Failed to initialize feed tokens")
+		}
+	}
+	for _, feeds := range cfg.feedsByRoomID {
+		wg.Add(len(feeds))
+		for _, feed := range feeds {
+			go func(feed *FeedConfig) {
+				fs.InitSyncFeed(feed)
+				wg.Done()
+			}(feed)
 		}
-		feed.id = feedID
-		feed.entries = util.NewRingBuffer[id.EventID, *event.Event](feed.MaxEntries)
-		feed.lastUpdate = time.Now().UTC()
-		if existing, alreadyExists := cfg.feedsByRoomID[feed.RoomID]; alreadyExists {
-			log.Fatal().
-				Str("room_id", feed.RoomID.String()).
-				Str("prev_feed_id", existing.id).
-				Str("new_feed_id", feedID).
-				Msg("Multiple feeds pointing at same room")
-		}
-		go func(feed *FeedConfig) {
-			fs.InitSyncFeed(feed)
-			wg.Done()
-		}(feed)
-		cfg.feedsByRoomID[feed.RoomID] = feed
-		allowedRoomIDs = append(allowedRoomIDs, feed.RoomID)
 	}
 	wg.Wait()
+	for _, feed := range aggregateFeeds {
+		feed.updateLock.Lock()
+		fs.regenerateFeed(feed, log.With().Str("feed_id", feed.id).Str("action", "initial feed load").Logger())
+		feed.updateLock.Unlock()
+	}
+
+	if !serverMode {
+		fs.Exporter, err = NewFeedExporter(fs, exportDir, log.With().Str("component", "export").Logger())
+		if err != nil {
+			log.Fatal().Err(err).Msg("Failed to initialize exporter")
+		} else if err = fs.Exporter.ExportAll(); err != nil {
+			log.Fatal().Err(err).Msg("Failed to export feeds")
+		}
+		log.Info().Str("output_dir", fs.Exporter.Dir).Msg("Exported feeds")
+		if !exportWatch {
+			return
+		}
+	}
+
+	// The ingest rooms are resolved before syncing, so that invites to them are accepted
+	if len(cfg.Ingest) > 0 && serverMode {
+		fs.Ingester, err = NewFeedIngester(cfg.Ingest, cli, log.With().Str("component", "ingest").Logger())
+		if err != nil {
+			log.Fatal().Err(err).Msg("Failed to initialize feed ingester")
+		}
+	}
 
 	ctx, cancel := context.WithCancel(context.Background())
-	wg.Add(2)
+	wg.Add(1)
 
 	syncer := cli.Syncer.(*mautrix.DefaultSyncer)
-	syncer.OnEventType(event.EventMessage, fs.HandleFeedEvent)
+	syncer.ParseErrorHandler = func(evt *event.Event, err error) bool {
+		// Poll and extensible events don't have content structs in mautrix, so they're parsed manually later
+		return errors.Is(err, event.ErrUnsupportedContentType)
+	}
+	for _, evtType := range feedEventTypes {
+		syncer.OnEventType(evtType, fs.HandleFeedEvent)
+	}
 	syncer.OnEventType(event.StateMember, fs.HandleInvite)
+	syncer.OnEventType(event.StateMember, fs.HandleMembership)
+	syncer.OnEventType(event.StateJoinRules, fs.HandleJoinRules)
 	syncer.OnEventType(event.StateMember, fs.HandleMetadata)
 	syncer.OnEventType(event.StatePowerLevels, fs.HandleMetadata)
 	syncer.OnEventType(event.StateRoomName, fs.HandleMetadata)
 	syncer.OnEventType(event.StateTopic, fs.HandleMetadata)
 	syncer.OnEventType(event.StateRoomAvatar, fs.HandleMetadata)
+	syncer.OnEventType(event.StateTombstone, fs.HandleTombstone)
 
 	nothing := mautrix.FilterPart{NotTypes: []event.Type{{Type: "*"}}}
 	importantTypes := mautrix.FilterPart{
-		Types: []event.Type{
-			event.EventMessage, event.StateMember, event.StatePowerLevels,
-			event.StateRoomName, event.StateTopic, event.StateRoomAvatar,
-		},
+		Types: append([]event.Type{
+			event.StateMember, event.StatePowerLevels,
+			event.StateRoomName, event.StateTopic, event.StateRoomAvatar, event.StateTombstone, event.StateJoinRules,
+		}, feedEventTypes...),
 	}
 	syncer.FilterJSON = &mautrix.Filter{
 		AccountData: nothing,
@@ -157,49 +333,187 @@ func main() {
 		Room: mautrix.RoomFilter{
 			AccountData: nothing,
 			Ephemeral:   nothing,
-			Rooms:       allowedRoomIDs,
+			Rooms:       fs.syncFilterRooms(),
 			State:       importantTypes,
 			Timeline:    importantTypes,
 		},
 	}
 
-	cli.Store = mautrix.NewAccountDataStore("com.beeper.feedserv_sync_token", cli)
+	// Watched exports use their own sync token, so that they don't make a server on the same account miss events
+	syncTokenKey := "com.beeper.feedserv_sync_token"
+	if !serverMode {
+		syncTokenKey = "com.beeper.feedserv_export_sync_token"
+	}
+	cli.Store = mautrix.NewAccountDataStore(syncTokenKey, cli)
 
+	fs.trustedProxies, err = parseTrustedProxies(cfg.TrustedProxies)
+	if err != nil {
+		log.Fatal().Err(err).Msg("Failed to parse trusted proxies")
+	}
+	if cfg.RateLimit.Enabled {
+		fs.RateLimiter, err = NewRateLimiter(&cfg.RateLimit)
+		if err != nil {
+			log.Fatal().Err(err).Msg("Invalid rate limit config")
+		}
+	}
 	server := http.Server{
-		Addr:    cfg.ListenAddress,
-		Handler: fs,
+		Addr:              cfg.ListenAddress,
+		Handler:           fs.limitRequests(fs),
+		ReadHeaderTimeout: cfg.Timeouts.ReadHeader,
+		ReadTimeout:       cfg.Timeouts.Read,
+		WriteTimeout:      cfg.Timeouts.Write,
+		IdleTimeout:       cfg.Timeouts.Idle,
+	}
+	var challengeServer *http.Server
+	if cfg.TLS.IsEnabled() && serverMode {
+		var challengeHandler http.Handler
+		server.TLSConfig, challengeHandler, err = fs.makeTLSConfig(log.With().Str("component", "tls").Logger())
+		if err != nil {
+			log.Fatal().Err(err).Msg("Failed to initialize TLS")
+		}
+		if challengeHandler != nil && cfg.TLS.ACME.HTTPChallengeAddress != "" {
+			challengeServer = &http.Server{
+				Addr:              cfg.TLS.ACME.HTTPChallengeAddress,
+				Handler:           challengeHandler,
+				ReadHeaderTimeout: cfg.Timeouts.ReadHeader,
+			}
+		}
 	}
 	go func() {
 		defer wg.Done()
-		err := cli.SyncWithContext(ctx)
+		err := fs.runSync(ctx)
 		if err != nil && !errors.Is(err, context.Canceled) {
 			log.Fatal().Err(err).Msg("Error in syncer")
 		} else {
 			log.Debug().Msg("Syncer finished cleanly")
 		}
 	}()
+	wg.Add(1)
 	go func() {
 		defer wg.Done()
-		err := server.ListenAndServe()
-		if err != nil && !errors.Is(err, http.ErrServerClosed) {
-			log.Fatal().Err(err).Msg("Error in HTTP server")
-		} else {
-			log.Debug().Msg("HTTP server finished cleanly")
-		}
+		fs.RunRejoins(ctx)
 	}()
+	if serverMode {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			var err error
+			if server.TLSConfig != nil {
+				// HTTP/2 is enabled automatically when serving TLS
+				err = server.ListenAndServeTLS("", "")
+			} else {
+				err = server.ListenAndServe()
+			}
+			if err != nil && !errors.Is(err, http.ErrServerClosed) {
+				log.Fatal().Err(err).Msg("Error in HTTP server")
+			} else {
+				log.Debug().Msg("HTTP server finished cleanly")
+			}
+		}()
+		if challengeServer != nil {
+			go func() {
+				err := challengeServer.ListenAndServe()
+				if err != nil && !errors.Is(err, http.ErrServerClosed) {
+					log.Fatal().Err(err).Msg("Error in ACME HTTP challenge server")
+				}
+			}()
+		}
+	} else {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			fs.Exporter.Run(ctx)
+		}()
+	}
+
+	// Deliveries use a separate context, as queued activities are still delivered after the syncer stops
+	deliveryCtx, cancelDeliveries := context.WithCancel(context.Background())
+	deliveriesDone := make(chan struct{})
+	if fs.ActivityPub != nil {
+		go func() {
+			defer close(deliveriesDone)
+			fs.ActivityPub.RunDeliveries(deliveryCtx)
+		}()
+	} else {
+		close(deliveriesDone)
+	}
+	if fs.Ingester != nil {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			fs.Ingester.Run(ctx)
+		}()
+	}
+	if serverMode {
+		fs.Digester, err = NewDigester(fs, log.With().Str("component", "digest").Logger())
+		if err != nil {
+			log.Fatal().Err(err).Msg("Failed to initialize digests")
+		} else if fs.Digester != nil {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				fs.Digester.Run(ctx)
+			}()
+		}
+	}
 
 	log.Info().Msg("Feedserv initialization complete")
 
 	c := make(chan os.Signal, 1)
-	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
-	<-c
-	log.Info().Msg("Interrupt received, stopping...")
+	signal.Notify(c, os.Interrupt, syscall.SIGTERM, syscall.SIGHUP, syscall.SIGUSR1)
+	for sig := range c {
+		if sig == syscall.SIGHUP {
+			fs.Reload()
+		} else if sig == syscall.SIGUSR1 {
+			fs.LogDiagnostics()
+		} else {
+			break
+		}
+	}
+	log.Info().Dur("timeout", cfg.ShutdownTimeout).Msg("Interrupt received, stopping...")
 
-	cancel()
-	err = server.Close()
+	// Stop accepting new requests and wait for active ones to finish
+	shutdownCtx, cancelShutdown := context.WithTimeout(context.Background(), cfg.ShutdownTimeout)
+	defer cancelShutdown()
+	err = server.Shutdown(shutdownCtx)
 	if err != nil {
-		log.Warn().Err(err).Msg("Error closing HTTP server")
+		log.Warn().Err(err).Msg("Error shutting down HTTP server")
+		_ = server.Close()
 	}
-	wg.Wait()
+	if challengeServer != nil {
+		_ = challengeServer.Close()
+	}
+	// Stop the syncer and background loops. Event handlers that are already running, including
+	// feed regenerations and cache purges, finish before the syncer returns.
+	cancel()
+	if !waitWithTimeout(shutdownCtx, wg.Wait) {
+		log.Warn().Msg("Shutdown timeout exceeded while waiting for the syncer and background tasks")
+	} else {
+		if fs.Exporter != nil {
+			fs.Exporter.Flush()
+		}
+		if fs.ActivityPub != nil {
+			fs.ActivityPub.StopDeliveries()
+		}
+		if !waitWithTimeout(shutdownCtx, func() { <-deliveriesDone }) {
+			log.Warn().Msg("Shutdown timeout exceeded while delivering queued activities")
+		}
+	}
+	cancelDeliveries()
 	log.Info().Msg("Feedserv stopped")
 }
+
+// waitWithTimeout calls the wait function and returns true if it returns before the context is canceled.
+func waitWithTimeout(ctx context.Context, wait func()) bool {
+	done := make(chan struct{})
+	go func() {
+		wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
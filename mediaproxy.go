@@ -0,0 +1,410 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/id"
+)
+
+const mediaProxyPrefix = "/_feedserv/media/"
+
+type MediaProxyConfig struct {
+	Enabled      bool          `yaml:"enabled"`
+	CacheDir     string        `yaml:"cache_dir"`
+	MaxCacheSize int64         `yaml:"max_cache_size"`
+	MaxFileSize  int64         `yaml:"max_file_size"`
+	CacheTTL     time.Duration `yaml:"cache_ttl"`
+}
+
+type MediaProxy struct {
+	Config *MediaProxyConfig
+	Client *mautrix.Client
+	Log    zerolog.Logger
+
+	fs         *FeedServ
+	urlRegex   *regexp.Regexp
+	mediaLock  sync.RWMutex
+	feedMedia  map[*FeedConfig]map[id.ContentURI]struct{}
+	mediaFeeds map[id.ContentURI]map[*FeedConfig]struct{}
+	keyLocks   sync.Map
+	evictLock  sync.Mutex
+}
+
+type cachedMediaMeta struct {
+	ContentType        string    `json:"content_type"`
+	ContentDisposition string    `json:"content_disposition,omitempty"`
+	Size               int64     `json:"size"`
+	FetchedAt          time.Time `json:"fetched_at"`
+}
+
+var errMediaTooLarge = errors.New("media is too large")
+
+var inlineMediaTypes = map[string]struct{}{
+	"image/jpeg": {}, "image/png": {}, "image/gif": {}, "image/webp": {}, "image/apng": {}, "image/avif": {},
+	"video/mp4": {}, "video/webm": {}, "video/ogg": {}, "video/quicktime": {},
+	"audio/mpeg": {}, "audio/mp4": {}, "audio/ogg": {}, "audio/webm": {}, "audio/wav": {}, "audio/x-wav": {},
+	"audio/aac": {}, "audio/flac": {}, "text/plain": {},
+}
+
+func NewMediaProxy(cfg *MediaProxyConfig, fs *FeedServ, log zerolog.Logger) (*MediaProxy, error) {
+	if cfg.CacheDir == "" {
+		cfg.CacheDir = "media-cache"
+	}
+	if cfg.CacheTTL == 0 {
+		cfg.CacheTTL = 7 * 24 * time.Hour
+	}
+	err := os.MkdirAll(cfg.CacheDir, 0700)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create media cache directory: %w", err)
+	}
+	return &MediaProxy{
+		Config: cfg,
+		Client: fs.Client,
+		Log:    log,
+
+		fs:         fs,
+		urlRegex:   regexp.MustCompile(regexp.QuoteMeta(fs.Config.PublicURL+mediaProxyPrefix) + `([^/"?#\\]+)/([^/"?#\\]+)`),
+		feedMedia:  make(map[*FeedConfig]map[id.ContentURI]struct{}),
+		mediaFeeds: make(map[id.ContentURI]map[*FeedConfig]struct{}),
+	}, nil
+}
+
+// mediaURL returns the public URL for the given Matrix content URI, either through the media proxy
+// or directly from the public media homeserver.
+func (fs *FeedServ) mediaURL(uri id.ContentURI) string {
+	if uri.IsEmpty() {
+		return ""
+	} else if fs.MediaProxy == nil {
+		return fs.Media.GetDownloadURL(uri)
+	}
+	return fs.Config.PublicURL + mediaProxyPrefix + url.PathEscape(uri.Homeserver) + "/" + url.PathEscape(uri.FileID)
+}
+
+// setFeedMedia replaces the media used by the feed with the media URLs in its generated JSON feed, which contains
+// every URL of the other formats too. Media that isn't used by any feed anymore can't be downloaded through the proxy.
+func (mp *MediaProxy) setFeedMedia(feed *FeedConfig, jsonFeed []byte) {
+	media := make(map[id.ContentURI]struct{})
+	for _, match := range mp.urlRegex.FindAllSubmatch(jsonFeed, -1) {
+		homeserver, err1 := url.PathUnescape(string(match[1]))
+		fileID, err2 := url.PathUnescape(string(match[2]))
+		if err1 == nil && err2 == nil {
+			media[id.ContentURI{Homeserver: homeserver, FileID: fileID}] = struct{}{}
+		}
+	}
+	mp.mediaLock.Lock()
+	defer mp.mediaLock.Unlock()
+	for uri := range mp.feedMedia[feed] {
+		if _, stillUsed := media[uri]; stillUsed {
+			continue
+		}
+		delete(mp.mediaFeeds[uri], feed)
+		if len(mp.mediaFeeds[uri]) == 0 {
+			delete(mp.mediaFeeds, uri)
+		}
+	}
+	for uri := range media {
+		if mp.mediaFeeds[uri] == nil {
+			mp.mediaFeeds[uri] = make(map[*FeedConfig]struct{})
+		}
+		mp.mediaFeeds[uri][feed] = struct{}{}
+	}
+	mp.feedMedia[feed] = media
+}
+
+// getMediaFeeds returns whether the media is used by any public feed, and if not, the private feeds that use it.
+func (mp *MediaProxy) getMediaFeeds(uri id.ContentURI) (public bool, privateFeeds []*FeedConfig) {
+	mp.mediaLock.RLock()
+	defer mp.mediaLock.RUnlock()
+	for feed := range mp.mediaFeeds[uri] {
+		if !feed.Private {
+			return true, nil
+		}
+		privateFeeds = append(privateFeeds, feed)
+	}
+	return false, privateFeeds
+}
+
+// authorizeMedia checks that the request has access to the media. Media used only by private feeds
+// requires a token for one of them. If access is denied, an error response is written and false is returned.
+func (mp *MediaProxy) authorizeMedia(w http.ResponseWriter, r *http.Request, uri id.ContentURI) (public, ok bool) {
+	public, privateFeeds := mp.getMediaFeeds(uri)
+	if public {
+		return true, true
+	} else if len(privateFeeds) == 0 {
+		writeError(w, http.StatusNotFound, "Media not found")
+		return false, false
+	}
+	token := getRequestToken(r)
+	for _, feed := range privateFeeds {
+		if mp.fs.Tokens != nil && mp.fs.Tokens.Check(feed, token) {
+			return false, true
+		}
+	}
+	w.Header().Add("WWW-Authenticate", `Basic realm="feedserv", charset="UTF-8"`)
+	writeError(w, http.StatusUnauthorized, "A valid token is required to access this media")
+	return false, false
+}
+
+func (mp *MediaProxy) lockKey(key string) func() {
+	lockIface, _ := mp.keyLocks.LoadOrStore(key, &sync.Mutex{})
+	lock := lockIface.(*sync.Mutex)
+	lock.Lock()
+	return lock.Unlock
+}
+
+func (mp *MediaProxy) cachePath(key string) string {
+	return filepath.Join(mp.Config.CacheDir, key[:2], key)
+}
+
+func (mp *MediaProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// Media files can be large, so the server write timeout doesn't apply to them
+	_ = http.NewResponseController(w).SetWriteDeadline(time.Time{})
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, mediaProxyPrefix), "/")
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		writeError(w, http.StatusNotFound, "Invalid media path")
+		return
+	}
+	uri := id.ContentURI{Homeserver: parts[0], FileID: parts[1]}
+	log := mp.Log.With().Str("mxc_uri", uri.String()).Logger()
+	public, ok := mp.authorizeMedia(w, r, uri)
+	if !ok {
+		log.Debug().Msg("Rejecting request for media that isn't used in any feed accessible to the requester")
+		return
+	}
+
+	thumbnail := r.URL.Query().Get("thumbnail")
+	if thumbnail != "" && thumbnail != thumbnailSize {
+		writeError(w, http.StatusBadRequest, "Unsupported thumbnail size")
+		return
+	}
+
+	cacheKey := uri.String()
+	if thumbnail != "" {
+		cacheKey += "?thumbnail=" + thumbnail
+	}
+	keyHash := sha256.Sum256([]byte(cacheKey))
+	key := hex.EncodeToString(keyHash[:])
+	unlock := mp.lockKey(key)
+	meta, file, err := mp.getCached(key)
+	if err != nil {
+		meta, file, err = mp.download(r, key, uri, thumbnail != "")
+	}
+	unlock()
+	if errors.Is(err, errMediaTooLarge) {
+		log.Warn().Msg("Media is too large to proxy")
+		writeError(w, http.StatusBadGateway, "Media is too large")
+		return
+	} else if err != nil {
+		log.Err(err).Msg("Failed to fetch media")
+		writeError(w, http.StatusBadGateway, "Failed to fetch media")
+		return
+	}
+	defer file.Close()
+
+	mediaType := strings.TrimSpace(strings.Split(meta.ContentType, ";")[0])
+	if _, safe := inlineMediaTypes[mediaType]; safe {
+		w.Header().Set("Content-Type", meta.ContentType)
+		if meta.ContentDisposition != "" {
+			w.Header().Set("Content-Disposition", strings.Replace(meta.ContentDisposition, "attachment", "inline", 1))
+		}
+	} else {
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Header().Set("Content-Disposition", "attachment")
+	}
+	if public {
+		w.Header().Set("Cache-Control", "public, max-age=604800, immutable")
+	} else {
+		// Private media must not be stored by shared caches, and tokens may be revoked, so it's only cached briefly
+		w.Header().Set("Cache-Control", "private, max-age=3600")
+	}
+	w.Header().Add("Vary", "Authorization")
+	w.Header().Set("ETag", fmt.Sprintf(`"%s"`, key))
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("Content-Security-Policy", "sandbox; default-src 'none'; media-src 'self'; img-src 'self'; style-src 'unsafe-inline'")
+	http.ServeContent(w, r, "", meta.FetchedAt, file)
+}
+
+func (mp *MediaProxy) getCached(key string) (*cachedMediaMeta, *os.File, error) {
+	path := mp.cachePath(key)
+	metaData, err := os.ReadFile(path + ".json")
+	if err != nil {
+		return nil, nil, err
+	}
+	var meta cachedMediaMeta
+	if err = json.Unmarshal(metaData, &meta); err != nil {
+		return nil, nil, err
+	} else if time.Since(meta.FetchedAt) > mp.Config.CacheTTL {
+		return nil, nil, fmt.Errorf("cache entry expired")
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	now := time.Now()
+	_ = os.Chtimes(path, now, now)
+	return &meta, file, nil
+}
+
+func (mp *MediaProxy) fetch(r *http.Request, uri id.ContentURI, thumbnail bool) (*http.Response, error) {
+	var urls []string
+	if thumbnail {
+		query := map[string]string{
+			"width":  strconv.Itoa(thumbnailWidth),
+			"height": strconv.Itoa(thumbnailHeight),
+			"method": thumbnailMethod,
+		}
+		urls = []string{
+			mp.Client.BuildURLWithQuery(mautrix.ClientURLPath{"v1", "media", "thumbnail", uri.Homeserver, uri.FileID}, query),
+			mp.Client.BuildURLWithQuery(mautrix.MediaURLPath{"v3", "thumbnail", uri.Homeserver, uri.FileID}, query),
+		}
+	} else {
+		urls = []string{
+			mp.Client.BuildURL(mautrix.ClientURLPath{"v1", "media", "download", uri.Homeserver, uri.FileID}),
+			mp.Client.BuildURLWithQuery(mautrix.MediaURLPath{"v3", "download", uri.Homeserver, uri.FileID}, map[string]string{"allow_redirect": "true"}),
+		}
+	}
+	var resp *http.Response
+	for _, reqURL := range urls {
+		req, err := http.NewRequestWithContext(r.Context(), http.MethodGet, reqURL, nil)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Authorization", "Bearer "+mp.Client.AccessToken)
+		req.Header.Set("User-Agent", mp.Client.UserAgent)
+		resp, err = mp.Client.Client.Do(req)
+		if err != nil {
+			return nil, err
+		} else if resp.StatusCode == http.StatusOK {
+			return resp, nil
+		}
+		_ = resp.Body.Close()
+		// Servers that don't support authenticated media respond with 404 M_UNRECOGNIZED (or 400/405)
+		if resp.StatusCode != http.StatusNotFound && resp.StatusCode != http.StatusBadRequest && resp.StatusCode != http.StatusMethodNotAllowed {
+			break
+		}
+	}
+	return nil, fmt.Errorf("unexpected status code %d", resp.StatusCode)
+}
+
+func (mp *MediaProxy) download(r *http.Request, key string, uri id.ContentURI, thumbnail bool) (*cachedMediaMeta, *os.File, error) {
+	resp, err := mp.fetch(r, uri, thumbnail)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+	if mp.Config.MaxFileSize > 0 && resp.ContentLength > mp.Config.MaxFileSize {
+		return nil, nil, errMediaTooLarge
+	}
+	path := mp.cachePath(key)
+	if err = os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, nil, err
+	}
+	tempFile, err := os.CreateTemp(filepath.Dir(path), key+".*.tmp")
+	if err != nil {
+		return nil, nil, err
+	}
+	defer func() {
+		_ = tempFile.Close()
+		_ = os.Remove(tempFile.Name())
+	}()
+	var body io.Reader = resp.Body
+	if mp.Config.MaxFileSize > 0 {
+		body = io.LimitReader(resp.Body, mp.Config.MaxFileSize+1)
+	}
+	size, err := io.Copy(tempFile, body)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to write media to cache: %w", err)
+	} else if mp.Config.MaxFileSize > 0 && size > mp.Config.MaxFileSize {
+		return nil, nil, errMediaTooLarge
+	}
+	meta := &cachedMediaMeta{
+		ContentType:        resp.Header.Get("Content-Type"),
+		ContentDisposition: resp.Header.Get("Content-Disposition"),
+		Size:               size,
+		FetchedAt:          time.Now().UTC(),
+	}
+	metaData, err := json.Marshal(meta)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err = os.Rename(tempFile.Name(), path); err != nil {
+		return nil, nil, fmt.Errorf("failed to move media into cache: %w", err)
+	} else if err = os.WriteFile(path+".json", metaData, 0600); err != nil {
+		return nil, nil, fmt.Errorf("failed to write media metadata to cache: %w", err)
+	}
+	go mp.evict()
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	return meta, file, nil
+}
+
+type cacheFileInfo struct {
+	path    string
+	size    int64
+	modTime time.Time
+}
+
+// evict removes the least recently used files from the cache until it fits in the configured maximum size.
+func (mp *MediaProxy) evict() {
+	if mp.Config.MaxCacheSize <= 0 {
+		return
+	}
+	mp.evictLock.Lock()
+	defer mp.evictLock.Unlock()
+	var files []cacheFileInfo
+	var totalSize int64
+	err := filepath.WalkDir(mp.Config.CacheDir, func(path string, d os.DirEntry, err error) error {
+		if err != nil || d.IsDir() || strings.HasSuffix(path, ".json") || strings.HasSuffix(path, ".tmp") {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return nil
+		}
+		files = append(files, cacheFileInfo{path: path, size: info.Size(), modTime: info.ModTime()})
+		totalSize += info.Size()
+		return nil
+	})
+	if err != nil {
+		mp.Log.Err(err).Msg("Failed to scan media cache")
+		return
+	}
+	if totalSize <= mp.Config.MaxCacheSize {
+		return
+	}
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].modTime.Before(files[j].modTime)
+	})
+	for _, file := range files {
+		if totalSize <= mp.Config.MaxCacheSize {
+			break
+		}
+		_ = os.Remove(file.path + ".json")
+		if err = os.Remove(file.path); err != nil {
+			mp.Log.Warn().Err(err).Str("path", file.path).Msg("Failed to remove file from media cache")
+			continue
+		}
+		totalSize -= file.size
+	}
+	mp.Log.Debug().Int64("cache_size", totalSize).Msg("Evicted old files from media cache")
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/rs/zerolog"
+
+	"maunium.net/go/mautrix/id"
+)
+
+func makeTestMediaProxy(t *testing.T) (*FeedServ, *MediaProxy) {
+	fs := &FeedServ{Config: &Config{PublicURL: "https://feeds.example.com"}}
+	mp, err := NewMediaProxy(&MediaProxyConfig{CacheDir: t.TempDir()}, fs, zerolog.Nop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	fs.MediaProxy = mp
+	return fs, mp
+}
+
+func TestMediaProxySetFeedMedia(t *testing.T) {
+	fs, mp := makeTestMediaProxy(t)
+	isKnown := func(uri id.ContentURI) bool {
+		public, privateFeeds := mp.getMediaFeeds(uri)
+		return public || len(privateFeeds) > 0
+	}
+	feedA, feedB := makeTestFeed("/a", "!a:example.com"), makeTestFeed("/b", "!b:example.com")
+	first := id.ContentURI{Homeserver: "example.com", FileID: "first"}
+	second := id.ContentURI{Homeserver: "example.com", FileID: "second"}
+
+	mp.setFeedMedia(feedA, []byte(`{"icon":"`+fs.mediaURL(first)+`","items":[{"image":"`+fs.thumbnailURL(second)+`"}]}`))
+	mp.setFeedMedia(feedB, []byte(`{"icon":"`+fs.mediaURL(first)+`"}`))
+	if !isKnown(first) || !isKnown(second) {
+		t.Fatal("media in feeds isn't known")
+	}
+	mp.setFeedMedia(feedA, []byte(`{"items":[]}`))
+	if !isKnown(first) {
+		t.Error("media still used by another feed was forgotten")
+	} else if isKnown(second) {
+		t.Error("media that fell out of the feed is still known")
+	}
+	mp.setFeedMedia(feedB, []byte(`{"items":[]}`))
+	if isKnown(first) || len(mp.mediaFeeds) != 0 {
+		t.Error("media that isn't used by any feed is still known")
+	}
+}
+
+func TestMediaProxyAuthorizeMedia(t *testing.T) {
+	fs, mp := makeTestMediaProxy(t)
+	fs.Tokens = &FeedTokens{fs: fs, store: feedTokenStore{Tokens: map[string]*feedToken{
+		hashFeedToken("secret"): {Feeds: []string{"/private"}},
+	}}}
+	publicFeed := makeTestFeed("/public", "!public:example.com")
+	privateFeed := makeTestFeed("/private", "!private:example.com")
+	privateFeed.Private = true
+	shared := id.ContentURI{Homeserver: "example.com", FileID: "shared"}
+	secret := id.ContentURI{Homeserver: "example.com", FileID: "secret"}
+	unknown := id.ContentURI{Homeserver: "example.com", FileID: "unknown"}
+	mp.setFeedMedia(publicFeed, []byte(`{"icon":"`+fs.mediaURL(shared)+`"}`))
+	mp.setFeedMedia(privateFeed, []byte(`{"icon":"`+fs.mediaURL(shared)+`","items":[{"image":"`+fs.mediaURL(secret)+`"}]}`))
+
+	tests := []struct {
+		name       string
+		uri        id.ContentURI
+		token      string
+		wantPublic bool
+		wantOK     bool
+		wantStatus int
+	}{
+		{"public media", shared, "", true, true, http.StatusOK},
+		{"private media without token", secret, "", false, false, http.StatusUnauthorized},
+		{"private media with wrong token", secret, "wrong", false, false, http.StatusUnauthorized},
+		{"private media with token", secret, "secret", false, true, http.StatusOK},
+		{"unknown media", unknown, "secret", false, false, http.StatusNotFound},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, fs.mediaURL(test.uri), nil)
+			if test.token != "" {
+				req.Header.Set("Authorization", "Bearer "+test.token)
+			}
+			w := httptest.NewRecorder()
+			public, ok := mp.authorizeMedia(w, req, test.uri)
+			if public != test.wantPublic || ok != test.wantOK {
+				t.Errorf("got public=%t ok=%t, expected public=%t ok=%t", public, ok, test.wantPublic, test.wantOK)
+			} else if w.Code != test.wantStatus {
+				t.Errorf("got status %d, expected %d", w.Code, test.wantStatus)
+			}
+		})
+	}
+}
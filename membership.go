@@ -0,0 +1,225 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/rs/zerolog"
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+	"maunium.net/go/mautrix/util"
+)
+
+// Reasons why a feed is stale, i.e. can't receive new entries because feedserv isn't in the room.
+const (
+	staleReasonKicked     = "kicked"
+	staleReasonBanned     = "banned"
+	staleReasonLeft       = "left"
+	staleReasonJoinFailed = "join_failed"
+)
+
+const (
+	rejoinCheckInterval  = 10 * time.Second
+	rejoinInitialBackoff = 30 * time.Second
+	rejoinMaxBackoff     = 1 * time.Hour
+)
+
+type rejoinState struct {
+	nextAttempt time.Time
+	backoff     time.Duration
+}
+
+// HandleMembership marks feeds as stale when feedserv is kicked or banned from the room or leaves it,
+// and as fresh again when it rejoins. Rejoining is retried automatically for public rooms.
+func (fs *FeedServ) HandleMembership(_ mautrix.EventSource, evt *event.Event) {
+	feeds := fs.Config.feedsByRoomID[evt.RoomID]
+	if evt.GetStateKey() != fs.Client.UserID.String() || len(feeds) == 0 {
+		return
+	}
+	log := fs.Log.With().
+		Str("room_id", evt.RoomID.String()).
+		Str("sender", evt.Sender.String()).
+		Str("event_id", evt.ID.String()).
+		Str("action", "own membership change").
+		Logger()
+	content := evt.Content.AsMember()
+	var reason string
+	switch content.Membership {
+	case event.MembershipJoin:
+		fs.cancelRejoin(evt.RoomID)
+		if fs.setFeedsStale(feeds, "", log) {
+			log.Info().Msg("Rejoined feed room, feeds are no longer stale")
+			fs.refreshRoomState(evt.RoomID, log)
+			fs.reloadHistory(feeds, log)
+		}
+		return
+	case event.MembershipBan:
+		reason = staleReasonBanned
+	case event.MembershipLeave:
+		reason = staleReasonKicked
+		if evt.Sender == fs.Client.UserID {
+			reason = staleReasonLeft
+		}
+	default:
+		return
+	}
+	if !fs.setFeedsStale(feeds, reason, log) {
+		return
+	}
+	log.Warn().
+		Str("stale_reason", reason).
+		Str("membership_reason", content.Reason).
+		Msg("Removed from feed room, feeds won't be updated until it's rejoined")
+	isPublic := false
+	for _, feed := range feeds {
+		feed.updateLock.RLock()
+		isPublic = isPublic || feed.joinRule == event.JoinRulePublic
+		feed.updateLock.RUnlock()
+	}
+	if isPublic && reason != staleReasonBanned {
+		fs.queueRejoin(evt.RoomID)
+	}
+}
+
+// HandleJoinRules keeps track of whether feed rooms are public, which determines if rejoining is retried.
+func (fs *FeedServ) HandleJoinRules(_ mautrix.EventSource, evt *event.Event) {
+	if evt.GetStateKey() != "" {
+		return
+	}
+	for _, feed := range fs.Config.feedsByRoomID[evt.RoomID] {
+		feed.updateLock.Lock()
+		feed.joinRule = evt.Content.AsJoinRules().JoinRule
+		feed.updateLock.Unlock()
+	}
+}
+
+// setFeedsStale sets the stale reason of the given feeds, or clears it if the reason is empty.
+// Feeds that expire when stale are regenerated. It returns true if any feed changed.
+func (fs *FeedServ) setFeedsStale(feeds []*FeedConfig, reason string, log zerolog.Logger) bool {
+	changed := false
+	for _, feed := range feeds {
+		feedLog := log.With().Str("feed_id", feed.id).Logger()
+		feed.updateLock.Lock()
+		if feed.staleReason == reason {
+			feed.updateLock.Unlock()
+			continue
+		}
+		changed = true
+		feed.staleReason = reason
+		feed.staleSince = time.Time{}
+		if reason != "" {
+			feed.staleSince = time.Now().UTC()
+		}
+		if !feed.ExpireWhenStale {
+			feed.updateLock.Unlock()
+			continue
+		}
+		fs.regenerateFeed(feed, feedLog)
+		feed.updateLock.Unlock()
+		if err := fs.purgeCloudflareCache(feed); err != nil {
+			feedLog.Err(err).Msg("Failed to purge Cloudflare cache")
+		}
+		fs.regenerateAggregates(feed, feedLog)
+	}
+	return changed
+}
+
+// reloadHistory replaces the entries of the given feeds with the latest messages in the room. Messages sent
+// while feedserv wasn't in the room were missed, and feeds of rooms that couldn't be joined on startup are empty.
+func (fs *FeedServ) reloadHistory(feeds []*FeedConfig, log zerolog.Logger) {
+	for _, feed := range feeds {
+		feedLog := log.With().Str("feed_id", feed.id).Logger()
+		feed.updateLock.Lock()
+		oldEntries, oldGroupedMedia, oldPolls := feed.entries, feed.groupedMedia, feed.polls
+		feed.entries = util.NewRingBuffer[id.EventID, *event.Event](feed.MaxEntries)
+		feed.groupedMedia = make(map[id.EventID][]*event.Event)
+		feed.polls = make(map[id.EventID]*pollState)
+		if err := fs.loadHistory(feed, feedLog); err != nil {
+			feedLog.Err(err).Msg("Failed to reload feed history, keeping existing entries")
+			feed.entries, feed.groupedMedia, feed.polls = oldEntries, oldGroupedMedia, oldPolls
+			feed.updateLock.Unlock()
+			continue
+		}
+		fs.regenerateFeed(feed, feedLog)
+		feed.updateLock.Unlock()
+		if !feed.hidden {
+			if err := fs.purgeCloudflareCache(feed); err != nil {
+				feedLog.Err(err).Msg("Failed to purge Cloudflare cache")
+			}
+		}
+		fs.regenerateAggregates(feed, feedLog)
+	}
+}
+
+func (fs *FeedServ) queueRejoin(roomID id.RoomID) {
+	fs.rejoinLock.Lock()
+	defer fs.rejoinLock.Unlock()
+	if _, alreadyQueued := fs.rejoins[roomID]; alreadyQueued {
+		return
+	} else if fs.rejoins == nil {
+		fs.rejoins = make(map[id.RoomID]*rejoinState)
+	}
+	fs.rejoins[roomID] = &rejoinState{
+		nextAttempt: time.Now().Add(rejoinInitialBackoff),
+		backoff:     rejoinInitialBackoff,
+	}
+}
+
+func (fs *FeedServ) cancelRejoin(roomID id.RoomID) {
+	fs.rejoinLock.Lock()
+	delete(fs.rejoins, roomID)
+	fs.rejoinLock.Unlock()
+}
+
+// RunRejoins retries joining the queued rooms with exponential backoff until the context is cancelled.
+// The feeds become fresh again once the join event comes down the sync.
+func (fs *FeedServ) RunRejoins(ctx context.Context) {
+	ticker := time.NewTicker(rejoinCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			fs.rejoinLock.Lock()
+			var due []id.RoomID
+			for roomID, state := range fs.rejoins {
+				if now.After(state.nextAttempt) {
+					due = append(due, roomID)
+				}
+			}
+			fs.rejoinLock.Unlock()
+			for _, roomID := range due {
+				fs.attemptRejoin(roomID)
+			}
+		}
+	}
+}
+
+func (fs *FeedServ) attemptRejoin(roomID id.RoomID) {
+	log := fs.Log.With().Str("room_id", roomID.String()).Str("action", "rejoin").Logger()
+	_, err := fs.Client.JoinRoomByID(roomID)
+	fs.rejoinLock.Lock()
+	state, ok := fs.rejoins[roomID]
+	if !ok {
+		fs.rejoinLock.Unlock()
+		return
+	} else if err == nil {
+		delete(fs.rejoins, roomID)
+		fs.rejoinLock.Unlock()
+		log.Info().Msg("Rejoined feed room")
+		// Feeds that couldn't be joined on startup don't have the room state yet,
+		// and the state is synced before the join event reaches HandleMembership
+		fs.refreshRoomState(roomID, log)
+		return
+	}
+	state.backoff *= 2
+	if state.backoff > rejoinMaxBackoff {
+		state.backoff = rejoinMaxBackoff
+	}
+	state.nextAttempt = time.Now().Add(state.backoff)
+	backoff := state.backoff
+	fs.rejoinLock.Unlock()
+	log.Warn().Err(err).Dur("retry_in", backoff).Msg("Failed to rejoin feed room")
+}
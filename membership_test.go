@@ -0,0 +1,134 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/rs/zerolog"
+
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+func TestReloadHistoryAfterRejoin(t *testing.T) {
+	failMessages := false
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasSuffix(r.URL.Path, "/messages") {
+			t.Errorf("unexpected request to %s", r.URL.Path)
+			w.WriteHeader(http.StatusNotFound)
+		} else if failMessages {
+			w.WriteHeader(http.StatusInternalServerError)
+			_, _ = w.Write([]byte(`{"errcode":"M_UNKNOWN","error":"Internal error"}`))
+		} else {
+			_, _ = w.Write([]byte(`{"start":"s1","end":"","chunk":[
+				{"event_id":"$new2","room_id":"!room:example.com","type":"m.room.message","sender":"@author:example.com","origin_server_ts":1700000002000,"content":{"msgtype":"m.text","body":"Second"}},
+				{"event_id":"$new1","room_id":"!room:example.com","type":"m.room.message","sender":"@author:example.com","origin_server_ts":1700000001000,"content":{"msgtype":"m.text","body":"First"}}
+			]}`))
+		}
+	}))
+	defer server.Close()
+	cli, err := mautrix.NewClient(server.URL, "@feedserv:example.com", "token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	log := zerolog.Nop()
+	feed := makeTestFeed("/test", "!room:example.com")
+	feed.pushEvent(log, makeTestMessage(feed.RoomID, "$old", "@author:example.com", &event.MessageEventContent{MsgType: event.MsgText, Body: "Old"}))
+	fs := &FeedServ{Log: &log, Client: cli, Config: &Config{PublicURL: "https://example.com"}}
+
+	failMessages = true
+	fs.reloadHistory([]*FeedConfig{feed}, log)
+	if !feed.entries.Contains("$old") || feed.entries.Size() != 1 {
+		t.Fatal("failed reload didn't keep the existing entries")
+	}
+
+	failMessages = false
+	fs.reloadHistory([]*FeedConfig{feed}, log)
+	var entryIDs []id.EventID
+	for _, entry := range feed.getEntries() {
+		entryIDs = append(entryIDs, entry.ID)
+	}
+	if len(entryIDs) != 2 || entryIDs[0] != "$new2" || entryIDs[1] != "$new1" {
+		t.Errorf("expected entries to be replaced with the room history, got %v", entryIDs)
+	}
+	if len(feed.json) == 0 {
+		t.Error("feed wasn't regenerated")
+	}
+}
+
+func TestRejoinAfterFailedStartupJoin(t *testing.T) {
+	var lock sync.Mutex
+	joined := false
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		defer lock.Unlock()
+		switch {
+		case strings.HasSuffix(r.URL.Path, "/join") && !joined:
+			w.WriteHeader(http.StatusBadGateway)
+			_, _ = w.Write([]byte(`{"errcode":"M_UNKNOWN","error":"Failed to reach remote server"}`))
+		case strings.HasSuffix(r.URL.Path, "/join"):
+			_, _ = w.Write([]byte(`{"room_id":"!room:example.com"}`))
+		case strings.HasSuffix(r.URL.Path, "/state") && !joined:
+			w.WriteHeader(http.StatusForbidden)
+			_, _ = w.Write([]byte(`{"errcode":"M_FORBIDDEN","error":"Not in room"}`))
+		case strings.HasSuffix(r.URL.Path, "/state"):
+			_, _ = w.Write([]byte(`[
+				{"type":"m.room.power_levels","state_key":"","event_id":"$pl","room_id":"!room:example.com","sender":"@admin:example.com","content":{"users":{"@author:example.com":50},"events_default":50}},
+				{"type":"m.room.member","state_key":"@author:example.com","event_id":"$member","room_id":"!room:example.com","sender":"@author:example.com","content":{"membership":"join","displayname":"Author"}}
+			]`))
+		default:
+			t.Errorf("unexpected request to %s", r.URL.Path)
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+	cli, err := mautrix.NewClient(server.URL, "@feedserv:example.com", "token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	log := zerolog.Nop()
+	fs := &FeedServ{Log: &log, Client: cli, Config: &Config{
+		PublicURL:     "https://example.com",
+		feedsByRoomID: make(map[id.RoomID][]*FeedConfig),
+	}}
+	feed := &FeedConfig{id: "/test", RoomID: "!room:example.com", MaxEntries: 10, MemberAccess: true}
+	fs.prepareRoomFeed(feed)
+	fs.InitSyncFeed(feed)
+	if feed.staleReason != staleReasonJoinFailed {
+		t.Fatalf("expected feed to be stale after failed join, got %q", feed.staleReason)
+	}
+
+	// The state of the room is synced before the join event, which must not crash on the missing state
+	memberEvt := &event.Event{
+		Type:     event.StateMember,
+		StateKey: ptrString("@author:example.com"),
+		RoomID:   feed.RoomID,
+		Sender:   "@author:example.com",
+		ID:       "$member",
+		Content:  event.Content{Parsed: &event.MemberEventContent{Membership: event.MembershipJoin, Displayname: "Author"}},
+	}
+	fs.HandleMetadata(0, memberEvt)
+
+	lock.Lock()
+	joined = true
+	lock.Unlock()
+	fs.attemptRejoin(feed.RoomID)
+	if _, stillQueued := fs.rejoins[feed.RoomID]; stillQueued {
+		t.Error("room is still queued for rejoining")
+	}
+	if feed.powers.Users["@author:example.com"] != 50 {
+		t.Error("power levels weren't loaded after rejoining")
+	} else if feed.authors["@author:example.com"].Name != "Author" {
+		t.Errorf("author profile wasn't loaded after rejoining: %+v", feed.authors)
+	} else if _, isMember := feed.members["@author:example.com"]; !isMember {
+		t.Error("members weren't loaded after rejoining")
+	}
+}
+
+func ptrString(s string) *string {
+	return &s
+}
@@ -1,23 +1,28 @@
 package main
 
 import (
+	"fmt"
 	"time"
 
+	"github.com/rs/zerolog"
+
 	"maunium.net/go/mautrix"
 	"maunium.net/go/mautrix/event"
 	"maunium.net/go/mautrix/id"
+	"maunium.net/go/mautrix/util"
 )
 
 func (fs *FeedServ) HandleMetadata(_ mautrix.EventSource, evt *event.Event) {
-	if evt.StateKey == nil || (*evt.StateKey != "" && evt.Type == event.StateMember) {
+	if evt.StateKey == nil || (*evt.StateKey != "" && evt.Type != event.StateMember) {
 		return
 	}
-	feed, ok := fs.Config.feedsByRoomID[evt.RoomID]
-	if !ok {
-		return
+	for _, feed := range fs.Config.feedsByRoomID[evt.RoomID] {
+		fs.updateFeedMetadata(feed, evt)
 	}
+}
+
+func (fs *FeedServ) updateFeedMetadata(feed *FeedConfig, evt *event.Event) {
 	feed.updateLock.Lock()
-	defer feed.updateLock.Unlock()
 	log := fs.Log.With().
 		Str("room_id", evt.RoomID.String()).
 		Str("sender", evt.Sender.String()).
@@ -25,42 +30,111 @@ func (fs *FeedServ) HandleMetadata(_ mautrix.EventSource, evt *event.Event) {
 		Str("feed_id", feed.id).
 		Str("action", "feed metadata update").
 		Logger()
+	profileChanged := false
+	revokeMemberTokens := false
 	switch evt.Type {
 	case event.StateRoomName:
+		if feed.Title != "" {
+			break
+		}
 		feed.title = evt.Content.AsRoomName().Name
+		profileChanged = true
 		log.Debug().Str("feed_title", feed.title).Msg("Updated feed title")
 	case event.StateTopic:
+		if feed.Description != "" {
+			break
+		}
 		feed.description = evt.Content.AsTopic().Topic
+		profileChanged = true
 		log.Debug().Str("feed_description", feed.description).Msg("Updated feed description")
 	case event.StateRoomAvatar:
-		feed.icon = fs.Media.GetDownloadURL(evt.Content.AsRoomAvatar().URL)
+		if feed.Icon != "" {
+			break
+		}
+		feed.icon = fs.mediaURL(evt.Content.AsRoomAvatar().URL)
 		feed.iconMXC = evt.Content.AsRoomAvatar().URL
+		profileChanged = true
 		log.Debug().Str("feed_icon", feed.icon).Msg("Updated feed icon")
 	case event.StatePowerLevels:
 		feed.powers = evt.Content.AsPowerLevels()
 		log.Debug().Msg("Updated cached power levels")
 	case event.StateMember:
 		userID := id.UserID(evt.GetStateKey())
-		if feed.powers.GetUserLevel(userID) > feed.powers.GetEventLevel(event.EventMessage) {
-			profile := evt.Content.AsMember()
-			feed.authors[userID] = JSONFeedAuthor{
-				Name:   profile.Displayname,
-				URL:    userID.URI().MatrixToURL(),
-				Avatar: fs.Media.GetDownloadURL(profile.AvatarURL.ParseOrIgnore()),
-				MatrixProfile: &JSONFeedMatrixProfile{
-					UserID: userID,
-					Avatar: profile.AvatarURL,
-				},
+		profile := evt.Content.AsMember()
+		if feed.MemberAccess {
+			if profile.Membership == event.MembershipJoin {
+				feed.members[userID] = struct{}{}
+			} else if _, wasMember := feed.members[userID]; wasMember {
+				delete(feed.members, userID)
+				revokeMemberTokens = true
+			}
+		}
+		if level, ok := feed.powers.Users[userID]; !ok || level < feed.powers.GetEventLevel(event.EventMessage) {
+			// Only users who can send messages are authors, so other membership changes don't affect the feed
+			feed.updateLock.Unlock()
+			if revokeMemberTokens {
+				fs.Tokens.RevokeMember(feed, userID)
 			}
-			log.Debug().
-				Str("user_id", userID.String()).
-				Str("name", feed.authors[userID].Name).
-				Str("avatar", feed.authors[userID].Avatar).
-				Msg("Updated author profile")
+			return
 		}
+		feed.authors[userID] = JSONFeedAuthor{
+			Name:   profile.Displayname,
+			URL:    userID.URI().MatrixToURL(),
+			Avatar: fs.mediaURL(profile.AvatarURL.ParseOrIgnore()),
+			MatrixProfile: &JSONFeedMatrixProfile{
+				UserID: userID,
+				Avatar: profile.AvatarURL,
+			},
+		}
+		log.Debug().
+			Str("user_id", userID.String()).
+			Str("name", feed.authors[userID].Name).
+			Str("avatar", feed.authors[userID].Avatar).
+			Msg("Updated author profile")
 	}
 
 	fs.regenerateFeed(feed, log)
+	if profileChanged && fs.ActivityPub != nil {
+		fs.ActivityPub.QueueActorUpdate(feed)
+	}
+	feed.updateLock.Unlock()
+	if revokeMemberTokens {
+		fs.Tokens.RevokeMember(feed, id.UserID(evt.GetStateKey()))
+	}
+	fs.regenerateAggregates(feed, log)
+}
+
+// maxInitialSyncPages is the maximum number of message pages fetched when loading a filtered feed on startup.
+const maxInitialSyncPages = 10
+
+// minInitialSyncPageSize is the minimum number of events requested per page, so that rooms with lots of
+// poll votes and edits don't run out of pages before the feed is full.
+const minInitialSyncPageSize = 100
+
+// countBackfillEntries returns the number of entries that the given events would result in. Poll responses,
+// edits, redactions and grouped media don't create entries, so they don't count toward the backfill limit.
+// The events must be in reverse chronological order like in /messages responses.
+func (feed *FeedConfig) countBackfillEntries(events []*event.Event) int {
+	scratch := &FeedConfig{
+		GroupMedia:   feed.GroupMedia,
+		powers:       feed.powers,
+		entries:      util.NewRingBuffer[id.EventID, *event.Event](len(events) + 1),
+		groupedMedia: make(map[id.EventID][]*event.Event),
+		polls:        make(map[id.EventID]*pollState),
+	}
+	for i := len(events) - 1; i >= 0; i-- {
+		// Edits and redactions modify the stored event, so the real events must not be pushed
+		evtCopy := *events[i]
+		scratch.pushEvent(zerolog.Nop(), &evtCopy)
+	}
+	count := 0
+	_ = scratch.entries.Iter(func(_ id.EventID, evt *event.Event) error {
+		if evt.Unsigned.RedactedBecause == nil {
+			count++
+		}
+		return nil
+	})
+	return count
 }
 
 func (fs *FeedServ) InitSyncFeed(feed *FeedConfig) {
@@ -72,27 +146,111 @@ func (fs *FeedServ) InitSyncFeed(feed *FeedConfig) {
 		Logger()
 	log.Debug().Msg("Syncing initial metadata")
 	state, err := fs.Client.State(feed.RoomID)
-	if err != nil {
+	if err != nil && feed.staleReason != "" {
+		// Feeds of rooms that couldn't be joined are served empty until the room is joined
+		log.Err(err).Msg("Failed to fetch room state of stale feed")
+		feed.updateLock.Lock()
+		fs.regenerateFeed(feed, log)
+		feed.updateLock.Unlock()
+		return
+	} else if err != nil {
 		log.Fatal().Err(err).Msg("Failed to fetch room state")
 		return
 	}
 	feed.updateLock.Lock()
 	defer feed.updateLock.Unlock()
+	fs.applyRoomState(feed, state)
+
+	if err = fs.loadHistory(feed, log); err != nil && feed.staleReason != "" {
+		log.Warn().Err(err).Msg("Failed to load history of stale feed")
+	} else if err != nil {
+		log.Fatal().Err(err).Msg("Failed to load feed history")
+	}
+	log.Info().
+		Str("feed_title", feed.title).
+		Str("feed_description", feed.description).
+		Str("feed_icon", feed.icon).
+		Int("entry_count", feed.entries.Size()).
+		Dur("duration", time.Since(start)).
+		Msg("Synced feed metadata")
+
+	fs.regenerateFeed(feed, log)
+}
+
+// loadHistory fetches the latest messages from the room and the rooms it was upgraded from, and pushes
+// them into the feed. The caller must hold the update lock of the feed.
+func (fs *FeedServ) loadHistory(feed *FeedConfig, log zerolog.Logger) error {
+	var events []*event.Event
+	var entryCount int
+	var fetchErr error
+	pageSize := feed.MaxEntries
+	if pageSize < minInitialSyncPageSize {
+		pageSize = minInitialSyncPageSize
+	}
+	// If the room has been upgraded, history is loaded from the previous rooms until the feed is full
+	for _, roomID := range append([]id.RoomID{feed.RoomID}, feed.previousRooms...) {
+		var from string
+		for page := 0; page < maxInitialSyncPages && entryCount < feed.MaxEntries; page++ {
+			resp, err := fs.Client.Messages(roomID, from, "", mautrix.DirectionBackward, &mautrix.FilterPart{Types: feedEventTypes}, pageSize)
+			if err != nil && roomID != feed.RoomID {
+				log.Warn().Err(err).Str("history_room_id", roomID.String()).Msg("Failed to fetch room messages")
+				break
+			} else if err != nil {
+				fetchErr = fmt.Errorf("failed to fetch room messages: %w", err)
+				break
+			}
+			for _, evt := range resp.Chunk {
+				evt.Type.Class = event.MessageEventType
+				_ = evt.Content.ParseRaw(evt.Type)
+				if !isCommandReply(evt) && !fs.isTokenCommand(evt) && feed.Filter.Matches(feed, evt) {
+					events = append(events, evt)
+				}
+			}
+			entryCount = feed.countBackfillEntries(events)
+			if resp.End == "" || len(resp.Chunk) == 0 {
+				break
+			}
+			from = resp.End
+		}
+		if fetchErr != nil {
+			break
+		}
+	}
+	for i := len(events) - 1; i >= 0; i-- {
+		feed.pushEvent(log, events[i])
+	}
+	return fetchErr
+}
+
+// applyRoomState sets the feed metadata, power levels, members and authors from the full state of the room.
+// The caller must hold the update lock of the feed.
+func (fs *FeedServ) applyRoomState(feed *FeedConfig, state mautrix.RoomStateMap) {
 	roomNameEvt := state[event.StateRoomName][""]
 	roomTopicEvt := state[event.StateTopic][""]
 	roomAvatarEvt := state[event.StateRoomAvatar][""]
-	if roomNameEvt != nil {
+	if roomNameEvt != nil && feed.Title == "" {
 		feed.title = roomNameEvt.Content.AsRoomName().Name
 	}
-	if roomTopicEvt != nil {
+	if roomTopicEvt != nil && feed.Description == "" {
 		feed.description = roomTopicEvt.Content.AsTopic().Topic
 	}
-	if roomAvatarEvt != nil {
-		feed.icon = fs.Media.GetDownloadURL(roomAvatarEvt.Content.AsRoomAvatar().URL)
+	if roomAvatarEvt != nil && feed.Icon == "" {
+		feed.icon = fs.mediaURL(roomAvatarEvt.Content.AsRoomAvatar().URL)
 		feed.iconMXC = roomAvatarEvt.Content.AsRoomAvatar().URL
 	}
 
 	feed.powers = state[event.StatePowerLevels][""].Content.AsPowerLevels()
+	if joinRulesEvt := state[event.StateJoinRules][""]; joinRulesEvt != nil {
+		feed.joinRule = joinRulesEvt.Content.AsJoinRules().JoinRule
+	}
+	if feed.MemberAccess {
+		feed.members = make(map[id.UserID]struct{})
+		for stateKey, memberEvt := range state[event.StateMember] {
+			if memberEvt.Content.AsMember().Membership == event.MembershipJoin {
+				feed.members[id.UserID(stateKey)] = struct{}{}
+			}
+		}
+	}
 	feed.authors = make(map[id.UserID]JSONFeedAuthor)
 	for userID, level := range feed.powers.Users {
 		if level >= feed.powers.GetEventLevel(event.EventMessage) {
@@ -100,7 +258,7 @@ func (fs *FeedServ) InitSyncFeed(feed *FeedConfig) {
 			feed.authors[userID] = JSONFeedAuthor{
 				Name:   profile.Displayname,
 				URL:    userID.URI().MatrixToURL(),
-				Avatar: fs.Media.GetDownloadURL(profile.AvatarURL.ParseOrIgnore()),
+				Avatar: fs.mediaURL(profile.AvatarURL.ParseOrIgnore()),
 				MatrixProfile: &JSONFeedMatrixProfile{
 					UserID: userID,
 					Avatar: profile.AvatarURL,
@@ -108,22 +266,4 @@ func (fs *FeedServ) InitSyncFeed(feed *FeedConfig) {
 			}
 		}
 	}
-	resp, err := fs.Client.Messages(feed.RoomID, "", "", mautrix.DirectionBackward, &mautrix.FilterPart{Types: []event.Type{event.EventMessage}}, feed.MaxEntries)
-	if err != nil {
-		log.Fatal().Err(err).Msg("Failed to fetch room messages")
-	}
-	for i := len(resp.Chunk) - 1; i >= 0; i-- {
-		evt := resp.Chunk[i]
-		_ = evt.Content.ParseRaw(evt.Type)
-		feed.pushEvent(log, evt)
-	}
-	log.Info().
-		Str("feed_title", feed.title).
-		Str("feed_description", feed.description).
-		Str("feed_icon", feed.icon).
-		Int("entry_count", feed.entries.Size()).
-		Dur("duration", time.Since(start)).
-		Msg("Synced feed metadata")
-
-	fs.regenerateFeed(feed, log)
 }
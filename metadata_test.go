@@ -0,0 +1,48 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+func TestCountBackfillEntries(t *testing.T) {
+	feed := makeTestFeed("/test", "!room:example.com")
+	sender := id.UserID("@author:example.com")
+	// Chronological order, reversed below to match /messages
+	chronological := []*event.Event{
+		makeTestPoll(feed.RoomID, "m.poll.disclosed"),
+		makeTestMessage(feed.RoomID, "$first", sender, &event.MessageEventContent{MsgType: event.MsgText, Body: "First"}),
+		makeTestMessage(feed.RoomID, "$second", sender, &event.MessageEventContent{MsgType: event.MsgText, Body: "Second"}),
+	}
+	for i := 0; i < 20; i++ {
+		chronological = append(chronological, makeTestVote(feed.RoomID, id.UserID(fmt.Sprintf("@voter%d:example.com", i)), "red"))
+	}
+	edit := makeTestMessage(feed.RoomID, "$edit", sender, &event.MessageEventContent{
+		MsgType:    event.MsgText,
+		Body:       "* First!",
+		NewContent: &event.MessageEventContent{MsgType: event.MsgText, Body: "First!"},
+		RelatesTo:  &event.RelatesTo{Type: event.RelReplace, EventID: "$first"},
+	})
+	redaction := &event.Event{ID: "$redaction", RoomID: feed.RoomID, Type: event.EventRedaction, Sender: sender, Redacts: "$second"}
+	chronological = append(chronological, edit, redaction)
+	events := make([]*event.Event, len(chronological))
+	for i, evt := range chronological {
+		events[len(events)-1-i] = evt
+	}
+
+	if count := feed.countBackfillEntries(events); count != 2 {
+		t.Errorf("expected 2 entries (the poll and the first message), got %d", count)
+	}
+	if first := chronological[1].Content.AsMessage(); first.Body != "First" {
+		t.Errorf("counting modified the original event: %q", first.Body)
+	}
+	if chronological[2].Unsigned.RedactedBecause != nil {
+		t.Error("counting redacted the original event")
+	}
+	if feed.entries.Size() != 0 || len(feed.polls) != 0 {
+		t.Error("counting modified the feed")
+	}
+}
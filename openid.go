@@ -0,0 +1,213 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"maunium.net/go/mautrix/id"
+)
+
+const openIDSubscribePath = "/_feedserv/openid/subscribe"
+
+var serverNameRegex = regexp.MustCompile(`^(?:[a-zA-Z0-9.-]+|\[[0-9a-fA-F:.]+])(?::[0-9]{1,5})?$`)
+
+var openIDClient = newOpenIDClient(nil)
+
+// newOpenIDClient returns a client for contacting the homeservers of OpenID tokens. The server names come from
+// unauthenticated requests, so only public addresses are allowed, like for ActivityPub.
+func newOpenIDClient(tlsConfig *tls.Config) *http.Client {
+	client := newPublicHTTPClient(15 * time.Second)
+	client.Transport.(*http.Transport).TLSClientConfig = tlsConfig
+	// Redirects aren't followed, so that verification can't be pointed at arbitrary URLs
+	client.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+		return http.ErrUseLastResponse
+	}
+	return client
+}
+
+// OpenIDToken is the response of /_matrix/client/v3/user/{userId}/openid/request_token.
+type OpenIDToken struct {
+	AccessToken      string `json:"access_token"`
+	TokenType        string `json:"token_type"`
+	MatrixServerName string `json:"matrix_server_name"`
+	ExpiresIn        int    `json:"expires_in"`
+}
+
+type reqOpenIDSubscribe struct {
+	Feed   string      `json:"feed"`
+	OpenID OpenIDToken `json:"openid"`
+}
+
+type respOpenIDSubscribe struct {
+	UserID id.UserID `json:"user_id"`
+	Token  string    `json:"token"`
+	URL    string    `json:"url"`
+}
+
+type federationServer struct {
+	// URL is the base URL to connect to, and Host is the Host header and TLS server name to use.
+	URL  string
+	Host string
+}
+
+// resolveFederationServer finds the federation API address of a server name using .well-known
+// delegation and SRV records as described in https://spec.matrix.org/v1.6/server-server-api/#resolving-server-names
+func resolveFederationServer(ctx context.Context, serverName string) (*federationServer, error) {
+	if !serverNameRegex.MatchString(serverName) {
+		return nil, fmt.Errorf("invalid server name")
+	}
+	host, port, err := net.SplitHostPort(serverName)
+	if err != nil {
+		host = serverName
+	}
+	if net.ParseIP(strings.Trim(host, "[]")) != nil || port != "" {
+		if port == "" {
+			return &federationServer{URL: "https://" + serverName + ":8448", Host: host}, nil
+		}
+		return &federationServer{URL: "https://" + serverName, Host: host}, nil
+	}
+	if delegated := fetchWellKnownServer(ctx, serverName); delegated != "" {
+		if delegatedHost, _, err := net.SplitHostPort(delegated); err == nil {
+			return &federationServer{URL: "https://" + delegated, Host: delegatedHost}, nil
+		}
+		host = delegated
+	}
+	for _, service := range []string{"matrix-fed", "matrix"} {
+		_, records, err := net.DefaultResolver.LookupSRV(ctx, service, "tcp", host)
+		if err == nil && len(records) > 0 {
+			target := strings.TrimSuffix(records[0].Target, ".")
+			return &federationServer{
+				URL:  "https://" + net.JoinHostPort(target, strconv.Itoa(int(records[0].Port))),
+				Host: host,
+			}, nil
+		}
+	}
+	return &federationServer{URL: "https://" + net.JoinHostPort(host, "8448"), Host: host}, nil
+}
+
+func fetchWellKnownServer(ctx context.Context, serverName string) string {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "https://"+serverName+"/.well-known/matrix/server", nil)
+	if err != nil {
+		return ""
+	}
+	resp, err := openIDClient.Do(req)
+	if err != nil {
+		return ""
+	}
+	defer resp.Body.Close()
+	var wellKnown struct {
+		Server string `json:"m.server"`
+	}
+	if resp.StatusCode != http.StatusOK || json.NewDecoder(io.LimitReader(resp.Body, 64*1024)).Decode(&wellKnown) != nil {
+		return ""
+	} else if !serverNameRegex.MatchString(wellKnown.Server) {
+		return ""
+	}
+	return wellKnown.Server
+}
+
+// verifyOpenIDToken asks the homeserver of the token which user it belongs to.
+func verifyOpenIDToken(ctx context.Context, token *OpenIDToken) (id.UserID, error) {
+	if token.AccessToken == "" || token.MatrixServerName == "" {
+		return "", fmt.Errorf("access_token and matrix_server_name are required")
+	}
+	server, err := resolveFederationServer(ctx, token.MatrixServerName)
+	if err != nil {
+		return "", err
+	}
+	userinfoURL := server.URL + "/_matrix/federation/v1/openid/userinfo?access_token=" + url.QueryEscape(token.AccessToken)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, userinfoURL, nil)
+	if err != nil {
+		return "", err
+	}
+	req.Host = server.Host
+	client := openIDClient
+	if !strings.HasPrefix(server.URL, "https://"+server.Host) {
+		// SRV targets must present a certificate for the server name rather than the target host
+		client = newOpenIDClient(&tls.Config{ServerName: server.Host})
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("failed to contact homeserver: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("homeserver rejected token with HTTP %d", resp.StatusCode)
+	}
+	var userinfo struct {
+		Sub id.UserID `json:"sub"`
+	}
+	if err = json.NewDecoder(io.LimitReader(resp.Body, 64*1024)).Decode(&userinfo); err != nil {
+		return "", fmt.Errorf("invalid userinfo response: %w", err)
+	}
+	_, homeserver, err := userinfo.Sub.Parse()
+	if err != nil {
+		return "", fmt.Errorf("invalid user ID in userinfo response: %w", err)
+	} else if homeserver != token.MatrixServerName {
+		return "", fmt.Errorf("homeserver returned user ID %s from a different server", userinfo.Sub)
+	}
+	return userinfo.Sub, nil
+}
+
+// ServeOpenID issues personal feed tokens to room members who prove their identity with an OpenID token.
+func (ft *FeedTokens) ServeOpenID(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Methods", "POST, OPTIONS")
+	w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
+	if r.Method == http.MethodOptions {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	} else if r.Method != http.MethodPost {
+		w.Header().Add("Allow", "POST, OPTIONS")
+		writeError(w, http.StatusMethodNotAllowed, "Unsupported method %q", r.Method)
+		return
+	}
+	var req reqOpenIDSubscribe
+	if err := json.NewDecoder(io.LimitReader(r.Body, 64*1024)).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "Invalid request body: %v", err)
+		return
+	}
+	feed, ok := ft.fs.Config.Feeds[strings.ToLower(req.Feed)]
+	if !ok || !feed.MemberAccess {
+		writeError(w, http.StatusNotFound, "Feed %q doesn't allow member access", req.Feed)
+		return
+	}
+	log := ft.Log.With().Str("feed_id", feed.id).Str("matrix_server_name", req.OpenID.MatrixServerName).Logger()
+	userID, err := verifyOpenIDToken(r.Context(), &req.OpenID)
+	if err != nil {
+		log.Debug().Err(err).Msg("Failed to verify OpenID token")
+		writeError(w, http.StatusUnauthorized, "Failed to verify OpenID token: %v", err)
+		return
+	}
+	log = log.With().Str("user_id", userID.String()).Logger()
+	feed.updateLock.RLock()
+	_, isMember := feed.members[userID]
+	feed.updateLock.RUnlock()
+	if !isMember {
+		log.Debug().Msg("Rejecting member access for user who isn't in the room")
+		writeError(w, http.StatusForbidden, "%s is not a member of the room", userID)
+		return
+	}
+	token, _, err := ft.IssueMember(feed, userID)
+	if err != nil {
+		log.Err(err).Msg("Failed to issue member token")
+		writeError(w, http.StatusInternalServerError, "Failed to issue token")
+		return
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	writeJSON(w, http.StatusOK, &respOpenIDSubscribe{
+		UserID: userID,
+		Token:  token,
+		URL:    ft.fs.Config.PublicURL + feed.id + "?token=" + token,
+	})
+}
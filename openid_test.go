@@ -0,0 +1,31 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func TestVerifyOpenIDTokenRefusesLoopback(t *testing.T) {
+	var requests atomic.Int32
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		_, _ = w.Write([]byte(`{"sub":"@admin:127.0.0.1"}`))
+	}))
+	defer server.Close()
+	serverName := strings.TrimPrefix(server.URL, "https://")
+
+	for _, name := range []string{serverName, "localhost" + serverName[strings.LastIndex(serverName, ":"):]} {
+		_, err := verifyOpenIDToken(context.Background(), &OpenIDToken{AccessToken: "token", MatrixServerName: name})
+		if !errors.Is(err, errNonPublicAddress) {
+			t.Errorf("%s: expected non-public address error, got %v", name, err)
+		}
+	}
+	if requests.Load() != 0 {
+		t.Errorf("loopback server received %d requests", requests.Load())
+	}
+}
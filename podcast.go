@@ -0,0 +1,125 @@
+package main
+
+import (
+	"fmt"
+
+	"maunium.net/go/mautrix/event"
+)
+
+const (
+	ITunesNamespace  = "http://www.itunes.com/dtds/podcast-1.0.dtd"
+	PodcastNamespace = "https://podcastindex.org/namespace/1.0"
+
+	// episodeNumberField is a custom field in message content that can be used to set the episode number explicitly.
+	episodeNumberField = "com.beeper.feedserv.episode"
+)
+
+type PodcastConfig struct {
+	Enabled     bool   `yaml:"enabled"`
+	Author      string `yaml:"author"`
+	OwnerName   string `yaml:"owner_name"`
+	OwnerEmail  string `yaml:"owner_email"`
+	Category    string `yaml:"category"`
+	Subcategory string `yaml:"subcategory"`
+	Explicit    bool   `yaml:"explicit"`
+	Image       string `yaml:"image"`
+	Type        string `yaml:"type"`
+}
+
+type rssChannelExtensions struct {
+	ITunesAuthor   string          `xml:"itunes:author,omitempty"`
+	ITunesOwner    *iTunesOwner    `xml:"itunes:owner,omitempty"`
+	ITunesImage    *iTunesImage    `xml:"itunes:image,omitempty"`
+	ITunesCategory *iTunesCategory `xml:"itunes:category,omitempty"`
+	ITunesExplicit string          `xml:"itunes:explicit,omitempty"`
+	ITunesType     string          `xml:"itunes:type,omitempty"`
+}
+
+type iTunesOwner struct {
+	Name  string `xml:"itunes:name,omitempty"`
+	Email string `xml:"itunes:email,omitempty"`
+}
+
+type iTunesImage struct {
+	Href string `xml:"href,attr"`
+}
+
+type iTunesCategory struct {
+	Text        string          `xml:"text,attr"`
+	Subcategory *iTunesCategory `xml:"itunes:category,omitempty"`
+}
+
+type podcastEpisode struct {
+	Number int `xml:",chardata"`
+}
+
+func formatITunesBool(val bool) string {
+	if val {
+		return "true"
+	}
+	return "false"
+}
+
+// formatITunesDuration formats a duration in milliseconds as HH:MM:SS.
+func formatITunesDuration(durationMS int) string {
+	seconds := durationMS / 1000
+	return fmt.Sprintf("%02d:%02d:%02d", seconds/3600, seconds/60%60, seconds%60)
+}
+
+func (fs *FeedServ) makePodcastChannelExtensions(feed *FeedConfig) *rssChannelExtensions {
+	cfg := feed.Podcast
+	ext := &rssChannelExtensions{
+		ITunesAuthor:   cfg.Author,
+		ITunesExplicit: formatITunesBool(cfg.Explicit),
+		ITunesType:     cfg.Type,
+	}
+	if cfg.OwnerName != "" || cfg.OwnerEmail != "" {
+		ext.ITunesOwner = &iTunesOwner{Name: cfg.OwnerName, Email: cfg.OwnerEmail}
+	}
+	if image := cfg.Image; image != "" {
+		ext.ITunesImage = &iTunesImage{Href: image}
+	} else if feed.icon != "" {
+		ext.ITunesImage = &iTunesImage{Href: feed.icon}
+	}
+	if cfg.Category != "" {
+		ext.ITunesCategory = &iTunesCategory{Text: cfg.Category}
+		if cfg.Subcategory != "" {
+			ext.ITunesCategory.Subcategory = &iTunesCategory{Text: cfg.Subcategory}
+		}
+	}
+	return ext
+}
+
+func getExplicitEpisodeNumber(evt *event.Event) int {
+	raw, ok := evt.Content.Raw[episodeNumberField]
+	if !ok {
+		return 0
+	}
+	number, _ := raw.(float64)
+	return int(number)
+}
+
+// addPodcastItemExtensions adds iTunes and Podcasting 2.0 metadata to the RSS items of a podcast feed.
+// Episodes are only numbered if the event specifies a number explicitly, as the feed only contains the latest
+// entries, so numbering by position would change the numbers of every episode when old ones fall out.
+func (fs *FeedServ) addPodcastItemExtensions(feed *FeedConfig, entries []feedEntry, extensions []rssItemExtensions) {
+	for i, evt := range entries {
+		content := evt.Content.AsMessage()
+		ext := &extensions[i]
+		ext.ITunesExplicit = formatITunesBool(feed.Podcast.Explicit)
+		if content.MsgType != event.MsgAudio {
+			continue
+		}
+		if episodeNumber := getExplicitEpisodeNumber(evt.Event); episodeNumber > 0 {
+			ext.ITunesEpisode = episodeNumber
+			ext.PodcastEpisode = &podcastEpisode{Number: episodeNumber}
+		}
+		ext.ITunesEpisodeType = "full"
+		if duration := content.GetInfo().Duration; duration > 0 {
+			ext.ITunesDuration = formatITunesDuration(duration)
+		}
+		if ext.MediaThumbnail != nil {
+			ext.ITunesImage = &iTunesImage{Href: ext.MediaThumbnail.URL}
+		}
+	}
+}
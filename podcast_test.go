@@ -0,0 +1,32 @@
+package main
+
+import (
+	"testing"
+
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+func TestPodcastEpisodeNumbers(t *testing.T) {
+	feed := makeTestFeed("/podcast", "!room:example.com")
+	feed.Podcast.Enabled = true
+	sender := id.UserID("@host:example.com")
+	numbered := makeTestMessage(feed.RoomID, "$numbered", sender, &event.MessageEventContent{MsgType: event.MsgAudio, Body: "ep2.mp3"})
+	numbered.Content.Raw = map[string]any{episodeNumberField: float64(2)}
+	unnumbered := makeTestMessage(feed.RoomID, "$unnumbered", sender, &event.MessageEventContent{MsgType: event.MsgAudio, Body: "bonus.mp3"})
+	entries := []feedEntry{{Event: unnumbered}, {Event: numbered}}
+	extensions := make([]rssItemExtensions, len(entries))
+
+	(&FeedServ{}).addPodcastItemExtensions(feed, entries, extensions)
+	if extensions[0].ITunesEpisode != 0 || extensions[0].PodcastEpisode != nil {
+		t.Errorf("episode without explicit number was numbered: %d", extensions[0].ITunesEpisode)
+	}
+	if extensions[1].ITunesEpisode != 2 || extensions[1].PodcastEpisode == nil || extensions[1].PodcastEpisode.Number != 2 {
+		t.Errorf("expected explicit episode number 2, got %d", extensions[1].ITunesEpisode)
+	}
+	for i, ext := range extensions {
+		if ext.ITunesEpisodeType != "full" {
+			t.Errorf("entry %d: expected episode type full, got %q", i, ext.ITunesEpisodeType)
+		}
+	}
+}
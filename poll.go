@@ -0,0 +1,228 @@
+package main
+
+import (
+	"encoding/json"
+
+	"github.com/rs/zerolog"
+
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+var (
+	EventPollStart         = event.Type{Type: "m.poll.start", Class: event.MessageEventType}
+	EventPollResponse      = event.Type{Type: "m.poll.response", Class: event.MessageEventType}
+	EventPollEnd           = event.Type{Type: "m.poll.end", Class: event.MessageEventType}
+	EventUnstablePollStart = event.Type{Type: "org.matrix.msc3381.poll.start", Class: event.MessageEventType}
+	EventUnstablePollResp  = event.Type{Type: "org.matrix.msc3381.poll.response", Class: event.MessageEventType}
+	EventUnstablePollEnd   = event.Type{Type: "org.matrix.msc3381.poll.end", Class: event.MessageEventType}
+)
+
+const (
+	pollKindUndisclosed         = "m.poll.undisclosed"
+	unstablePollKindUndisclosed = "org.matrix.msc3381.poll.undisclosed"
+)
+
+func isPollStart(evtType event.Type) bool {
+	return evtType == EventPollStart || evtType == EventUnstablePollStart
+}
+
+func isPollUpdate(evtType event.Type) bool {
+	return evtType == EventPollResponse || evtType == EventUnstablePollResp ||
+		evtType == EventPollEnd || evtType == EventUnstablePollEnd
+}
+
+// extensibleText is an MSC1767 text content block, which is either a plain string (old unstable format)
+// or a list of representations with different mimetypes.
+type extensibleText struct {
+	Plain string
+	HTML  string
+}
+
+func (et *extensibleText) UnmarshalJSON(data []byte) error {
+	var plain string
+	if json.Unmarshal(data, &plain) == nil {
+		et.Plain = plain
+		return nil
+	}
+	var representations []struct {
+		Body     string `json:"body"`
+		MimeType string `json:"mimetype"`
+	}
+	if err := json.Unmarshal(data, &representations); err != nil {
+		return err
+	}
+	for _, repr := range representations {
+		switch repr.MimeType {
+		case "", "text/plain":
+			if et.Plain == "" {
+				et.Plain = repr.Body
+			}
+		case "text/html":
+			if et.HTML == "" {
+				et.HTML = repr.Body
+			}
+		}
+	}
+	return nil
+}
+
+// extensibleTextContent contains the text blocks of an extensible event in both stable and unstable formats.
+type extensibleTextContent struct {
+	Text         *extensibleText `json:"m.text,omitempty"`
+	HTML         string          `json:"m.html,omitempty"`
+	UnstableText string          `json:"org.matrix.msc1767.text,omitempty"`
+	UnstableHTML string          `json:"org.matrix.msc1767.html,omitempty"`
+}
+
+func (etc *extensibleTextContent) Get() (plain, html string) {
+	if etc.Text != nil {
+		plain, html = etc.Text.Plain, etc.Text.HTML
+	}
+	if plain == "" {
+		plain = etc.UnstableText
+	}
+	if html == "" {
+		html = etc.HTML
+	}
+	if html == "" {
+		html = etc.UnstableHTML
+	}
+	return
+}
+
+type pollAnswer struct {
+	extensibleTextContent
+	ID         string `json:"m.id"`
+	UnstableID string `json:"id"`
+}
+
+type pollStartBlock struct {
+	Question      extensibleTextContent `json:"question"`
+	Kind          string                `json:"kind"`
+	MaxSelections int                   `json:"max_selections"`
+	Answers       []pollAnswer          `json:"answers"`
+}
+
+type pollStartContent struct {
+	Poll         *pollStartBlock `json:"m.poll,omitempty"`
+	UnstablePoll *pollStartBlock `json:"org.matrix.msc3381.poll.start,omitempty"`
+}
+
+type pollUpdateContent struct {
+	RelatesTo struct {
+		EventID id.EventID `json:"event_id"`
+	} `json:"m.relates_to"`
+	Selections       []string `json:"m.selections"`
+	UnstableResponse *struct {
+		Answers []string `json:"answers"`
+	} `json:"org.matrix.msc3381.poll.response,omitempty"`
+}
+
+func parsePollStart(evt *event.Event) *pollStartBlock {
+	var content pollStartContent
+	if err := json.Unmarshal(evt.Content.VeryRaw, &content); err != nil {
+		return nil
+	} else if content.Poll != nil {
+		return content.Poll
+	}
+	return content.UnstablePoll
+}
+
+type pollResponse struct {
+	answers   []string
+	timestamp int64
+}
+
+type pollState struct {
+	responses map[id.UserID]pollResponse
+	ended     bool
+	// federatedText is the rendered poll that was last sent to ActivityPub followers.
+	federatedText string
+}
+
+type pollResults struct {
+	Votes map[string]int
+	Ended bool
+	Total int
+}
+
+// getPollState returns the state of the given poll, creating it if it doesn't exist yet.
+// The caller must hold the update lock of the feed.
+func (feed *FeedConfig) getPollState(pollID id.EventID) *pollState {
+	state, ok := feed.polls[pollID]
+	if !ok {
+		state = &pollState{responses: make(map[id.UserID]pollResponse)}
+		feed.polls[pollID] = state
+	}
+	return state
+}
+
+// recordPollUpdate applies a poll response or end event to a poll that is in the feed.
+// It returns the ID of the poll, or an empty string if the update didn't change anything.
+// The caller must hold the update lock of the feed.
+func (feed *FeedConfig) recordPollUpdate(log zerolog.Logger, evt *event.Event) id.EventID {
+	var content pollUpdateContent
+	if err := json.Unmarshal(evt.Content.VeryRaw, &content); err != nil {
+		log.Warn().Err(err).Msg("Failed to parse poll update")
+		return ""
+	}
+	pollEvt, found := feed.entries.Get(content.RelatesTo.EventID)
+	if !found || !isPollStart(pollEvt.Type) {
+		return ""
+	}
+	state := feed.getPollState(pollEvt.ID)
+	if evt.Type == EventPollEnd || evt.Type == EventUnstablePollEnd {
+		if evt.Sender == pollEvt.Sender {
+			state.ended = true
+		}
+		return pollEvt.ID
+	} else if state.ended {
+		return ""
+	}
+	answers := content.Selections
+	if content.UnstableResponse != nil {
+		answers = content.UnstableResponse.Answers
+	}
+	if existing, ok := state.responses[evt.Sender]; ok && existing.timestamp > evt.Timestamp {
+		return ""
+	}
+	state.responses[evt.Sender] = pollResponse{answers: answers, timestamp: evt.Timestamp}
+	return pollEvt.ID
+}
+
+// getPollResults counts the votes of a poll. Votes with more selections than allowed are ignored.
+// The caller must hold the update lock of the feed.
+func (feed *FeedConfig) getPollResults(pollEvt *event.Event) *pollResults {
+	results := &pollResults{Votes: make(map[string]int)}
+	state, ok := feed.polls[pollEvt.ID]
+	if !ok {
+		return results
+	}
+	results.Ended = state.ended
+	poll := parsePollStart(pollEvt)
+	maxSelections := 1
+	if poll != nil && poll.MaxSelections > 0 {
+		maxSelections = poll.MaxSelections
+	}
+	for _, resp := range state.responses {
+		if len(resp.answers) == 0 || len(resp.answers) > maxSelections {
+			continue
+		}
+		results.Total++
+		for _, answer := range resp.answers {
+			results.Votes[answer]++
+		}
+	}
+	return results
+}
+
+// prunePolls removes poll state for polls that have fallen out of the feed.
+// The caller must hold the update lock of the feed.
+func (feed *FeedConfig) prunePolls() {
+	for pollID := range feed.polls {
+		if !feed.entries.Contains(pollID) {
+			delete(feed.polls, pollID)
+		}
+	}
+}
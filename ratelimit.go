@@ -0,0 +1,197 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type HTTPTimeoutConfig struct {
+	ReadHeader time.Duration `yaml:"read_header"`
+	Read       time.Duration `yaml:"read"`
+	Write      time.Duration `yaml:"write"`
+	Idle       time.Duration `yaml:"idle"`
+}
+
+type RateLimitConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// Rate is the number of requests per second that each client IP can make on average.
+	Rate float64 `yaml:"rate"`
+	// Burst is the number of requests that can be made at once before the rate applies.
+	Burst int `yaml:"burst"`
+}
+
+// rateLimitBucketTTL is how long the bucket of an idle client is kept in memory.
+const rateLimitBucketTTL = 10 * time.Minute
+
+type tokenBucket struct {
+	tokens     float64
+	lastUpdate time.Time
+}
+
+// RateLimiter is a token bucket rate limiter keyed by client IP.
+type RateLimiter struct {
+	rate  float64
+	burst float64
+
+	buckets   map[string]*tokenBucket
+	lastSweep time.Time
+	lock      sync.Mutex
+}
+
+func NewRateLimiter(cfg *RateLimitConfig) (*RateLimiter, error) {
+	if cfg.Rate <= 0 || cfg.Burst <= 0 {
+		return nil, fmt.Errorf("rate and burst must be positive")
+	}
+	return &RateLimiter{
+		rate:      cfg.Rate,
+		burst:     float64(cfg.Burst),
+		buckets:   make(map[string]*tokenBucket),
+		lastSweep: time.Now(),
+	}, nil
+}
+
+// Allow takes a token from the bucket of the given key. If the bucket is empty,
+// it returns false and the time until the next token is available.
+func (rl *RateLimiter) Allow(key string) (bool, time.Duration) {
+	now := time.Now()
+	rl.lock.Lock()
+	defer rl.lock.Unlock()
+	if now.Sub(rl.lastSweep) > rateLimitBucketTTL {
+		rl.sweep(now)
+	}
+	bucket, ok := rl.buckets[key]
+	if !ok {
+		bucket = &tokenBucket{tokens: rl.burst, lastUpdate: now}
+		rl.buckets[key] = bucket
+	} else {
+		bucket.tokens = math.Min(rl.burst, bucket.tokens+now.Sub(bucket.lastUpdate).Seconds()*rl.rate)
+		bucket.lastUpdate = now
+	}
+	if bucket.tokens < 1 {
+		return false, time.Duration((1 - bucket.tokens) / rl.rate * float64(time.Second))
+	}
+	bucket.tokens--
+	return true, 0
+}
+
+// SetLimits changes the rate and burst of the limiter. Existing buckets keep their current tokens.
+func (rl *RateLimiter) SetLimits(cfg *RateLimitConfig) error {
+	if cfg.Rate <= 0 || cfg.Burst <= 0 {
+		return fmt.Errorf("rate and burst must be positive")
+	}
+	rl.lock.Lock()
+	rl.rate = cfg.Rate
+	rl.burst = float64(cfg.Burst)
+	rl.lock.Unlock()
+	return nil
+}
+
+// sweep removes buckets that have been idle long enough to be full again. The caller must hold the lock.
+func (rl *RateLimiter) sweep(now time.Time) {
+	for key, bucket := range rl.buckets {
+		if now.Sub(bucket.lastUpdate) > rateLimitBucketTTL {
+			delete(rl.buckets, key)
+		}
+	}
+	rl.lastSweep = now
+}
+
+func parseTrustedProxies(proxies []string) ([]*net.IPNet, error) {
+	nets := make([]*net.IPNet, len(proxies))
+	for i, proxy := range proxies {
+		if !strings.Contains(proxy, "/") {
+			if ip := net.ParseIP(proxy); ip != nil && ip.To4() != nil {
+				proxy += "/32"
+			} else {
+				proxy += "/128"
+			}
+		}
+		_, ipNet, err := net.ParseCIDR(proxy)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy %q: %w", proxy, err)
+		}
+		nets[i] = ipNet
+	}
+	return nets, nil
+}
+
+func isTrustedProxy(ip net.IP, trusted []*net.IPNet) bool {
+	for _, ipNet := range trusted {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientIP returns the IP address of the client that made the request. Proxy headers are only
+// used if the request came from a trusted proxy: X-Forwarded-For is read from right to left until
+// the first untrusted address, and CF-Connecting-IP is used as-is if trust_cloudflare_header is enabled.
+// Other proxies like nginx pass CF-Connecting-IP through unchanged, so it can't be trusted by default.
+func (fs *FeedServ) clientIP(r *http.Request) string {
+	remoteIP, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		remoteIP = r.RemoteAddr
+	}
+	parsedRemoteIP := net.ParseIP(remoteIP)
+	if parsedRemoteIP == nil || !isTrustedProxy(parsedRemoteIP, fs.trustedProxies) {
+		return remoteIP
+	}
+	if fs.Config.TrustCloudflareHeader {
+		if cfIP := net.ParseIP(strings.TrimSpace(r.Header.Get("CF-Connecting-IP"))); cfIP != nil {
+			return cfIP.String()
+		}
+	}
+	forwardedFor := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(forwardedFor) - 1; i >= 0; i-- {
+		ip := net.ParseIP(strings.TrimSpace(forwardedFor[i]))
+		if ip == nil {
+			break
+		}
+		remoteIP = ip.String()
+		if !isTrustedProxy(ip, fs.trustedProxies) {
+			break
+		}
+	}
+	return remoteIP
+}
+
+// limitRequests wraps the handler with the per-IP rate limit and the concurrent request limit.
+func (fs *FeedServ) limitRequests(next http.Handler) http.Handler {
+	var semaphore chan struct{}
+	if fs.Config.MaxConcurrentRequests > 0 {
+		semaphore = make(chan struct{}, fs.Config.MaxConcurrentRequests)
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if fs.RateLimiter != nil {
+			ip := fs.clientIP(r)
+			if ok, retryAfter := fs.RateLimiter.Allow(ip); !ok {
+				fs.Log.Debug().
+					Str("remote_ip", ip).
+					Str("path", r.URL.Path).
+					Dur("retry_after", retryAfter).
+					Msg("Rate limited request")
+				w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+				writeError(w, http.StatusTooManyRequests, "Too many requests")
+				return
+			}
+		}
+		if semaphore != nil {
+			select {
+			case semaphore <- struct{}{}:
+				defer func() { <-semaphore }()
+			default:
+				w.Header().Set("Retry-After", "1")
+				writeError(w, http.StatusServiceUnavailable, "Too many concurrent requests")
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
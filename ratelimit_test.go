@@ -0,0 +1,127 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+func TestRateLimiterAllow(t *testing.T) {
+	rl, err := NewRateLimiter(&RateLimitConfig{Enabled: true, Rate: 1, Burst: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		if ok, _ := rl.Allow("192.0.2.1"); !ok {
+			t.Fatalf("request %d within burst was denied", i+1)
+		}
+	}
+	ok, retryAfter := rl.Allow("192.0.2.1")
+	if ok {
+		t.Fatal("request over burst was allowed")
+	} else if retryAfter <= 0 || retryAfter > time.Second {
+		t.Errorf("unexpected retry after %s", retryAfter)
+	}
+	if ok, _ = rl.Allow("192.0.2.2"); !ok {
+		t.Error("other client was limited")
+	}
+
+	// Pretend that two seconds have passed
+	rl.buckets["192.0.2.1"].lastUpdate = rl.buckets["192.0.2.1"].lastUpdate.Add(-2 * time.Second)
+	for i := 0; i < 2; i++ {
+		if ok, _ = rl.Allow("192.0.2.1"); !ok {
+			t.Fatalf("request %d after refill was denied", i+1)
+		}
+	}
+	if ok, _ = rl.Allow("192.0.2.1"); ok {
+		t.Error("bucket was refilled with more tokens than the rate allows")
+	}
+
+	// Idle buckets are removed in the next sweep
+	rl.buckets["192.0.2.2"].lastUpdate = time.Now().Add(-2 * rateLimitBucketTTL)
+	rl.lastSweep = time.Now().Add(-2 * rateLimitBucketTTL)
+	rl.Allow("192.0.2.1")
+	if _, exists := rl.buckets["192.0.2.2"]; exists {
+		t.Error("idle bucket wasn't swept")
+	} else if _, exists = rl.buckets["192.0.2.1"]; !exists {
+		t.Error("active bucket was swept")
+	}
+
+	if _, err = NewRateLimiter(&RateLimitConfig{Rate: 0, Burst: 1}); err == nil {
+		t.Error("zero rate was accepted")
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	trusted, err := parseTrustedProxies([]string{"10.0.0.0/8", "::1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	fs := &FeedServ{trustedProxies: trusted, Config: &Config{}}
+	tests := []struct {
+		name       string
+		cloudflare bool
+		remoteAddr string
+		headers    map[string]string
+		expected   string
+	}{
+		{"direct", false, "192.0.2.1:1234", nil, "192.0.2.1"},
+		{"untrusted proxy headers are ignored", true, "192.0.2.1:1234", map[string]string{
+			"X-Forwarded-For": "198.51.100.1", "CF-Connecting-IP": "198.51.100.2",
+		}, "192.0.2.1"},
+		{"cloudflare", true, "10.1.2.3:1234", map[string]string{"CF-Connecting-IP": "198.51.100.2"}, "198.51.100.2"},
+		{"cloudflare header not trusted", false, "10.1.2.3:1234", map[string]string{
+			"X-Forwarded-For": "198.51.100.1", "CF-Connecting-IP": "198.51.100.2",
+		}, "198.51.100.1"},
+		{"forwarded for", false, "10.1.2.3:1234", map[string]string{"X-Forwarded-For": "198.51.100.1"}, "198.51.100.1"},
+		{"spoofed forwarded for", false, "10.1.2.3:1234", map[string]string{
+			"X-Forwarded-For": "203.0.113.9, 198.51.100.1, 10.4.5.6",
+		}, "198.51.100.1"},
+		{"only trusted proxies", false, "[::1]:1234", map[string]string{"X-Forwarded-For": "10.4.5.6"}, "10.4.5.6"},
+		{"invalid forwarded for", false, "10.1.2.3:1234", map[string]string{"X-Forwarded-For": "garbage"}, "10.1.2.3"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			fs.Config.TrustCloudflareHeader = test.cloudflare
+			req := httptest.NewRequest(http.MethodGet, "/feed", nil)
+			req.RemoteAddr = test.remoteAddr
+			for key, value := range test.headers {
+				req.Header.Set(key, value)
+			}
+			if ip := fs.clientIP(req); ip != test.expected {
+				t.Errorf("got %q, expected %q", ip, test.expected)
+			}
+		})
+	}
+	if _, err = parseTrustedProxies([]string{"not an ip"}); err == nil {
+		t.Error("invalid trusted proxy was accepted")
+	}
+}
+
+func TestLimitRequests(t *testing.T) {
+	log := zerolog.Nop()
+	rl, err := NewRateLimiter(&RateLimitConfig{Enabled: true, Rate: 0.5, Burst: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	fs := &FeedServ{Config: &Config{}, Log: &log, RateLimiter: rl}
+	handler := fs.limitRequests(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	request := func() *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/feed", nil))
+		return w
+	}
+	if w := request(); w.Code != http.StatusNoContent {
+		t.Errorf("first request failed with %d", w.Code)
+	}
+	if w := request(); w.Code != http.StatusTooManyRequests {
+		t.Errorf("second request wasn't rate limited, got %d", w.Code)
+	} else if w.Header().Get("Retry-After") != "2" {
+		t.Errorf("unexpected Retry-After %q", w.Header().Get("Retry-After"))
+	}
+}
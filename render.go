@@ -0,0 +1,135 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"golang.org/x/net/html"
+
+	"maunium.net/go/mautrix/event"
+)
+
+// EventExtensibleMessage is the MSC1767 extensible event type for plain text messages.
+var EventExtensibleMessage = event.Type{Type: "m.message", Class: event.MessageEventType}
+
+// feedEventTypes are the event types that can become entries in feeds (or modify or remove existing entries).
+var feedEventTypes = []event.Type{
+	event.EventMessage, event.EventSticker, EventExtensibleMessage, event.EventRedaction,
+	EventPollStart, EventPollResponse, EventPollEnd,
+	EventUnstablePollStart, EventUnstablePollResp, EventUnstablePollEnd,
+}
+
+type geoPoint struct {
+	Latitude  float64 `json:"latitude"`
+	Longitude float64 `json:"longitude"`
+}
+
+func (gp *geoPoint) MapURL() string {
+	return fmt.Sprintf("https://www.openstreetmap.org/?mlat=%[1]f&mlon=%[2]f#map=16/%[1]f/%[2]f", gp.Latitude, gp.Longitude)
+}
+
+// parseGeoURI parses a geo: URI as defined in RFC 5870, e.g. geo:60.1699,24.9384;u=35
+func parseGeoURI(uri string) *geoPoint {
+	coords, ok := strings.CutPrefix(uri, "geo:")
+	if !ok {
+		return nil
+	}
+	coords, _, _ = strings.Cut(coords, ";")
+	parts := strings.Split(coords, ",")
+	if len(parts) < 2 {
+		return nil
+	}
+	lat, err1 := strconv.ParseFloat(parts[0], 64)
+	lon, err2 := strconv.ParseFloat(parts[1], 64)
+	if err1 != nil || err2 != nil {
+		return nil
+	}
+	return &geoPoint{Latitude: lat, Longitude: lon}
+}
+
+type renderedContent struct {
+	Text string
+	HTML string
+	Geo  *geoPoint
+}
+
+func escapeHTMLText(text string) string {
+	return strings.ReplaceAll(html.EscapeString(text), "\n", "<br>")
+}
+
+// renderContent converts the content of an entry into plain text and HTML,
+// including content types that don't use the legacy body and formatted_body fields.
+func (fs *FeedServ) renderContent(entry feedEntry) renderedContent {
+	content := entry.Content.AsMessage()
+	switch {
+	case isPollStart(entry.Type):
+		return renderPoll(entry)
+	case entry.Type == event.EventSticker:
+		rendered := renderedContent{Text: content.Body}
+		if url := fs.mediaURL(content.URL.ParseOrIgnore()); url != "" {
+			rendered.HTML = fmt.Sprintf(`<img src="%s" alt="%s" title="%s">`, html.EscapeString(url), html.EscapeString(content.Body), html.EscapeString(content.Body))
+		}
+		return rendered
+	case content.MsgType == event.MsgLocation:
+		rendered := renderedContent{Text: content.Body, Geo: parseGeoURI(content.GeoURI)}
+		if rendered.Geo != nil {
+			mapURL := rendered.Geo.MapURL()
+			rendered.Text = fmt.Sprintf("%s\n%s", content.Body, mapURL)
+			rendered.HTML = fmt.Sprintf(`<p>%s</p><p><a href="%s">📍 %f, %f</a></p>`, escapeHTMLText(content.Body), html.EscapeString(mapURL), rendered.Geo.Latitude, rendered.Geo.Longitude)
+		}
+		return rendered
+	case content.Body != "" || content.FormattedBody != "":
+		return renderedContent{Text: content.Body, HTML: fs.rewriteInlineMedia(content.FormattedBody)}
+	default:
+		var extensible extensibleTextContent
+		_ = json.Unmarshal(entry.Content.VeryRaw, &extensible)
+		text, htmlText := extensible.Get()
+		return renderedContent{Text: text, HTML: fs.rewriteInlineMedia(htmlText)}
+	}
+}
+
+func renderPoll(entry feedEntry) renderedContent {
+	poll := parsePollStart(entry.Event)
+	if poll == nil {
+		var extensible extensibleTextContent
+		_ = json.Unmarshal(entry.Content.VeryRaw, &extensible)
+		text, htmlText := extensible.Get()
+		return renderedContent{Text: text, HTML: htmlText}
+	}
+	results := entry.pollResults
+	showResults := results != nil && (results.Ended || (poll.Kind != pollKindUndisclosed && poll.Kind != unstablePollKindUndisclosed))
+	question, _ := poll.Question.Get()
+	var text, htmlText strings.Builder
+	_, _ = fmt.Fprintf(&text, "📊 %s\n", question)
+	_, _ = fmt.Fprintf(&htmlText, "<p>📊 <strong>%s</strong></p><ul>", escapeHTMLText(question))
+	for _, answer := range poll.Answers {
+		answerText, _ := answer.Get()
+		answerID := answer.ID
+		if answerID == "" {
+			answerID = answer.UnstableID
+		}
+		if showResults {
+			votes := results.Votes[answerID]
+			_, _ = fmt.Fprintf(&text, "- %s (%d)\n", answerText, votes)
+			_, _ = fmt.Fprintf(&htmlText, "<li>%s <em>(%d)</em></li>", escapeHTMLText(answerText), votes)
+		} else {
+			_, _ = fmt.Fprintf(&text, "- %s\n", answerText)
+			_, _ = fmt.Fprintf(&htmlText, "<li>%s</li>", escapeHTMLText(answerText))
+		}
+	}
+	htmlText.WriteString("</ul>")
+	if results != nil {
+		status := fmt.Sprintf("%d votes", results.Total)
+		if results.Total == 1 {
+			status = "1 vote"
+		}
+		if results.Ended {
+			status = "Poll ended · " + status
+		}
+		_, _ = fmt.Fprintf(&text, "%s\n", status)
+		_, _ = fmt.Fprintf(&htmlText, "<p><em>%s</em></p>", status)
+	}
+	return renderedContent{Text: strings.TrimSpace(text.String()), HTML: htmlText.String()}
+}
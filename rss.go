@@ -1,45 +1,180 @@
 package main
 
 import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/gorilla/feeds"
-	"golang.org/x/net/html"
+)
 
-	"maunium.net/go/mautrix/event"
-	"maunium.net/go/mautrix/id"
-	"maunium.net/go/mautrix/util"
+const (
+	MediaRSSNamespace = "http://search.yahoo.com/mrss/"
+	GeoRSSNamespace   = "http://www.georss.org/georss"
 )
 
-func (fs *FeedServ) generateGorillaFeed(feed *FeedConfig) *feeds.Feed {
-	feedURL := fs.Config.PublicURL + feed.id + ".json"
-	items, _ := util.MapRingBuffer(feed.entries, func(evtID id.EventID, evt *event.Event) (*feeds.Item, error) {
-		content := evt.Content.AsMessage()
+// rssFeedXML is a replacement for feeds.RssFeedXml that supports extension namespaces.
+type rssFeedXML struct {
+	XMLName          xml.Name `xml:"rss"`
+	Version          string   `xml:"version,attr"`
+	ContentNamespace string   `xml:"xmlns:content,attr"`
+	MediaNamespace   string   `xml:"xmlns:media,attr"`
+	ITunesNamespace  string   `xml:"xmlns:itunes,attr,omitempty"`
+	PodcastNamespace string   `xml:"xmlns:podcast,attr,omitempty"`
+	GeoRSSNamespace  string   `xml:"xmlns:georss,attr"`
+	Channel          *rssChannel
+}
+
+type rssChannel struct {
+	*feeds.RssFeed
+	rssChannelExtensions
+	Items []*rssItem `xml:"item"`
+}
+
+type rssExtensions struct {
+	Podcast bool
+	Channel rssChannelExtensions
+	Items   []rssItemExtensions
+}
+
+type rssItem struct {
+	*feeds.RssItem
+	rssItemExtensions
+}
+
+type rssItemExtensions struct {
+	MediaContent   []*mediaRSSContent `xml:"media:content,omitempty"`
+	MediaThumbnail *mediaRSSThumbnail `xml:"media:thumbnail,omitempty"`
+	GeoRSSPoint    string             `xml:"georss:point,omitempty"`
+
+	ITunesDuration    string          `xml:"itunes:duration,omitempty"`
+	ITunesImage       *iTunesImage    `xml:"itunes:image,omitempty"`
+	ITunesEpisode     int             `xml:"itunes:episode,omitempty"`
+	ITunesEpisodeType string          `xml:"itunes:episodeType,omitempty"`
+	ITunesExplicit    string          `xml:"itunes:explicit,omitempty"`
+	PodcastEpisode    *podcastEpisode `xml:"podcast:episode,omitempty"`
+}
+
+type mediaRSSContent struct {
+	URL      string `xml:"url,attr"`
+	Type     string `xml:"type,attr,omitempty"`
+	Medium   string `xml:"medium,attr,omitempty"`
+	FileSize int    `xml:"fileSize,attr,omitempty"`
+	Duration int    `xml:"duration,attr,omitempty"`
+	Width    int    `xml:"width,attr,omitempty"`
+	Height   int    `xml:"height,attr,omitempty"`
+}
+
+type mediaRSSThumbnail struct {
+	URL    string `xml:"url,attr"`
+	Width  int    `xml:"width,attr,omitempty"`
+	Height int    `xml:"height,attr,omitempty"`
+}
+
+func writeRSS(w io.Writer, gorillaFeed *feeds.Feed, language string, extensions *rssExtensions) error {
+	channel := (&feeds.Rss{Feed: gorillaFeed}).RssFeed()
+	channel.Language = language
+	items := make([]*rssItem, len(channel.Items))
+	for i, item := range channel.Items {
+		items[i] = &rssItem{RssItem: item, rssItemExtensions: extensions.Items[i]}
+	}
+	feedXML := &rssFeedXML{
+		Version:          "2.0",
+		ContentNamespace: "http://purl.org/rss/1.0/modules/content/",
+		MediaNamespace:   MediaRSSNamespace,
+		GeoRSSNamespace:  GeoRSSNamespace,
+		Channel: &rssChannel{
+			RssFeed:              channel,
+			rssChannelExtensions: extensions.Channel,
+			Items:                items,
+		},
+	}
+	if extensions.Podcast {
+		feedXML.ITunesNamespace = ITunesNamespace
+		feedXML.PodcastNamespace = PodcastNamespace
+	}
+	return feeds.WriteXML(&rssXMLFeed{feedXML}, w)
+}
+
+type rssXMLFeed struct {
+	feed *rssFeedXML
+}
+
+func (rxf *rssXMLFeed) FeedXml() any {
+	return rxf.feed
+}
+
+func mediaMedium(mimeType string) string {
+	medium, _, _ := strings.Cut(mimeType, "/")
+	switch medium {
+	case "image", "video", "audio":
+		return medium
+	default:
+		return ""
+	}
+}
+
+func (fs *FeedServ) generateGorillaFeed(feed *FeedConfig, feedPath string, entries []feedEntry) (*feeds.Feed, *rssExtensions) {
+	feedURL := fs.Config.PublicURL + feedPath + ".json"
+	items := make([]*feeds.Item, len(entries))
+	extensions := &rssExtensions{Items: make([]rssItemExtensions, len(entries))}
+	for i, evt := range entries {
 		var attachment *feeds.Enclosure
-		if content.URL != "" {
-			attachment = &feeds.Enclosure{
-				Url:  fs.Media.GetDownloadURL(content.URL.ParseOrIgnore()),
-				Type: content.GetInfo().MimeType,
+		for _, entryAttachment := range fs.getEntryAttachments(evt) {
+			media, thumbnail := entryAttachment.Media, entryAttachment.Thumbnail
+			if attachment == nil {
+				attachment = &feeds.Enclosure{
+					Url:    media.URL,
+					Type:   media.MimeType,
+					Length: strconv.Itoa(media.Size),
+				}
+			}
+			extensions.Items[i].MediaContent = append(extensions.Items[i].MediaContent, &mediaRSSContent{
+				URL:      media.URL,
+				Type:     media.MimeType,
+				Medium:   mediaMedium(media.MimeType),
+				FileSize: media.Size,
+				Duration: media.Duration / 1000,
+				Width:    media.Width,
+				Height:   media.Height,
+			})
+			if thumbnail != nil && extensions.Items[i].MediaThumbnail == nil {
+				extensions.Items[i].MediaThumbnail = &mediaRSSThumbnail{
+					URL:    thumbnail.URL,
+					Width:  thumbnail.Width,
+					Height: thumbnail.Height,
+				}
 			}
 		}
-		author := feed.authors[evt.Sender]
-		contentText := content.FormattedBody
-		if contentText == "" {
-			contentText = html.EscapeString(content.Body)
+		rendered := fs.renderContent(evt)
+		contentText := fs.renderEntryHTML(evt, rendered, true)
+		if rendered.Geo != nil {
+			extensions.Items[i].GeoRSSPoint = fmt.Sprintf("%f %f", rendered.Geo.Latitude, rendered.Geo.Longitude)
 		}
 		eventLink := evt.RoomID.EventURI(evt.ID, fs.Config.homeserverDomain).MatrixToURL()
-		return &feeds.Item{
-			Author:      &feeds.Author{Name: author.Name},
+		items[i] = &feeds.Item{
+			Author:      &feeds.Author{Name: evt.author.Name},
 			Link:        &feeds.Link{Href: eventLink},
 			Id:          eventLink,
 			Updated:     evt.Mautrix.EditedAt,
 			Created:     time.UnixMilli(evt.Timestamp).UTC(),
-			Title:       feed.title,
+			Title:       evt.source.title,
 			Content:     contentText,
 			Description: contentText,
 			Enclosure:   attachment,
-		}, nil
-	})
+		}
+		if feed.IsAggregate() && !evt.source.hidden {
+			items[i].Source = &feeds.Link{Href: fs.Config.PublicURL + evt.source.id + ".rss"}
+		}
+	}
+	if feed.Podcast.Enabled {
+		extensions.Podcast = true
+		extensions.Channel = *fs.makePodcastChannelExtensions(feed)
+		fs.addPodcastItemExtensions(feed, entries, extensions.Items)
+	}
 	return &feeds.Feed{
 		Title:       feed.title,
 		Description: feed.description,
@@ -47,5 +182,5 @@ func (fs *FeedServ) generateGorillaFeed(feed *FeedConfig) *feeds.Feed {
 		Items:       items,
 		Image:       &feeds.Image{Url: feed.icon, Link: feedURL, Title: feed.title},
 		Updated:     feed.lastUpdate,
-	}
+	}, extensions
 }
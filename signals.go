@@ -0,0 +1,109 @@
+package main
+
+import (
+	"os"
+	"runtime"
+	"runtime/pprof"
+	"sort"
+	"time"
+)
+
+// Reload re-reads the config file and applies the settings that can be changed without restarting:
+// HTML templates, TLS certificates and rate limits. Other changes require a restart.
+func (fs *FeedServ) Reload() {
+	log := fs.Log.With().Str("action", "reload").Logger()
+	log.Info().Msg("Reloading config")
+	newCfg, err := loadConfig()
+	if err != nil {
+		log.Err(err).Msg("Failed to reload config")
+		return
+	}
+	if fs.certReloader != nil {
+		if err = fs.certReloader.Reload(); err != nil {
+			log.Err(err).Msg("Failed to reload TLS certificate")
+		}
+	}
+	if fs.RateLimiter != nil && newCfg.RateLimit.Enabled {
+		if err = fs.RateLimiter.SetLimits(&newCfg.RateLimit); err != nil {
+			log.Err(err).Msg("Invalid rate limit config")
+		}
+	} else if (fs.RateLimiter != nil) != newCfg.RateLimit.Enabled {
+		log.Warn().Msg("Enabling or disabling rate limiting requires a restart")
+	}
+	for feedID := range newCfg.Feeds {
+		if _, ok := fs.Config.Feeds[feedID]; !ok {
+			log.Warn().Str("feed_id", feedID).Msg("Adding feeds requires a restart")
+		}
+	}
+	for feedID, feed := range fs.Config.Feeds {
+		newFeed, ok := newCfg.Feeds[feedID]
+		if !ok {
+			log.Warn().Str("feed_id", feedID).Msg("Removing feeds requires a restart")
+			continue
+		} else if !feed.HTML {
+			continue
+		}
+		feedLog := log.With().Str("feed_id", feedID).Logger()
+		templatePath := newFeed.HTMLTemplate
+		if templatePath == "" {
+			templatePath = newCfg.HTMLTemplate
+		}
+		tpl, err := fs.loadHTMLTemplate(templatePath)
+		if err != nil {
+			feedLog.Err(err).Msg("Failed to reload HTML template")
+			continue
+		}
+		feed.updateLock.Lock()
+		feed.htmlTemplate = tpl
+		fs.regenerateFeed(feed, feedLog)
+		feed.updateLock.Unlock()
+		if err = fs.purgeCloudflareCache(feed); err != nil {
+			feedLog.Err(err).Msg("Failed to purge Cloudflare cache")
+		}
+	}
+	log.Info().Msg("Config reloaded")
+}
+
+// LogDiagnostics logs the state of feeds and background tasks, and writes the stacks of all goroutines to stderr.
+func (fs *FeedServ) LogDiagnostics() {
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+	evt := fs.Log.Info().
+		Dur("uptime", time.Since(fs.startTime)).
+		Int("goroutines", runtime.NumGoroutine()).
+		Uint64("heap_alloc", mem.HeapAlloc).
+		Uint64("sys", mem.Sys).
+		Uint32("gc_count", mem.NumGC)
+	if fs.ActivityPub != nil {
+		evt = evt.Int("activitypub_queue", len(fs.ActivityPub.deliveries))
+	}
+	if fs.RateLimiter != nil {
+		fs.RateLimiter.lock.Lock()
+		evt = evt.Int("rate_limit_buckets", len(fs.RateLimiter.buckets))
+		fs.RateLimiter.lock.Unlock()
+	}
+	evt.Msg("Diagnostics")
+
+	feedIDs := make([]string, 0, len(fs.Config.Feeds))
+	for feedID := range fs.Config.Feeds {
+		feedIDs = append(feedIDs, feedID)
+	}
+	sort.Strings(feedIDs)
+	for _, feedID := range feedIDs {
+		feed := fs.Config.Feeds[feedID]
+		feed.updateLock.RLock()
+		feedEvt := fs.Log.Info().
+			Str("feed_id", feedID).
+			Str("room_id", feed.RoomID.String()).
+			Time("last_update", feed.lastUpdate).
+			Str("json_hash", feed.jsonHash).
+			Str("stale_reason", feed.staleReason).
+			Int("language_count", len(feed.languageOutputs))
+		if feed.entries != nil {
+			feedEvt = feedEvt.Int("entry_count", feed.entries.Size())
+		}
+		feed.updateLock.RUnlock()
+		feedEvt.Msg("Feed diagnostics")
+	}
+	_ = pprof.Lookup("goroutine").WriteTo(os.Stderr, 1)
+}
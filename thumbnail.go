@@ -0,0 +1,92 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"strconv"
+
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+const (
+	thumbnailWidth  = 800
+	thumbnailHeight = 600
+	thumbnailMethod = "scale"
+)
+
+var thumbnailSize = fmt.Sprintf("%dx%d", thumbnailWidth, thumbnailHeight)
+
+type entryMedia struct {
+	URL      string
+	Title    string
+	MsgType  event.MessageType
+	MimeType string
+	Width    int
+	Height   int
+	Size     int
+	Duration int
+}
+
+// thumbnailURL returns the URL of a server-side thumbnail of the given Matrix content URI.
+func (fs *FeedServ) thumbnailURL(uri id.ContentURI) string {
+	if uri.IsEmpty() {
+		return ""
+	} else if fs.MediaProxy == nil {
+		return fs.Media.BuildURLWithQuery(mautrix.MediaURLPath{"v3", "thumbnail", uri.Homeserver, uri.FileID}, map[string]string{
+			"width":  strconv.Itoa(thumbnailWidth),
+			"height": strconv.Itoa(thumbnailHeight),
+			"method": thumbnailMethod,
+		})
+	}
+	return fs.mediaURL(uri) + "?thumbnail=" + url.QueryEscape(thumbnailSize)
+}
+
+// scaleToThumbnail calculates the dimensions of a server-side thumbnail
+// with the scale method, which keeps the aspect ratio of the original.
+func scaleToThumbnail(width, height int) (int, int) {
+	if width <= 0 || height <= 0 || (width <= thumbnailWidth && height <= thumbnailHeight) {
+		return width, height
+	}
+	if width*thumbnailHeight > height*thumbnailWidth {
+		return thumbnailWidth, height * thumbnailWidth / width
+	}
+	return width * thumbnailHeight / height, thumbnailHeight
+}
+
+// getEntryMedia returns the main media file and the preview thumbnail of a media message.
+// Server-side thumbnails are only used for images, other types need an explicit thumbnail.
+func (fs *FeedServ) getEntryMedia(content *event.MessageEventContent) (media, thumbnail *entryMedia) {
+	if content.URL == "" {
+		return nil, nil
+	}
+	info := content.GetInfo()
+	mediaURI := content.URL.ParseOrIgnore()
+	media = &entryMedia{
+		URL:      fs.mediaURL(mediaURI),
+		Title:    content.FileName,
+		MsgType:  content.MsgType,
+		MimeType: info.MimeType,
+		Width:    info.Width,
+		Height:   info.Height,
+		Size:     info.Size,
+		Duration: info.Duration,
+	}
+	if content.MsgType != event.MsgImage && content.MsgType != event.MsgVideo && content.MsgType != event.MsgAudio {
+		return
+	}
+	if thumbnailURI := info.ThumbnailURL.ParseOrIgnore(); !thumbnailURI.IsEmpty() {
+		thumbnail = &entryMedia{URL: fs.mediaURL(thumbnailURI)}
+		if info.ThumbnailInfo != nil {
+			thumbnail.MimeType = info.ThumbnailInfo.MimeType
+			thumbnail.Width = info.ThumbnailInfo.Width
+			thumbnail.Height = info.ThumbnailInfo.Height
+			thumbnail.Size = info.ThumbnailInfo.Size
+		}
+	} else if content.MsgType == event.MsgImage {
+		thumbnail = &entryMedia{URL: fs.thumbnailURL(mediaURI)}
+		thumbnail.Width, thumbnail.Height = scaleToThumbnail(info.Width, info.Height)
+	}
+	return
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+type TLSConfig struct {
+	// Cert and Key are paths to a PEM certificate chain and private key. They're reloaded automatically when changed.
+	Cert string `yaml:"cert"`
+	Key  string `yaml:"key"`
+
+	ACME ACMEConfig `yaml:"acme"`
+}
+
+type ACMEConfig struct {
+	Enabled      bool   `yaml:"enabled"`
+	Email        string `yaml:"email"`
+	CacheDir     string `yaml:"cache_dir"`
+	DirectoryURL string `yaml:"directory_url"`
+	// DirectoryCA is an optional path to a CA certificate for connecting to the ACME directory,
+	// for testing with a local ACME server like Pebble.
+	DirectoryCA string `yaml:"directory_ca"`
+	// HTTPChallengeAddress is an optional address to listen on for HTTP-01 challenges.
+	// TLS-ALPN-01 challenges are always handled on the main listener.
+	HTTPChallengeAddress string `yaml:"http_challenge_address"`
+}
+
+func (cfg *TLSConfig) IsEnabled() bool {
+	return cfg.ACME.Enabled || cfg.Cert != "" || cfg.Key != ""
+}
+
+// certCheckInterval is how often the certificate files are checked for changes.
+const certCheckInterval = 1 * time.Minute
+
+// certReloader serves a certificate from disk and reloads it when the files are modified.
+type certReloader struct {
+	certPath string
+	keyPath  string
+	log      zerolog.Logger
+
+	cert      *tls.Certificate
+	modTime   time.Time
+	lastCheck time.Time
+	lock      sync.Mutex
+}
+
+func newCertReloader(certPath, keyPath string, log zerolog.Logger) (*certReloader, error) {
+	cr := &certReloader{certPath: certPath, keyPath: keyPath, log: log}
+	if err := cr.reload(); err != nil {
+		return nil, err
+	}
+	return cr, nil
+}
+
+func (cr *certReloader) latestModTime() (time.Time, error) {
+	certStat, err := os.Stat(cr.certPath)
+	if err != nil {
+		return time.Time{}, err
+	}
+	keyStat, err := os.Stat(cr.keyPath)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if keyStat.ModTime().After(certStat.ModTime()) {
+		return keyStat.ModTime(), nil
+	}
+	return certStat.ModTime(), nil
+}
+
+func (cr *certReloader) reload() error {
+	modTime, err := cr.latestModTime()
+	if err != nil {
+		return fmt.Errorf("failed to stat certificate: %w", err)
+	}
+	cert, err := tls.LoadX509KeyPair(cr.certPath, cr.keyPath)
+	if err != nil {
+		return fmt.Errorf("failed to load certificate: %w", err)
+	}
+	cr.cert = &cert
+	cr.modTime = modTime
+	return nil
+}
+
+// Reload loads the certificate from disk immediately.
+func (cr *certReloader) Reload() error {
+	cr.lock.Lock()
+	defer cr.lock.Unlock()
+	cr.lastCheck = time.Now()
+	return cr.reload()
+}
+
+func (cr *certReloader) GetCertificate(_ *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	cr.lock.Lock()
+	defer cr.lock.Unlock()
+	if time.Since(cr.lastCheck) > certCheckInterval {
+		cr.lastCheck = time.Now()
+		if modTime, err := cr.latestModTime(); err != nil {
+			cr.log.Warn().Err(err).Msg("Failed to check certificate for changes")
+		} else if modTime.After(cr.modTime) {
+			if err = cr.reload(); err != nil {
+				// The files may be in the middle of being replaced, so keep using the old certificate and retry later
+				cr.log.Warn().Err(err).Msg("Failed to reload changed certificate")
+			} else {
+				cr.log.Info().Msg("Reloaded TLS certificate")
+			}
+		}
+	}
+	return cr.cert, nil
+}
+
+// makeTLSConfig creates the TLS config for the HTTP server. HTTP/2 is negotiated with ALPN.
+// If ACME is enabled, the returned handler must be served on the HTTP challenge address.
+func (fs *FeedServ) makeTLSConfig(log zerolog.Logger) (*tls.Config, http.Handler, error) {
+	cfg := fs.Config
+	if cfg.TLS.ACME.Enabled {
+		if cfg.TLS.Cert != "" || cfg.TLS.Key != "" {
+			return nil, nil, errors.New("static certificates and ACME can't be used at the same time")
+		}
+		publicURL, err := url.Parse(cfg.PublicURL)
+		if err != nil || publicURL.Hostname() == "" {
+			return nil, nil, fmt.Errorf("public_url must be set to a valid URL for ACME")
+		}
+		manager := &autocert.Manager{
+			Prompt:     autocert.AcceptTOS,
+			HostPolicy: autocert.HostWhitelist(publicURL.Hostname()),
+			Email:      cfg.TLS.ACME.Email,
+		}
+		if cfg.TLS.ACME.CacheDir != "" {
+			manager.Cache = autocert.DirCache(cfg.TLS.ACME.CacheDir)
+		}
+		if cfg.TLS.ACME.DirectoryURL != "" {
+			manager.Client = &acme.Client{DirectoryURL: cfg.TLS.ACME.DirectoryURL}
+			if cfg.TLS.ACME.DirectoryCA != "" {
+				caPEM, err := os.ReadFile(cfg.TLS.ACME.DirectoryCA)
+				if err != nil {
+					return nil, nil, fmt.Errorf("failed to read ACME directory CA: %w", err)
+				}
+				pool := x509.NewCertPool()
+				if !pool.AppendCertsFromPEM(caPEM) {
+					return nil, nil, fmt.Errorf("no certificates found in %s", cfg.TLS.ACME.DirectoryCA)
+				}
+				manager.Client.HTTPClient = &http.Client{
+					Timeout:   30 * time.Second,
+					Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}},
+				}
+			}
+		}
+		return manager.TLSConfig(), manager.HTTPHandler(nil), nil
+	} else if cfg.TLS.Cert == "" || cfg.TLS.Key == "" {
+		return nil, nil, errors.New("both cert and key must be set for static certificates")
+	}
+	var err error
+	fs.certReloader, err = newCertReloader(cfg.TLS.Cert, cfg.TLS.Key, log)
+	if err != nil {
+		return nil, nil, err
+	}
+	return &tls.Config{
+		GetCertificate: fs.certReloader.GetCertificate,
+		NextProtos:     []string{"h2", "http/1.1"},
+		MinVersion:     tls.VersionTLS12,
+	}, nil, nil
+}
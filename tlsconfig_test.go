@@ -0,0 +1,158 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+// writeTestCert writes a self-signed certificate for the given host name and its key to the given paths.
+func writeTestCert(t *testing.T, certPath, keyPath, hostname string, modTime time.Time) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: hostname},
+		DNSNames:     []string{hostname},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	certDER, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = os.WriteFile(certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certDER}), 0600); err != nil {
+		t.Fatal(err)
+	} else if err = os.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		t.Fatal(err)
+	} else if err = os.Chtimes(certPath, modTime, modTime); err != nil {
+		t.Fatal(err)
+	} else if err = os.Chtimes(keyPath, modTime, modTime); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func getCertName(t *testing.T, cr *certReloader) string {
+	cert, err := cr.GetCertificate(&tls.ClientHelloInfo{ServerName: "feeds.example.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return leaf.Subject.CommonName
+}
+
+func TestCertReloaderReloadsReplacedFiles(t *testing.T) {
+	dir := t.TempDir()
+	certPath, keyPath := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	start := time.Now().Add(-time.Hour)
+	writeTestCert(t, certPath, keyPath, "old.example.com", start)
+	cr, err := newCertReloader(certPath, keyPath, zerolog.Nop())
+	if err != nil {
+		t.Fatal(err)
+	} else if name := getCertName(t, cr); name != "old.example.com" {
+		t.Fatalf("unexpected initial certificate %q", name)
+	}
+
+	writeTestCert(t, certPath, keyPath, "new.example.com", start.Add(time.Minute))
+	if name := getCertName(t, cr); name != "old.example.com" {
+		t.Errorf("certificate was reloaded before the check interval passed, got %q", name)
+	}
+	cr.lastCheck = time.Time{}
+	if name := getCertName(t, cr); name != "new.example.com" {
+		t.Errorf("certificate wasn't reloaded after the files were replaced, got %q", name)
+	}
+
+	// A half-written certificate must not replace the working one
+	if err = os.WriteFile(certPath, []byte("not a certificate"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	broken := start.Add(2 * time.Minute)
+	if err = os.Chtimes(certPath, broken, broken); err != nil {
+		t.Fatal(err)
+	}
+	cr.lastCheck = time.Time{}
+	if name := getCertName(t, cr); name != "new.example.com" {
+		t.Errorf("broken certificate replaced the working one, got %q", name)
+	}
+	if err = cr.Reload(); err == nil {
+		t.Error("explicit reload of broken certificate didn't fail")
+	}
+}
+
+func TestMakeTLSConfigStatic(t *testing.T) {
+	dir := t.TempDir()
+	certPath, keyPath := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	writeTestCert(t, certPath, keyPath, "feeds.example.com", time.Now())
+	fs := &FeedServ{Config: &Config{TLS: TLSConfig{Cert: certPath, Key: keyPath}}}
+	tlsConfig, challengeHandler, err := fs.makeTLSConfig(zerolog.Nop())
+	if err != nil {
+		t.Fatal(err)
+	} else if challengeHandler != nil {
+		t.Error("static certificates shouldn't have a challenge handler")
+	} else if len(tlsConfig.NextProtos) == 0 || tlsConfig.NextProtos[0] != "h2" {
+		t.Errorf("HTTP/2 isn't offered: %v", tlsConfig.NextProtos)
+	}
+	fs.Config.TLS.Key = ""
+	if _, _, err = fs.makeTLSConfig(zerolog.Nop()); err == nil {
+		t.Error("cert without key was accepted")
+	}
+}
+
+// TestMakeTLSConfigACME requests a certificate from a Pebble test server. It's skipped unless PEBBLE_DIRECTORY
+// is set to the directory URL and PEBBLE_CA_CERT to Pebble's CA certificate. Pebble must be started with
+// PEBBLE_VA_ALWAYS_VALID=1, as the challenges can't be reached from it.
+func TestMakeTLSConfigACME(t *testing.T) {
+	directoryURL, caPath := os.Getenv("PEBBLE_DIRECTORY"), os.Getenv("PEBBLE_CA_CERT")
+	if directoryURL == "" || caPath == "" {
+		t.Skip("PEBBLE_DIRECTORY and PEBBLE_CA_CERT aren't set")
+	}
+	fs := &FeedServ{Config: &Config{
+		PublicURL: "https://feeds.example.com",
+		TLS: TLSConfig{ACME: ACMEConfig{
+			Enabled:      true,
+			Email:        "admin@example.com",
+			CacheDir:     t.TempDir(),
+			DirectoryURL: directoryURL,
+			DirectoryCA:  caPath,
+		}},
+	}}
+	tlsConfig, challengeHandler, err := fs.makeTLSConfig(zerolog.Nop())
+	if err != nil {
+		t.Fatal(err)
+	} else if challengeHandler == nil {
+		t.Error("ACME should have a challenge handler")
+	}
+	cert, err := tlsConfig.GetCertificate(&tls.ClientHelloInfo{ServerName: "feeds.example.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	} else if err = leaf.VerifyHostname("feeds.example.com"); err != nil {
+		t.Error(err)
+	}
+	if _, err = tlsConfig.GetCertificate(&tls.ClientHelloInfo{ServerName: "other.example.com"}); err == nil {
+		t.Error("certificate was issued for a host other than the public URL")
+	}
+}
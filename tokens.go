@@ -0,0 +1,459 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+const (
+	tokensAccountDataType = "com.beeper.feedserv.feed_tokens"
+	adminTokensPath       = "/_feedserv/admin/tokens"
+
+	commandPrefix = "!feedserv"
+	// commandReplyField marks messages sent by the bot in response to commands, so that they're not added to feeds.
+	commandReplyField = "com.beeper.feedserv.command_reply"
+
+	// feedTokenIDLength is the number of hex characters of the token hash that are used as the public token ID.
+	feedTokenIDLength = 16
+)
+
+type feedToken struct {
+	Feeds     []string  `json:"feeds"`
+	Label     string    `json:"label,omitempty"`
+	CreatedBy id.UserID `json:"created_by,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+	// Member tokens are personal tokens of room members, which only work while the creator is in the room.
+	Member bool `json:"member,omitempty"`
+}
+
+type feedTokenStore struct {
+	// Tokens is keyed by the hex-encoded SHA-256 hash of the token. The tokens themselves are never stored.
+	Tokens map[string]*feedToken `json:"tokens"`
+}
+
+type FeedTokenInfo struct {
+	ID string `json:"id"`
+	*feedToken
+}
+
+// FeedTokens manages the secret tokens used to access private feeds.
+type FeedTokens struct {
+	fs  *FeedServ
+	Log zerolog.Logger
+
+	store    feedTokenStore
+	lock     sync.RWMutex
+	saveLock sync.Mutex
+	dmLock   sync.Mutex
+}
+
+func NewFeedTokens(fs *FeedServ, log zerolog.Logger) (*FeedTokens, error) {
+	ft := &FeedTokens{fs: fs, Log: log}
+	err := fs.Client.GetAccountData(tokensAccountDataType, &ft.store)
+	if err != nil && !errors.Is(err, mautrix.MNotFound) {
+		return nil, fmt.Errorf("failed to load feed tokens: %w", err)
+	}
+	if ft.store.Tokens == nil {
+		ft.store.Tokens = make(map[string]*feedToken)
+	}
+	return ft, nil
+}
+
+func hashFeedToken(token string) string {
+	hash := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(hash[:])
+}
+
+// Issue creates a new token that can access the given feeds. The token is only returned once, as only its hash is stored.
+func (ft *FeedTokens) Issue(feedIDs []string, label string, createdBy id.UserID) (token string, info FeedTokenInfo, err error) {
+	return ft.issue(feedIDs, label, createdBy, false)
+}
+
+// IssueMember creates a personal token for a member of the room of the feed, replacing any previous
+// personal token of the user. The token stops working when the user leaves the room.
+func (ft *FeedTokens) IssueMember(feed *FeedConfig, userID id.UserID) (token string, info FeedTokenInfo, err error) {
+	ft.RevokeMember(feed, userID)
+	return ft.issue([]string{feed.id}, "Personal token of "+userID.String(), userID, true)
+}
+
+func (ft *FeedTokens) issue(feedIDs []string, label string, createdBy id.UserID, member bool) (token string, info FeedTokenInfo, err error) {
+	for _, feedID := range feedIDs {
+		if feed, ok := ft.fs.Config.Feeds[feedID]; !ok || !feed.Private {
+			return "", info, fmt.Errorf("%q is not a private feed", feedID)
+		}
+	}
+	if len(feedIDs) == 0 {
+		return "", info, fmt.Errorf("no feeds specified")
+	}
+	data := make([]byte, 32)
+	_, _ = rand.Read(data)
+	token = "fst_" + base64.RawURLEncoding.EncodeToString(data)
+	hash := hashFeedToken(token)
+	info = FeedTokenInfo{
+		ID: hash[:feedTokenIDLength],
+		feedToken: &feedToken{
+			Feeds:     feedIDs,
+			Label:     label,
+			CreatedBy: createdBy,
+			CreatedAt: time.Now().UTC(),
+			Member:    member,
+		},
+	}
+	ft.lock.Lock()
+	ft.store.Tokens[hash] = info.feedToken
+	ft.lock.Unlock()
+	if err = ft.save(); err != nil {
+		ft.lock.Lock()
+		delete(ft.store.Tokens, hash)
+		ft.lock.Unlock()
+		return "", info, err
+	}
+	ft.Log.Info().
+		Str("token_id", info.ID).
+		Strs("feed_ids", feedIDs).
+		Str("created_by", createdBy.String()).
+		Msg("Issued feed token")
+	return token, info, nil
+}
+
+// Revoke deletes the token with the given ID. If feedID is set, the token is only revoked if it can access that feed.
+func (ft *FeedTokens) Revoke(tokenID, feedID string) (bool, error) {
+	ft.lock.Lock()
+	var revokedHash string
+	var revoked *feedToken
+	for hash, token := range ft.store.Tokens {
+		if hash[:feedTokenIDLength] == tokenID && (feedID == "" || contains(token.Feeds, feedID)) {
+			revokedHash, revoked = hash, token
+			delete(ft.store.Tokens, hash)
+			break
+		}
+	}
+	ft.lock.Unlock()
+	if revoked == nil {
+		return false, nil
+	} else if err := ft.save(); err != nil {
+		ft.lock.Lock()
+		ft.store.Tokens[revokedHash] = revoked
+		ft.lock.Unlock()
+		return false, err
+	}
+	ft.Log.Info().Str("token_id", tokenID).Msg("Revoked feed token")
+	return true, nil
+}
+
+// RevokeMember deletes the personal tokens that the given user has for the feed.
+func (ft *FeedTokens) RevokeMember(feed *FeedConfig, userID id.UserID) {
+	ft.lock.Lock()
+	revoked := 0
+	for hash, token := range ft.store.Tokens {
+		if token.Member && token.CreatedBy == userID && contains(token.Feeds, feed.id) {
+			delete(ft.store.Tokens, hash)
+			revoked++
+		}
+	}
+	ft.lock.Unlock()
+	if revoked == 0 {
+		return
+	} else if err := ft.save(); err != nil {
+		// The tokens are still rejected while the user isn't a member, so this isn't critical
+		ft.Log.Err(err).Str("feed_id", feed.id).Str("user_id", userID.String()).Msg("Failed to save revoked member tokens")
+	} else {
+		ft.Log.Info().
+			Str("feed_id", feed.id).
+			Str("user_id", userID.String()).
+			Int("token_count", revoked).
+			Msg("Revoked personal tokens of user who left room")
+	}
+}
+
+// List returns the tokens that can access the given feed, or all tokens if feedID is empty.
+func (ft *FeedTokens) List(feedID string) []FeedTokenInfo {
+	ft.lock.RLock()
+	tokens := make([]FeedTokenInfo, 0, len(ft.store.Tokens))
+	for hash, token := range ft.store.Tokens {
+		if feedID == "" || contains(token.Feeds, feedID) {
+			tokens = append(tokens, FeedTokenInfo{ID: hash[:feedTokenIDLength], feedToken: token})
+		}
+	}
+	ft.lock.RUnlock()
+	sort.Slice(tokens, func(i, j int) bool {
+		return tokens[i].CreatedAt.Before(tokens[j].CreatedAt)
+	})
+	return tokens
+}
+
+// Check returns true if the given token can access the feed.
+func (ft *FeedTokens) Check(feed *FeedConfig, token string) bool {
+	if token == "" {
+		return false
+	}
+	ft.lock.RLock()
+	info, ok := ft.store.Tokens[hashFeedToken(token)]
+	ft.lock.RUnlock()
+	if !ok || !contains(info.Feeds, feed.id) {
+		return false
+	} else if info.Member {
+		feed.updateLock.RLock()
+		_, isMember := feed.members[info.CreatedBy]
+		feed.updateLock.RUnlock()
+		return isMember
+	}
+	return true
+}
+
+// save stores the current tokens in account data. The lock must not be held, so that checking tokens
+// doesn't wait for the homeserver. Saves are serialized, so the last save always has the latest tokens.
+func (ft *FeedTokens) save() error {
+	ft.saveLock.Lock()
+	defer ft.saveLock.Unlock()
+	ft.lock.RLock()
+	store := feedTokenStore{Tokens: make(map[string]*feedToken, len(ft.store.Tokens))}
+	for hash, token := range ft.store.Tokens {
+		store.Tokens[hash] = token
+	}
+	ft.lock.RUnlock()
+	return ft.fs.Client.SetAccountData(tokensAccountDataType, &store)
+}
+
+// getDMRoom returns a direct chat with the given user, creating one if there's no existing chat the user is in.
+// Direct chats are tracked in the standard m.direct account data, so clients show them as direct chats too.
+func (ft *FeedTokens) getDMRoom(userID id.UserID) (id.RoomID, error) {
+	ft.dmLock.Lock()
+	defer ft.dmLock.Unlock()
+	direct := make(map[id.UserID][]id.RoomID)
+	err := ft.fs.Client.GetAccountData(event.AccountDataDirectChats.Type, &direct)
+	if err != nil && !errors.Is(err, mautrix.MNotFound) {
+		return "", fmt.Errorf("failed to get direct chats: %w", err)
+	}
+	rooms := direct[userID]
+	for i := len(rooms) - 1; i >= 0; i-- {
+		var member event.MemberEventContent
+		err = ft.fs.Client.StateEvent(rooms[i], event.StateMember, userID.String(), &member)
+		if err == nil && (member.Membership == event.MembershipJoin || member.Membership == event.MembershipInvite) {
+			return rooms[i], nil
+		}
+	}
+	resp, err := ft.fs.Client.CreateRoom(&mautrix.ReqCreateRoom{
+		Preset:   "trusted_private_chat",
+		Invite:   []id.UserID{userID},
+		IsDirect: true,
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to create direct chat: %w", err)
+	}
+	direct[userID] = append(rooms, resp.RoomID)
+	if err = ft.fs.Client.SetAccountData(event.AccountDataDirectChats.Type, direct); err != nil {
+		ft.Log.Warn().Err(err).Str("user_id", userID.String()).Msg("Failed to save direct chat")
+	}
+	return resp.RoomID, nil
+}
+
+// sendTokenDM sends a newly issued token to the user who requested it in a direct chat, so that other room members can't see it.
+func (ft *FeedTokens) sendTokenDM(userID id.UserID, feed *FeedConfig, token string, info FeedTokenInfo) error {
+	roomID, err := ft.getDMRoom(userID)
+	if err != nil {
+		return err
+	}
+	_, err = ft.fs.Client.SendMessageEvent(roomID, event.EventMessage, &event.MessageEventContent{
+		MsgType: event.MsgNotice,
+		Body:    fmt.Sprintf("Issued token %s for %s: %s\n\nFeed URL: %s%s?token=%s", info.ID, feed.id, token, ft.fs.Config.PublicURL, feed.id, token),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to send token: %w", err)
+	}
+	return nil
+}
+
+// getRequestToken finds the feed token from the token query parameter, a bearer token,
+// or the password of basic auth (the username is ignored, as most feed readers require one).
+func getRequestToken(r *http.Request) string {
+	if token := r.URL.Query().Get("token"); token != "" {
+		return token
+	} else if _, password, ok := r.BasicAuth(); ok {
+		return password
+	} else if authType, token, ok := strings.Cut(r.Header.Get("Authorization"), " "); ok && strings.EqualFold(authType, "Bearer") {
+		return token
+	}
+	return ""
+}
+
+// authorizeFeed checks that the request has access to the feed. Public feeds are always accessible.
+// If access is denied, an error response is written and false is returned.
+func (fs *FeedServ) authorizeFeed(w http.ResponseWriter, r *http.Request, feed *FeedConfig) bool {
+	if !feed.Private || fs.Tokens.Check(feed, getRequestToken(r)) {
+		return true
+	}
+	w.Header().Add("WWW-Authenticate", `Basic realm="feedserv", charset="UTF-8"`)
+	writeError(w, http.StatusUnauthorized, "A valid token is required to access feed %q", feed.id)
+	return false
+}
+
+type reqIssueToken struct {
+	Feeds []string `json:"feeds"`
+	Label string   `json:"label"`
+}
+
+type respIssueToken struct {
+	Token string `json:"token"`
+	FeedTokenInfo
+}
+
+// ServeAdmin handles the token management API, which is authenticated with the admin_token from the config.
+func (ft *FeedTokens) ServeAdmin(w http.ResponseWriter, r *http.Request) {
+	_, token, _ := strings.Cut(r.Header.Get("Authorization"), " ")
+	adminToken := ft.fs.Config.AdminToken
+	if adminToken == "" {
+		writeError(w, http.StatusNotFound, "Admin API is not enabled")
+		return
+	} else if subtle.ConstantTimeCompare([]byte(token), []byte(adminToken)) != 1 {
+		writeError(w, http.StatusUnauthorized, "Invalid admin token")
+		return
+	}
+	tokenID := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, adminTokensPath), "/")
+	w.Header().Set("Cache-Control", "no-store")
+	switch {
+	case tokenID == "" && r.Method == http.MethodGet:
+		writeJSON(w, http.StatusOK, map[string]any{"tokens": ft.List(r.URL.Query().Get("feed"))})
+	case tokenID == "" && r.Method == http.MethodPost:
+		var req reqIssueToken
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeError(w, http.StatusBadRequest, "Invalid request body: %v", err)
+			return
+		}
+		newToken, info, err := ft.Issue(req.Feeds, req.Label, "")
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "Failed to issue token: %v", err)
+			return
+		}
+		writeJSON(w, http.StatusCreated, &respIssueToken{Token: newToken, FeedTokenInfo: info})
+	case tokenID != "" && r.Method == http.MethodDelete:
+		if found, err := ft.Revoke(tokenID, ""); err != nil {
+			writeError(w, http.StatusInternalServerError, "Failed to revoke token: %v", err)
+		} else if !found {
+			writeError(w, http.StatusNotFound, "Token %q not found", tokenID)
+		} else {
+			w.WriteHeader(http.StatusNoContent)
+		}
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "Unsupported method %q", r.Method)
+	}
+}
+
+// isCommandReply returns true for the bot's replies to commands, which are never added to feeds.
+func isCommandReply(evt *event.Event) bool {
+	isReply, _ := evt.Content.Raw[commandReplyField].(bool)
+	return evt.Type == event.EventMessage && isReply
+}
+
+// isCommandEvent returns true for messages that look like bot commands.
+func isCommandEvent(evt *event.Event) bool {
+	if evt.Type != event.EventMessage {
+		return false
+	}
+	body := evt.Content.AsMessage().Body
+	return body == commandPrefix || strings.HasPrefix(body, commandPrefix+" ")
+}
+
+// commandFeed returns the private feed whose tokens are managed with commands in the given room, or nil if there's none.
+func (ft *FeedTokens) commandFeed(roomID id.RoomID) *FeedConfig {
+	for _, roomFeed := range ft.fs.Config.feedsByRoomID[roomID] {
+		if roomFeed.Private && !roomFeed.hidden {
+			return roomFeed
+		}
+	}
+	return nil
+}
+
+// isTokenCommand returns true if the event is a command that's handled by the token management instead of being
+// added to feeds. Messages that look like commands are normal messages in rooms without a private feed.
+func (fs *FeedServ) isTokenCommand(evt *event.Event) bool {
+	return fs.Tokens != nil && isCommandEvent(evt) && fs.Tokens.commandFeed(evt.RoomID) != nil
+}
+
+// HandleCommand handles token management commands sent in the rooms of private feeds.
+// Room admins (users who can change power levels) can issue, list and revoke tokens.
+func (ft *FeedTokens) HandleCommand(evt *event.Event) {
+	feed := ft.commandFeed(evt.RoomID)
+	if feed == nil || evt.Sender == ft.fs.Client.UserID {
+		return
+	}
+	log := ft.Log.With().
+		Str("room_id", evt.RoomID.String()).
+		Str("sender", evt.Sender.String()).
+		Str("event_id", evt.ID.String()).
+		Logger()
+	feed.updateLock.RLock()
+	isAdmin := feed.powers.GetUserLevel(evt.Sender) >= feed.powers.GetEventLevel(event.StatePowerLevels)
+	feed.updateLock.RUnlock()
+	if !isAdmin {
+		log.Debug().Msg("Ignoring command from non-admin")
+		return
+	}
+	args := strings.Fields(evt.Content.AsMessage().Body)[1:]
+	var reply string
+	switch {
+	case len(args) >= 2 && args[0] == "token" && args[1] == "issue":
+		label := strings.Join(args[2:], " ")
+		token, info, err := ft.Issue([]string{feed.id}, label, evt.Sender)
+		if err != nil {
+			log.Err(err).Msg("Failed to issue token")
+			reply = fmt.Sprintf("Failed to issue token: %v", err)
+		} else if err = ft.sendTokenDM(evt.Sender, feed, token, info); err != nil {
+			log.Err(err).Msg("Failed to send token in direct chat")
+			// Nobody has seen the token, so it's revoked rather than left unused
+			if _, revokeErr := ft.Revoke(info.ID, feed.id); revokeErr != nil {
+				log.Err(revokeErr).Msg("Failed to revoke unsent token")
+			}
+			reply = fmt.Sprintf("Failed to send token in a direct chat: %v", err)
+		} else {
+			reply = fmt.Sprintf("Issued token %s for %s, sent it to %s in a direct chat", info.ID, feed.id, evt.Sender)
+		}
+	case len(args) == 3 && args[0] == "token" && args[1] == "revoke":
+		found, err := ft.Revoke(args[2], feed.id)
+		if err != nil {
+			log.Err(err).Msg("Failed to revoke token")
+			reply = fmt.Sprintf("Failed to revoke token: %v", err)
+		} else if !found {
+			reply = fmt.Sprintf("Token %s not found", args[2])
+		} else {
+			reply = fmt.Sprintf("Revoked token %s", args[2])
+		}
+	case len(args) == 2 && args[0] == "token" && args[1] == "list":
+		tokens := ft.List(feed.id)
+		lines := make([]string, len(tokens))
+		for i, token := range tokens {
+			lines[i] = fmt.Sprintf("* %s %s (created by %s at %s)", token.ID, token.Label, token.CreatedBy, token.CreatedAt.Format(time.RFC3339))
+		}
+		reply = fmt.Sprintf("%d tokens for %s:\n%s", len(tokens), feed.id, strings.Join(lines, "\n"))
+	default:
+		reply = "Usage: `!feedserv token issue [label]`, `!feedserv token list` or `!feedserv token revoke <id>`"
+	}
+	_, err := ft.fs.Client.SendMessageEvent(evt.RoomID, event.EventMessage, &event.Content{
+		Parsed: &event.MessageEventContent{
+			MsgType:   event.MsgNotice,
+			Body:      reply,
+			RelatesTo: (&event.RelatesTo{}).SetReplyTo(evt.ID),
+		},
+		Raw: map[string]any{commandReplyField: true},
+	})
+	if err != nil {
+		log.Err(err).Msg("Failed to send command reply")
+	}
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// fakeTokenServer is a fake homeserver for the endpoints used when issuing tokens.
+type fakeTokenServer struct {
+	t           *testing.T
+	lock        sync.Mutex
+	accountData map[string]json.RawMessage
+	sent        map[id.RoomID][]string
+	// saveBlock makes saving the feed tokens wait until it's closed.
+	saveBlock chan struct{}
+}
+
+func (fts *fakeTokenServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if strings.Contains(r.URL.Path, "/account_data/"+tokensAccountDataType) && r.Method == http.MethodPut && fts.saveBlock != nil {
+		<-fts.saveBlock
+	}
+	fts.lock.Lock()
+	defer fts.lock.Unlock()
+	path := r.URL.Path
+	switch {
+	case strings.Contains(path, "/account_data/"):
+		dataType := path[strings.LastIndex(path, "/")+1:]
+		if r.Method == http.MethodPut {
+			var data json.RawMessage
+			_ = json.NewDecoder(r.Body).Decode(&data)
+			fts.accountData[dataType] = data
+			_, _ = w.Write([]byte(`{}`))
+		} else if data, ok := fts.accountData[dataType]; ok {
+			_, _ = w.Write(data)
+		} else {
+			w.WriteHeader(http.StatusNotFound)
+			_, _ = w.Write([]byte(`{"errcode":"M_NOT_FOUND","error":"Not found"}`))
+		}
+	case strings.HasSuffix(path, "/createRoom"):
+		_, _ = w.Write([]byte(`{"room_id":"!dm:example.com"}`))
+	case strings.Contains(path, "/send/m.room.message/"):
+		roomID := id.RoomID(strings.Split(path, "/")[5])
+		var content event.MessageEventContent
+		_ = json.NewDecoder(r.Body).Decode(&content)
+		fts.sent[roomID] = append(fts.sent[roomID], content.Body)
+		_, _ = w.Write([]byte(`{"event_id":"$reply"}`))
+	default:
+		fts.t.Errorf("unexpected request to %s %s", r.Method, path)
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func makeTestTokens(t *testing.T) (*FeedTokens, *fakeTokenServer, *FeedConfig) {
+	fts := &fakeTokenServer{t: t, accountData: make(map[string]json.RawMessage), sent: make(map[id.RoomID][]string)}
+	server := httptest.NewServer(fts)
+	t.Cleanup(server.Close)
+	cli, err := mautrix.NewClient(server.URL, "@feedserv:example.com", "token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	feed := makeTestFeed("/private", "!room:example.com")
+	feed.Private = true
+	feed.powers = &event.PowerLevelsEventContent{Users: map[id.UserID]int{"@admin:example.com": 100}}
+	log := zerolog.Nop()
+	fs := &FeedServ{Log: &log, Client: cli, Config: &Config{
+		PublicURL:     "https://example.com",
+		Feeds:         map[string]*FeedConfig{"/private": feed},
+		feedsByRoomID: map[id.RoomID][]*FeedConfig{feed.RoomID: {feed}},
+	}}
+	ft, err := NewFeedTokens(fs, log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fs.Tokens = ft
+	return ft, fts, feed
+}
+
+func TestIssueCommandSendsTokenInDirectChat(t *testing.T) {
+	ft, fts, feed := makeTestTokens(t)
+	ft.HandleCommand(makeTestMessage(feed.RoomID, "$command", "@admin:example.com", &event.MessageEventContent{
+		MsgType: event.MsgText,
+		Body:    "!feedserv token issue Reader",
+	}))
+
+	tokens := ft.List(feed.id)
+	if len(tokens) != 1 {
+		t.Fatalf("expected 1 token, got %d", len(tokens))
+	}
+	roomReplies, dms := fts.sent[feed.RoomID], fts.sent["!dm:example.com"]
+	if len(roomReplies) != 1 || len(dms) != 1 {
+		t.Fatalf("expected one reply in the room and one direct message, got %q and %q", roomReplies, dms)
+	} else if strings.Contains(roomReplies[0], "fst_") || strings.Contains(roomReplies[0], "token=") {
+		t.Errorf("room reply contains the token: %q", roomReplies[0])
+	} else if !strings.Contains(roomReplies[0], tokens[0].ID) {
+		t.Errorf("room reply doesn't mention the token ID: %q", roomReplies[0])
+	} else if !strings.Contains(dms[0], "?token=fst_") {
+		t.Errorf("direct message doesn't contain the token: %q", dms[0])
+	}
+	var direct map[id.UserID][]id.RoomID
+	if err := json.Unmarshal(fts.accountData[event.AccountDataDirectChats.Type], &direct); err != nil {
+		t.Fatal(err)
+	} else if rooms := direct["@admin:example.com"]; len(rooms) != 1 || rooms[0] != "!dm:example.com" {
+		t.Errorf("direct chat wasn't saved in m.direct: %v", direct)
+	}
+}
+
+func TestCheckDoesntWaitForSave(t *testing.T) {
+	ft, fts, feed := makeTestTokens(t)
+	token, _, err := ft.Issue([]string{feed.id}, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fts.saveBlock = make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		_, _, _ = ft.Issue([]string{feed.id}, "", "")
+		close(done)
+	}()
+
+	checked := make(chan bool)
+	go func() {
+		checked <- ft.Check(feed, token)
+	}()
+	select {
+	case ok := <-checked:
+		if !ok {
+			t.Error("valid token was rejected")
+		}
+	case <-time.After(2 * time.Second):
+		t.Error("checking a token waited for the tokens to be saved")
+	}
+	close(fts.saveBlock)
+	<-done
+}
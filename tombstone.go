@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/rs/zerolog"
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+const roomUpgradesAccountDataType = "com.beeper.feedserv.room_upgrades"
+
+// roomUpgradeStore maps tombstoned room IDs to their replacement rooms, so that
+// feeds configured with an old room ID continue in the new room after restarting.
+type roomUpgradeStore struct {
+	Rooms map[id.RoomID]id.RoomID `json:"rooms"`
+}
+
+func (fs *FeedServ) loadRoomUpgrades() error {
+	err := fs.Client.GetAccountData(roomUpgradesAccountDataType, &fs.roomUpgrades)
+	if err != nil && !errors.Is(err, mautrix.MNotFound) {
+		return fmt.Errorf("failed to load room upgrades: %w", err)
+	}
+	if fs.roomUpgrades.Rooms == nil {
+		fs.roomUpgrades.Rooms = make(map[id.RoomID]id.RoomID)
+	}
+	return nil
+}
+
+// followRoomUpgrades returns the latest replacement of the given room,
+// along with the rooms that were replaced on the way, newest first.
+func (fs *FeedServ) followRoomUpgrades(roomID id.RoomID) (id.RoomID, []id.RoomID) {
+	var previous []id.RoomID
+	seen := map[id.RoomID]struct{}{roomID: {}}
+	for {
+		next, ok := fs.roomUpgrades.Rooms[roomID]
+		if _, alreadySeen := seen[next]; !ok || alreadySeen {
+			return roomID, previous
+		}
+		seen[next] = struct{}{}
+		previous = append([]id.RoomID{roomID}, previous...)
+		roomID = next
+	}
+}
+
+// HandleTombstone moves the feeds of an upgraded room to the replacement room. Existing entries are kept,
+// and the replacement is saved so that the old room's history is still loaded after restarting.
+func (fs *FeedServ) HandleTombstone(_ mautrix.EventSource, evt *event.Event) {
+	feeds := fs.Config.feedsByRoomID[evt.RoomID]
+	newRoomID := evt.Content.AsTombstone().ReplacementRoom
+	if evt.GetStateKey() != "" || len(feeds) == 0 || newRoomID == "" || newRoomID == evt.RoomID {
+		return
+	}
+	log := fs.Log.With().
+		Str("room_id", evt.RoomID.String()).
+		Str("replacement_room_id", newRoomID.String()).
+		Str("sender", evt.Sender.String()).
+		Str("event_id", evt.ID.String()).
+		Str("action", "room upgrade").
+		Logger()
+	log.Info().Msg("Feed room was upgraded, moving feeds to the replacement room")
+
+	delete(fs.Config.feedsByRoomID, evt.RoomID)
+	fs.Config.feedsByRoomID[newRoomID] = append(fs.Config.feedsByRoomID[newRoomID], feeds...)
+	for _, feed := range feeds {
+		feed.updateLock.Lock()
+		feed.previousRooms = append([]id.RoomID{feed.RoomID}, feed.previousRooms...)
+		feed.RoomID = newRoomID
+		feed.updateLock.Unlock()
+	}
+	fs.roomUpgrades.Rooms[evt.RoomID] = newRoomID
+	if err := fs.Client.SetAccountData(roomUpgradesAccountDataType, &fs.roomUpgrades); err != nil {
+		log.Err(err).Msg("Failed to save room upgrade")
+	}
+	fs.updateSyncFilter()
+
+	_, err := fs.Client.JoinRoom(newRoomID.String(), evt.Sender.Homeserver(), nil)
+	if err != nil {
+		log.Warn().Err(err).Msg("Failed to join replacement room, waiting for an invite")
+		return
+	}
+	log.Debug().Msg("Joined replacement room")
+	fs.refreshRoomState(newRoomID, log)
+}
+
+// refreshRoomState reloads the metadata, power levels and members of the feeds in the given room.
+func (fs *FeedServ) refreshRoomState(roomID id.RoomID, log zerolog.Logger) {
+	state, err := fs.Client.State(roomID)
+	if err != nil {
+		log.Err(err).Msg("Failed to fetch room state")
+		return
+	}
+	for _, feed := range fs.Config.feedsByRoomID[roomID] {
+		feedLog := log.With().Str("feed_id", feed.id).Logger()
+		feed.updateLock.Lock()
+		fs.applyRoomState(feed, state)
+		fs.regenerateFeed(feed, feedLog)
+		if fs.ActivityPub != nil {
+			fs.ActivityPub.QueueActorUpdate(feed)
+		}
+		feed.updateLock.Unlock()
+		fs.regenerateAggregates(feed, feedLog)
+	}
+}
+
+// syncFilterRooms returns the rooms that are included in the sync: the feed rooms and the rooms that external feeds are ingested into.
+func (fs *FeedServ) syncFilterRooms() []id.RoomID {
+	rooms := make([]id.RoomID, 0, len(fs.Config.feedsByRoomID))
+	for roomID := range fs.Config.feedsByRoomID {
+		rooms = append(rooms, roomID)
+	}
+	if fs.Ingester != nil {
+		for _, source := range fs.Ingester.Config {
+			if _, isFeedRoom := fs.Config.feedsByRoomID[source.RoomID]; !isFeedRoom && !contains(rooms, source.RoomID) {
+				rooms = append(rooms, source.RoomID)
+			}
+		}
+	}
+	return rooms
+}
+
+// updateSyncFilter sets the rooms of the sync filter to the current feed rooms and restarts the sync to apply it.
+// This must only be called from the sync goroutine.
+func (fs *FeedServ) updateSyncFilter() {
+	fs.Client.Syncer.(*mautrix.DefaultSyncer).FilterJSON.Room.Rooms = fs.syncFilterRooms()
+	if fs.restartSync != nil {
+		fs.restartSync()
+	}
+}
+
+// runSync syncs until the context is cancelled. If the sync filter changes, the sync is restarted with a new filter.
+// The response being processed when the restart is requested is still handled normally, so no events are lost.
+func (fs *FeedServ) runSync(ctx context.Context) error {
+	for {
+		syncCtx, cancel := context.WithCancel(ctx)
+		fs.restartSync = cancel
+		err := fs.Client.SyncWithContext(syncCtx)
+		cancel()
+		if ctx.Err() != nil || !errors.Is(err, context.Canceled) {
+			return err
+		}
+		fs.Log.Debug().Msg("Restarting sync with new filter")
+		fs.Client.Store.SaveFilterID(fs.Client.UserID, "")
+	}
+}
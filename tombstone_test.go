@@ -0,0 +1,34 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"maunium.net/go/mautrix/id"
+)
+
+func TestFollowRoomUpgrades(t *testing.T) {
+	fs := &FeedServ{roomUpgrades: roomUpgradeStore{Rooms: map[id.RoomID]id.RoomID{
+		"!v1:example.com":    "!v2:example.com",
+		"!v2:example.com":    "!v3:example.com",
+		"!loop1:example.com": "!loop2:example.com",
+		"!loop2:example.com": "!loop1:example.com",
+	}}}
+	tests := []struct {
+		roomID           id.RoomID
+		expected         id.RoomID
+		expectedPrevious []id.RoomID
+	}{
+		{"!v1:example.com", "!v3:example.com", []id.RoomID{"!v2:example.com", "!v1:example.com"}},
+		{"!v2:example.com", "!v3:example.com", []id.RoomID{"!v2:example.com"}},
+		{"!v3:example.com", "!v3:example.com", nil},
+		{"!other:example.com", "!other:example.com", nil},
+		{"!loop1:example.com", "!loop2:example.com", []id.RoomID{"!loop1:example.com"}},
+	}
+	for _, test := range tests {
+		latest, previous := fs.followRoomUpgrades(test.roomID)
+		if latest != test.expected || !reflect.DeepEqual(previous, test.expectedPrevious) {
+			t.Errorf("followRoomUpgrades(%s) = %s, %v; expected %s, %v", test.roomID, latest, previous, test.expected, test.expectedPrevious)
+		}
+	}
+}
@@ -12,6 +12,7 @@ import (
 	"github.com/rs/zerolog/log"
 	"maunium.net/go/mautrix"
 	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
 )
 
 func (fs *FeedServ) HandleFeedEvent(_ mautrix.EventSource, evt *event.Event) {
@@ -21,39 +22,91 @@ func (fs *FeedServ) HandleFeedEvent(_ mautrix.EventSource, evt *event.Event) {
 		Str("room_id", evt.RoomID.String()).
 		Str("action", "new message").
 		Logger()
-	feed, ok := fs.Config.feedsByRoomID[evt.RoomID]
+	feeds, ok := fs.Config.feedsByRoomID[evt.RoomID]
 	if !ok {
 		log.Debug().Msg("Dropping event in feed without room")
 		return
+	} else if isCommandReply(evt) {
+		return
+	} else if fs.isTokenCommand(evt) {
+		fs.Tokens.HandleCommand(evt)
+		return
 	}
-	log = log.With().Str("feed_id", feed.id).Logger()
-	log.Debug().Msg("Received new event in feed room")
+	for _, feed := range feeds {
+		// Edits and redactions modify the stored event, so each feed needs its own copy
+		evtCopy := *evt
+		fs.addFeedEvent(feed, log.With().Str("feed_id", feed.id).Logger(), &evtCopy)
+	}
+}
 
+func (fs *FeedServ) addFeedEvent(feed *FeedConfig, log zerolog.Logger, evt *event.Event) {
 	feed.updateLock.Lock()
-	defer feed.updateLock.Unlock()
-
-	feed.pushEvent(log, evt)
-
+	if !feed.Filter.Matches(feed, evt) {
+		feed.updateLock.Unlock()
+		log.Debug().Msg("Event doesn't match feed filter")
+		return
+	}
+	log.Debug().Msg("Received new event in feed room")
+	change, entryID := feed.pushEvent(log, evt)
+	if change == feedChangeNone {
+		feed.updateLock.Unlock()
+		return
+	}
 	fs.regenerateFeed(feed, log)
+	if fs.ActivityPub != nil {
+		fs.ActivityPub.QueueEntryChange(feed, change, entryID)
+	}
+	feed.updateLock.Unlock()
 
-	if err := fs.purgeCloudflareCache(feed); err != nil {
-		log.Error().Err(err).Msg("Failed to purge Cloudflare cache")
+	if !feed.hidden {
+		if err := fs.purgeCloudflareCache(feed); err != nil {
+			log.Error().Err(err).Msg("Failed to purge Cloudflare cache")
+		}
 	}
+	fs.regenerateAggregates(feed, log)
 }
 
-func (feed *FeedConfig) pushEvent(log zerolog.Logger, evt *event.Event) {
+// feedChange describes how an event changed the entries of a feed.
+type feedChange int
+
+const (
+	feedChangeNone feedChange = iota
+	feedChangeAdd
+	feedChangeUpdate
+	feedChangeRemove
+)
+
+// pushEvent adds the given event to the feed, or applies it to an existing entry if it's an edit,
+// redaction or poll update. It returns the kind of change and the ID of the affected entry.
+func (feed *FeedConfig) pushEvent(log zerolog.Logger, evt *event.Event) (feedChange, id.EventID) {
+	if isPollUpdate(evt.Type) {
+		if pollID := feed.recordPollUpdate(log, evt); pollID != "" {
+			return feedChangeUpdate, pollID
+		}
+		return feedChangeNone, ""
+	} else if evt.Type == event.EventRedaction {
+		return feed.redactEntry(log, evt)
+	}
 	content := evt.Content.AsMessage()
 	if edits := content.RelatesTo.GetReplaceID(); edits != "" {
 		log = log.With().Str("edit_target_event_id", edits.String()).Logger()
+		entryID := edits
 		existingEvt, found := feed.entries.Get(edits)
 		if !found {
+			// Grouped media messages aren't entries themselves, editing them updates the entry they're in
+			var groupIndex int
+			if entryID, groupIndex = feed.findGroupedMedia(edits); entryID != "" {
+				existingEvt, found = feed.groupedMedia[entryID][groupIndex], true
+			}
+		}
+		if !found || existingEvt.Unsigned.RedactedBecause != nil {
 			log.Warn().Msg("Couldn't find edit target event")
-			return
+			return feedChangeNone, ""
 		} else if existingEvt.Sender != evt.Sender {
 			log.Warn().
 				Str("orig_sender", existingEvt.Sender.String()).
 				Msg("Dropping edit of message by different sender")
-			return
+			return feedChangeNone, ""
 		} else {
 			log.Info().
 				Str("original_event_id", existingEvt.ID.String()).
@@ -62,10 +115,53 @@ func (feed *FeedConfig) pushEvent(log zerolog.Logger, evt *event.Event) {
 			existingEvt.Type = evt.Type
 			existingEvt.Mautrix.EditedAt = time.UnixMilli(evt.Timestamp).UTC()
 			existingEvt.Mautrix.LastEditID = evt.ID
+			return feedChangeUpdate, entryID
+		}
+	} else if groupID := feed.tryGroupMedia(log, evt); groupID != "" {
+		return feedChangeUpdate, groupID
+	}
+	feed.entries.Push(evt.ID, evt)
+	feed.pruneGroupedMedia()
+	feed.prunePolls()
+	return feedChangeAdd, evt.ID
+}
+
+// redactEntry marks an entry as redacted, which hides it from the feed. Only the original sender
+// and users with the power to redact other users' messages can remove entries.
+func (feed *FeedConfig) redactEntry(log zerolog.Logger, evt *event.Event) (feedChange, id.EventID) {
+	redacts := evt.Redacts
+	if redacts == "" {
+		// Room v11 moved the redacts key into the content
+		redactsStr, _ := evt.Content.Raw["redacts"].(string)
+		redacts = id.EventID(redactsStr)
+	}
+	existingEvt, found := feed.entries.Get(redacts)
+	entryID, groupIndex := redacts, -1
+	if !found {
+		// Redacting a grouped media message removes it from the entry it's in
+		if entryID, groupIndex = feed.findGroupedMedia(redacts); entryID != "" {
+			existingEvt, found = feed.groupedMedia[entryID][groupIndex], true
 		}
-	} else {
-		feed.entries.Push(evt.ID, evt)
 	}
+	if !found || existingEvt.Unsigned.RedactedBecause != nil {
+		return feedChangeNone, ""
+	} else if existingEvt.Sender != evt.Sender && feed.powers.GetUserLevel(evt.Sender) < feed.powers.Redact() {
+		log.Warn().
+			Str("redacted_event_id", redacts.String()).
+			Msg("Dropping redaction by user without permission to redact other users' messages")
+		return feedChangeNone, ""
+	} else if groupIndex >= 0 {
+		log.Info().
+			Str("redacted_event_id", redacts.String()).
+			Str("group_event_id", entryID.String()).
+			Msg("Removing redacted media from grouped entry")
+		group := feed.groupedMedia[entryID]
+		feed.groupedMedia[entryID] = append(group[:groupIndex:groupIndex], group[groupIndex+1:]...)
+		return feedChangeUpdate, entryID
+	}
+	log.Info().Str("redacted_event_id", redacts.String()).Msg("Removing redacted event from feed")
+	existingEvt.Unsigned.RedactedBecause = evt
+	return feedChangeRemove, redacts
 }
 
 func (fs *FeedServ) regenerateFeed(feed *FeedConfig, log zerolog.Logger) {
@@ -73,36 +169,77 @@ func (fs *FeedServ) regenerateFeed(feed *FeedConfig, log zerolog.Logger) {
 	start := time.Now()
 
 	oldJSONHash := feed.jsonHash
-	var err error
-	feed.json, feed.jsonHash, err = fs.generateJSONFeed(feed)
+	entries := feed.getEntries()
+	if !fs.generateFeedOutput(feed, &feed.feedOutput, feed.id, entries, feed.Language, log) {
+		return
+	}
+	languageOutputs := make(map[string]*feedOutput)
+	for _, lang := range feed.getLanguages(entries) {
+		output, ok := feed.languageOutputs[lang]
+		if !ok {
+			output = &feedOutput{}
+		}
+		langLog := log.With().Str("language", lang).Logger()
+		if fs.generateFeedOutput(feed, output, feed.id+"."+lang, filterEntriesByLanguage(entries, lang), lang, langLog) {
+			languageOutputs[lang] = output
+		}
+	}
+	feed.languageOutputs = languageOutputs
+	// Hidden feeds aren't served, their media is registered by the aggregate feeds that include them
+	if fs.MediaProxy != nil && !feed.hidden {
+		fs.MediaProxy.setFeedMedia(feed, feed.json)
+	}
+
+	feed.lastUpdate = time.Now().UTC()
+	if fs.Exporter != nil {
+		fs.Exporter.MarkChanged(feed)
+	}
+	log.Info().
+		Str("old_json_hash", oldJSONHash).
+		Str("new_json_hash", feed.jsonHash).
+		Int("item_count", len(entries)).
+		Int("language_count", len(languageOutputs)).
+		Dur("duration", time.Since(start)).
+		Msg("Feed updated successfully")
+}
+
+// generateFeedOutput renders the given entries in every format into the output.
+// It returns false if the JSON feed couldn't be generated, in which case the output is left untouched.
+func (fs *FeedServ) generateFeedOutput(feed *FeedConfig, output *feedOutput, feedPath string, entries []feedEntry, language string, log zerolog.Logger) bool {
+	jsonFeed := fs.buildJSONFeed(feed, feedPath, entries, language)
+	jsonData, jsonHash, err := marshalJSONFeed(jsonFeed)
 	if err != nil {
 		log.Err(err).Msg("Failed to generate JSON feed")
-		return
+		return false
 	}
+	output.json, output.jsonHash = jsonData, jsonHash
 
-	gorillaFeed := fs.generateGorillaFeed(feed)
+	gorillaFeed, rssExtensions := fs.generateGorillaFeed(feed, feedPath, entries)
 	var buf bytes.Buffer
-	if err = gorillaFeed.WriteRss(&buf); err != nil {
+	if err = writeRSS(&buf, gorillaFeed, language, rssExtensions); err != nil {
 		log.Err(err).Msg("Failed to generate RSS feed")
 	} else {
-		feed.rss = buf.Bytes()
-		feed.rssHash = fmt.Sprintf(`"%x"`, sha256.Sum256(feed.rss))
+		output.rss = buf.Bytes()
+		output.rssHash = fmt.Sprintf(`"%x"`, sha256.Sum256(output.rss))
+	}
+	entryLanguages := make([]string, len(entries))
+	for i, entry := range entries {
+		entryLanguages[i] = entry.language
 	}
 	buf = bytes.Buffer{}
-	if err = gorillaFeed.WriteAtom(&buf); err != nil {
+	if err = writeAtom(&buf, gorillaFeed, language, entryLanguages); err != nil {
 		log.Err(err).Msg("Failed to generate Atom feed")
 	} else {
-		feed.atom = buf.Bytes()
-		feed.atomHash = fmt.Sprintf(`"%x"`, sha256.Sum256(feed.atom))
+		output.atom = buf.Bytes()
+		output.atomHash = fmt.Sprintf(`"%x"`, sha256.Sum256(output.atom))
 	}
-
-	feed.lastUpdate = time.Now().UTC()
-	log.Info().
-		Str("old_json_hash", oldJSONHash).
-		Str("new_json_hash", feed.jsonHash).
-		Int("item_count", feed.entries.Size()).
-		Dur("duration", time.Since(start)).
-		Msg("Feed updated successfully")
+	if feed.HTML {
+		output.html, output.htmlHash, err = fs.generateHTMLPage(feed, feedPath, jsonFeed)
+		if err != nil {
+			log.Err(err).Msg("Failed to generate HTML page")
+		}
+	}
+	return true
 }
 
 var cloudflareClient = &http.Client{Timeout: time.Second * 10}
@@ -112,16 +249,29 @@ type cloudflarePurgeRequest struct {
 }
 
 func (fs *FeedServ) purgeCloudflareCache(feed *FeedConfig) error {
-	if fs.Config.CloudflareToken == "" {
+	if fs.Config.CloudflareToken == "" || feed.Private || fs.Exporter != nil {
+		// Private feeds are never cached by the CDN, and exported files are published separately
 		return nil
 	}
 
-	data := cloudflarePurgeRequest{[]string{
-		fs.Config.PublicURL + feed.id,
-		fs.Config.PublicURL + feed.id + ".json",
-		fs.Config.PublicURL + feed.id + ".rss",
-		fs.Config.PublicURL + feed.id + ".atom",
-	}}
+	feedPaths := []string{feed.id}
+	feed.updateLock.RLock()
+	for lang := range feed.languageOutputs {
+		feedPaths = append(feedPaths, feed.id+"."+lang)
+	}
+	feed.updateLock.RUnlock()
+	var data cloudflarePurgeRequest
+	for _, feedPath := range feedPaths {
+		data.Files = append(data.Files,
+			fs.Config.PublicURL+feedPath,
+			fs.Config.PublicURL+feedPath+".json",
+			fs.Config.PublicURL+feedPath+".rss",
+			fs.Config.PublicURL+feedPath+".atom",
+		)
+		if feed.HTML {
+			data.Files = append(data.Files, fs.Config.PublicURL+feedPath+".html")
+		}
+	}
 	body, err := json.Marshal(data)
 	if err != nil {
 		return err
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/rs/zerolog"
+
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+	"maunium.net/go/mautrix/util"
+)
+
+func makeTestFeed(feedID string, roomID id.RoomID) *FeedConfig {
+	return &FeedConfig{
+		id:           feedID,
+		RoomID:       roomID,
+		MaxEntries:   10,
+		entries:      util.NewRingBuffer[id.EventID, *event.Event](10),
+		groupedMedia: make(map[id.EventID][]*event.Event),
+		polls:        make(map[id.EventID]*pollState),
+		authors:      make(map[id.UserID]JSONFeedAuthor),
+		powers:       &event.PowerLevelsEventContent{},
+	}
+}
+
+func makeTestMessage(roomID id.RoomID, evtID id.EventID, sender id.UserID, content *event.MessageEventContent) *event.Event {
+	return &event.Event{
+		ID:        evtID,
+		RoomID:    roomID,
+		Type:      event.EventMessage,
+		Sender:    sender,
+		Timestamp: 1700000000000,
+		Content:   event.Content{Parsed: content},
+	}
+}
+
+func TestHandleFeedEventCopiesEventPerFeed(t *testing.T) {
+	log := zerolog.Nop()
+	roomID := id.RoomID("!room:example.com")
+	feedA := makeTestFeed("/a", roomID)
+	feedB := makeTestFeed("/b", roomID)
+	fs := &FeedServ{Log: &log, Config: &Config{
+		PublicURL:     "https://example.com",
+		Feeds:         map[string]*FeedConfig{"/a": feedA, "/b": feedB},
+		feedsByRoomID: map[id.RoomID][]*FeedConfig{roomID: {feedA, feedB}},
+	}}
+	sender := id.UserID("@author:example.com")
+	fs.HandleFeedEvent(0, makeTestMessage(roomID, "$orig", sender, &event.MessageEventContent{MsgType: event.MsgText, Body: "original"}))
+	// Apply the edit to only one feed, like a feed filter would
+	edit := makeTestMessage(roomID, "$edit", sender, &event.MessageEventContent{
+		MsgType:    event.MsgText,
+		Body:       "* edited",
+		NewContent: &event.MessageEventContent{MsgType: event.MsgText, Body: "edited"},
+		RelatesTo:  &event.RelatesTo{Type: event.RelReplace, EventID: "$orig"},
+	})
+	feedA.pushEvent(log, edit)
+
+	evtA, _ := feedA.entries.Get("$orig")
+	evtB, _ := feedB.entries.Get("$orig")
+	if evtA == evtB {
+		t.Fatal("feeds share the same event")
+	} else if body := evtA.Content.AsMessage().Body; body != "edited" {
+		t.Errorf("edit not applied to feed A: %q", body)
+	} else if body = evtB.Content.AsMessage().Body; body != "original" {
+		t.Errorf("edit leaked into feed B: %q", body)
+	}
+}
+
+type roundTripperFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+func TestPurgeCloudflareCacheSkippedInExportMode(t *testing.T) {
+	var purges int
+	origTransport := cloudflareClient.Transport
+	cloudflareClient.Transport = roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		purges++
+		return &http.Response{StatusCode: http.StatusOK, Body: io.NopCloser(strings.NewReader(`{}`))}, nil
+	})
+	defer func() {
+		cloudflareClient.Transport = origTransport
+	}()
+	fs := &FeedServ{Config: &Config{PublicURL: "https://example.com", CloudflareToken: "token", CloudflareZoneID: "zone"}}
+	feed := makeTestFeed("/test", "!room:example.com")
+
+	if err := fs.purgeCloudflareCache(feed); err != nil {
+		t.Fatal(err)
+	} else if purges != 1 {
+		t.Fatalf("expected cache to be purged in server mode, got %d purges", purges)
+	}
+	fs.Exporter = &FeedExporter{}
+	if err := fs.purgeCloudflareCache(feed); err != nil {
+		t.Fatal(err)
+	} else if purges != 1 {
+		t.Errorf("cache was purged in export mode")
+	}
+}
+
+func TestCommandsOnlySwallowedWithTokenManagement(t *testing.T) {
+	log := zerolog.Nop()
+	roomID := id.RoomID("!room:example.com")
+	feed := makeTestFeed("/test", roomID)
+	fs := &FeedServ{Log: &log, Config: &Config{
+		PublicURL:     "https://example.com",
+		Feeds:         map[string]*FeedConfig{"/test": feed},
+		feedsByRoomID: map[id.RoomID][]*FeedConfig{roomID: {feed}},
+	}}
+	sender := id.UserID("@author:example.com")
+	command := &event.MessageEventContent{MsgType: event.MsgText, Body: "!feedserv token list"}
+
+	fs.HandleFeedEvent(0, makeTestMessage(roomID, "$public", sender, command))
+	// Commands from non-admins are ignored without making any requests
+	fs.Client, _ = mautrix.NewClient("https://matrix.example.com", "@feedserv:example.com", "token")
+	fs.Tokens = &FeedTokens{fs: fs, Log: log, store: feedTokenStore{Tokens: make(map[string]*feedToken)}}
+	fs.HandleFeedEvent(0, makeTestMessage(roomID, "$tokens", sender, command))
+	if !feed.entries.Contains("$public") || !feed.entries.Contains("$tokens") {
+		t.Error("command-like message in room without a private feed was dropped")
+	}
+
+	feed.Private = true
+	fs.HandleFeedEvent(0, makeTestMessage(roomID, "$private", sender, command))
+	if feed.entries.Contains("$private") {
+		t.Error("command in room of private feed was added to the feed")
+	}
+	reply := makeTestMessage(roomID, "$reply", "@feedserv:example.com", &event.MessageEventContent{MsgType: event.MsgNotice, Body: "0 tokens"})
+	reply.Content.Raw = map[string]any{commandReplyField: true}
+	fs.HandleFeedEvent(0, reply)
+	if feed.entries.Contains("$reply") {
+		t.Error("command reply was added to the feed")
+	}
+}
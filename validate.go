@@ -0,0 +1,304 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net/mail"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"maunium.net/go/mautrix/appservice"
+	"maunium.net/go/mautrix/id"
+)
+
+// normalize fixes up values that have a single obvious meaning, so that they don't need to be validated:
+// the trailing slash of the public URL is removed, and feed IDs are lowercased like request paths.
+func (cfg *Config) normalize() error {
+	cfg.PublicURL = strings.TrimRight(cfg.PublicURL, "/")
+	normalizedFeeds := make(map[string]*FeedConfig, len(cfg.Feeds))
+	for feedID, feed := range cfg.Feeds {
+		lowerID := strings.ToLower(feedID)
+		if _, exists := normalizedFeeds[lowerID]; exists {
+			return fmt.Errorf("feeds: %s is defined multiple times (feed IDs are case-insensitive)", lowerID)
+		}
+		normalizedFeeds[lowerID] = feed
+		for i, sourceID := range feed.Sources {
+			if !strings.HasPrefix(sourceID, "!") {
+				feed.Sources[i] = strings.ToLower(sourceID)
+			}
+		}
+	}
+	cfg.Feeds = normalizedFeeds
+	return nil
+}
+
+func isHTTPURL(input string) bool {
+	parsed, err := url.Parse(input)
+	return err == nil && (parsed.Scheme == "http" || parsed.Scheme == "https") && parsed.Host != ""
+}
+
+// Validate checks the config for mistakes that would otherwise cause confusing errors later. All problems are returned at once.
+func (cfg *Config) Validate() error {
+	var errs []error
+	addErr := func(format string, args ...any) {
+		errs = append(errs, fmt.Errorf(format, args...))
+	}
+
+	if !isHTTPURL(cfg.HomeserverURL) {
+		addErr("homeserver_url: must be a http(s) URL")
+	}
+	if !isHTTPURL(cfg.MediaURL) {
+		addErr("media_url: must be a http(s) URL")
+	}
+	if !isHTTPURL(cfg.PublicURL) {
+		addErr("public_url: must be a http(s) URL")
+	}
+	switch cfg.LoginType {
+	case LoginTypePassword, "":
+		if cfg.AccessToken == "" && cfg.AppServiceRegistration == "" && (cfg.UserID == "" || cfg.Password == "") {
+			addErr("user_id and password are required unless using access_token or appservice_registration")
+		}
+	case LoginTypeJWT, LoginTypeSSO:
+		if cfg.LoginType == LoginTypeJWT && cfg.LoginToken == "" && cfg.AccessToken == "" {
+			addErr("login_token: required for JWT login")
+		}
+	default:
+		addErr("login_type: must be password, jwt or sso")
+	}
+	if cfg.UserID != "" {
+		if _, _, err := cfg.UserID.Parse(); err != nil {
+			addErr("user_id: %w", err)
+		}
+	}
+	if cfg.ListenAddress == "" {
+		addErr("listen_address: required")
+	}
+	if cfg.MaxConcurrentRequests < 0 {
+		addErr("max_concurrent_requests: must not be negative")
+	}
+	if _, err := parseTrustedProxies(cfg.TrustedProxies); err != nil {
+		addErr("trusted_proxies: %w", err)
+	}
+	if cfg.RateLimit.Enabled && (cfg.RateLimit.Rate <= 0 || cfg.RateLimit.Burst <= 0) {
+		addErr("rate_limit: rate and burst must be positive")
+	}
+	if cfg.TLS.ACME.Enabled && (cfg.TLS.Cert != "" || cfg.TLS.Key != "") {
+		addErr("tls: static certificates and ACME can't be used at the same time")
+	} else if !cfg.TLS.ACME.Enabled && (cfg.TLS.Cert == "") != (cfg.TLS.Key == "") {
+		addErr("tls: both cert and key must be set")
+	}
+	if (cfg.CloudflareToken == "") != (cfg.CloudflareZoneID == "") {
+		addErr("cloudflare_zone_id and cloudflare_token must be set together")
+	}
+	for i, source := range cfg.Ingest {
+		if !isHTTPURL(source.URL) {
+			addErr("ingest[%d].url: must be a http(s) URL", i)
+		}
+		if source.RoomID == "" && source.RoomAlias == "" {
+			addErr("ingest[%d]: room_id or room_alias is required", i)
+		}
+		if source.Backfill < 0 {
+			addErr("ingest[%d].backfill: must not be negative", i)
+		}
+	}
+
+	if len(cfg.Feeds) == 0 {
+		addErr("feeds: at least one feed is required")
+	}
+	feedIDs := make([]string, 0, len(cfg.Feeds))
+	for feedID := range cfg.Feeds {
+		feedIDs = append(feedIDs, feedID)
+	}
+	sort.Strings(feedIDs)
+	hasDigests := false
+	for _, feedID := range feedIDs {
+		feed := cfg.Feeds[feedID]
+		for _, err := range feed.validate(cfg, feedID) {
+			errs = append(errs, fmt.Errorf("feeds.%s: %w", feedID, err))
+		}
+		hasDigests = hasDigests || feed.Digest.Enabled
+	}
+	if hasDigests && (cfg.SMTP.Host == "" || cfg.SMTP.From == "") {
+		addErr("smtp: host and from are required when digests are enabled")
+	}
+	if _, err := mail.ParseAddress(cfg.SMTP.From); cfg.SMTP.From != "" && err != nil {
+		addErr("smtp.from: %q is not a valid email address", cfg.SMTP.From)
+	}
+	return errors.Join(errs...)
+}
+
+// hasPrivateRoomFeed returns true if any private feed is configured with the given room ID.
+func (cfg *Config) hasPrivateRoomFeed(roomID id.RoomID) bool {
+	for _, feed := range cfg.Feeds {
+		if feed.Private && feed.RoomID == roomID {
+			return true
+		}
+	}
+	return false
+}
+
+func (feed *FeedConfig) validate(cfg *Config, feedID string) (errs []error) {
+	addErr := func(format string, args ...any) {
+		errs = append(errs, fmt.Errorf(format, args...))
+	}
+	if !strings.HasPrefix(feedID, "/") || strings.HasPrefix(feedID, "/_feedserv/") {
+		addErr("feed ID must start with / and must not be under /_feedserv/")
+	}
+	switch feedID {
+	case "/", "/index.json", "/feeds.opml":
+		addErr("feed ID conflicts with a built-in endpoint")
+	}
+	switch ext := path.Ext(feedID); ext {
+	case ".json", ".rss", ".atom", ".html":
+		addErr("feed ID must not end with a feed format extension")
+	default:
+		// Language sub-feeds are served at the feed ID plus a language code extension
+		if len(ext) > 1 && languageCodeRegex.MatchString(ext[1:]) && cfg.Feeds[feedID[:len(feedID)-len(ext)]] != nil {
+			addErr("feed ID conflicts with the %s language feed of %s", ext[1:], feedID[:len(feedID)-len(ext)])
+		}
+	}
+	if feed.MaxEntries <= 0 {
+		addErr("max_entries: must be positive")
+	}
+	if feed.IsAggregate() {
+		if feed.RoomID != "" || feed.RoomAlias != "" {
+			addErr("aggregate feeds can't have a room")
+		}
+		if feed.MemberAccess {
+			addErr("member_access: can't be used with aggregate feeds")
+		}
+		if feed.ExpireWhenStale {
+			addErr("expire_when_stale: can't be used with aggregate feeds")
+		}
+		for _, sourceID := range feed.Sources {
+			if strings.HasPrefix(sourceID, "!") {
+				if !feed.Private && cfg.hasPrivateRoomFeed(id.RoomID(sourceID)) {
+					addErr("sources: room %s has a private feed, so it can't be included in a public aggregate feed", sourceID)
+				}
+				continue
+			}
+			source, ok := cfg.Feeds[sourceID]
+			if !ok {
+				addErr("sources: feed %s not found", sourceID)
+			} else if source.IsAggregate() {
+				addErr("sources: %s is an aggregate feed, which can't be included in other aggregate feeds", sourceID)
+			} else if source.Private && !feed.Private {
+				addErr("sources: %s is private, so it can't be included in a public aggregate feed", sourceID)
+			}
+		}
+	} else {
+		if feed.RoomID == "" && feed.RoomAlias == "" {
+			addErr("room_id or room_alias is required")
+		}
+		if feed.RoomID != "" && !strings.HasPrefix(feed.RoomID.String(), "!") {
+			addErr("room_id: must start with !")
+		}
+		if feed.RoomAlias != "" && !strings.HasPrefix(feed.RoomAlias.String(), "#") {
+			addErr("room_alias: must start with #")
+		}
+	}
+	if feed.MemberAccess && !feed.Private {
+		addErr("member_access: requires private to be enabled")
+	}
+	if feed.Language != "" && !languageCodeRegex.MatchString(strings.ToLower(feed.Language)) {
+		addErr("language: %q is not a valid language code", feed.Language)
+	}
+	for _, lang := range feed.Languages {
+		if !languageCodeRegex.MatchString(strings.ToLower(lang)) {
+			addErr("languages: %q is not a valid language code", lang)
+		}
+	}
+	if feed.Homepage != "" && !isHTTPURL(feed.Homepage) {
+		addErr("homepage: must be a http(s) URL")
+	}
+	if feed.Icon != "" {
+		if _, err := feed.Icon.Parse(); err != nil {
+			addErr("icon: must be a mxc:// URI")
+		}
+	}
+	if feed.GroupMedia.Enabled && feed.GroupMedia.Window < 0 {
+		addErr("group_media.window: must not be negative")
+	}
+	if feed.Podcast.Enabled && feed.Podcast.Type != "" && feed.Podcast.Type != "episodic" && feed.Podcast.Type != "serial" {
+		addErr("podcast.type: must be episodic or serial")
+	}
+	if feed.Digest.Enabled {
+		switch feed.Digest.Schedule {
+		case "", "daily", "weekly":
+		default:
+			addErr("digest.schedule: must be daily or weekly")
+		}
+		if _, ok := weekdays[strings.ToLower(feed.Digest.Weekday)]; feed.Digest.Weekday != "" && !ok {
+			addErr("digest.weekday: %q is not a weekday", feed.Digest.Weekday)
+		}
+		if _, err := time.Parse("15:04", feed.Digest.Time); feed.Digest.Time != "" && err != nil {
+			addErr("digest.time: must be in HH:MM format")
+		}
+		if _, err := time.LoadLocation(feed.Digest.Timezone); feed.Digest.Timezone != "" && err != nil {
+			addErr("digest.timezone: %w", err)
+		}
+		if len(feed.Digest.Recipients) == 0 {
+			addErr("digest.recipients: at least one recipient is required")
+		}
+		for _, recipient := range feed.Digest.Recipients {
+			if _, err := mail.ParseAddress(recipient); err != nil {
+				addErr("digest.recipients: %q is not a valid email address", recipient)
+			}
+		}
+	}
+	return
+}
+
+// checkFiles loads the templates and other files referenced in the config, which is otherwise only done while
+// starting up. Files that are created automatically when missing, like the ActivityPub key, aren't checked.
+func (fs *FeedServ) checkFiles() error {
+	cfg := fs.Config
+	var errs []error
+	addErr := func(format string, args ...any) {
+		errs = append(errs, fmt.Errorf(format, args...))
+	}
+
+	if cfg.AppServiceRegistration != "" {
+		if _, err := appservice.LoadRegistration(cfg.AppServiceRegistration); err != nil {
+			addErr("appservice_registration: %w", err)
+		}
+	}
+	if cfg.TLS.Cert != "" && cfg.TLS.Key != "" {
+		if _, err := tls.LoadX509KeyPair(cfg.TLS.Cert, cfg.TLS.Key); err != nil {
+			addErr("tls: %w", err)
+		}
+	}
+	if cfg.TLS.ACME.DirectoryCA != "" {
+		if _, err := os.Stat(cfg.TLS.ACME.DirectoryCA); err != nil {
+			addErr("tls.acme.directory_ca: %w", err)
+		}
+	}
+	feedIDs := make([]string, 0, len(cfg.Feeds))
+	for feedID := range cfg.Feeds {
+		feedIDs = append(feedIDs, feedID)
+	}
+	sort.Strings(feedIDs)
+	for _, feedID := range feedIDs {
+		feed := cfg.Feeds[feedID]
+		if feed.HTML {
+			templatePath := feed.HTMLTemplate
+			if templatePath == "" {
+				templatePath = cfg.HTMLTemplate
+			}
+			if _, err := fs.loadHTMLTemplate(templatePath); err != nil {
+				addErr("feeds.%s.html_template: %w", feedID, err)
+			}
+		}
+		if feed.Digest.Enabled {
+			if err := feed.Digest.prepare(fs); err != nil {
+				addErr("feeds.%s.digest: %w", feedID, err)
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
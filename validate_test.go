@@ -0,0 +1,164 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func makeValidTestConfig() *Config {
+	return &Config{
+		HomeserverURL: "https://matrix.example.com",
+		MediaURL:      "https://matrix.example.com",
+		PublicURL:     "https://feeds.example.com",
+		UserID:        "@feedserv:example.com",
+		Password:      "hunter2",
+		ListenAddress: ":8080",
+		Feeds: map[string]*FeedConfig{
+			"/news":   {RoomID: "!news:example.com", MaxEntries: 20},
+			"/secret": {RoomAlias: "#secret:example.com", MaxEntries: 20, Private: true},
+			"/all":    {Sources: []string{"/news", "!hidden:example.com"}, MaxEntries: 50},
+		},
+	}
+}
+
+func TestValidate(t *testing.T) {
+	if err := makeValidTestConfig().Validate(); err != nil {
+		t.Fatalf("valid config was rejected: %v", err)
+	}
+	tests := []struct {
+		name     string
+		modify   func(cfg *Config)
+		expected []string
+	}{
+		{"invalid URLs", func(cfg *Config) {
+			cfg.HomeserverURL = "matrix.example.com"
+			cfg.PublicURL = ""
+		}, []string{"homeserver_url: must be a http(s) URL", "public_url: must be a http(s) URL"}},
+		{"missing login", func(cfg *Config) {
+			cfg.Password = ""
+		}, []string{"user_id and password are required"}},
+		{"unknown login type", func(cfg *Config) {
+			cfg.LoginType = "magic"
+		}, []string{"login_type: must be password, jwt or sso"}},
+		{"half of TLS", func(cfg *Config) {
+			cfg.TLS.Cert = "cert.pem"
+		}, []string{"tls: both cert and key must be set"}},
+		{"no feeds", func(cfg *Config) {
+			cfg.Feeds = nil
+		}, []string{"feeds: at least one feed is required"}},
+		{"reserved feed ID", func(cfg *Config) {
+			cfg.Feeds["/_feedserv/health"] = &FeedConfig{RoomID: "!room:example.com", MaxEntries: 1}
+		}, []string{"feeds./_feedserv/health: feed ID must start with / and must not be under /_feedserv/"}},
+		{"feed format extension in feed ID", func(cfg *Config) {
+			cfg.Feeds["/news.rss"] = &FeedConfig{RoomID: "!room:example.com", MaxEntries: 1}
+		}, []string{"feeds./news.rss: feed ID must not end with a feed format extension"}},
+		{"language feed shadowed by feed ID", func(cfg *Config) {
+			cfg.Feeds["/news.de"] = &FeedConfig{RoomID: "!room:example.com", MaxEntries: 1}
+			cfg.Feeds["/blog.v2"] = &FeedConfig{RoomID: "!room:example.com", MaxEntries: 1}
+		}, []string{"feeds./news.de: feed ID conflicts with the de language feed of /news"}},
+		{"private source in public aggregate", func(cfg *Config) {
+			cfg.Feeds["/all"].Sources = append(cfg.Feeds["/all"].Sources, "/secret")
+		}, []string{"feeds./all: sources: /secret is private"}},
+		{"private room source in public aggregate", func(cfg *Config) {
+			cfg.Feeds["/secret"].RoomID = "!hidden:example.com"
+		}, []string{"feeds./all: sources: room !hidden:example.com has a private feed"}},
+		{"nested aggregate", func(cfg *Config) {
+			cfg.Feeds["/everything"] = &FeedConfig{Sources: []string{"/all"}, MaxEntries: 1}
+		}, []string{"feeds./everything: sources: /all is an aggregate feed"}},
+		{"feed errors", func(cfg *Config) {
+			feed := cfg.Feeds["/news"]
+			feed.MaxEntries = 0
+			feed.RoomID = "news"
+			feed.Language = "not a language"
+			feed.MemberAccess = true
+		}, []string{
+			"feeds./news: max_entries: must be positive",
+			"feeds./news: room_id: must start with !",
+			"feeds./news: member_access: requires private to be enabled",
+			`feeds./news: language: "not a language" is not a valid language code`,
+		}},
+		{"digest without SMTP", func(cfg *Config) {
+			cfg.Feeds["/news"].Digest = DigestConfig{Enabled: true, Schedule: "monthly", Recipients: []string{"user@example.com"}}
+		}, []string{"feeds./news: digest.schedule: must be daily or weekly", "smtp: host and from are required"}},
+		{"invalid email addresses", func(cfg *Config) {
+			cfg.SMTP = SMTPConfig{Host: "smtp.example.com", From: "Feedserv <feedserv.example.com>"}
+			cfg.Feeds["/news"].Digest = DigestConfig{Enabled: true, Schedule: "daily", Recipients: []string{"User <user@example.com>", "user.example.com"}}
+		}, []string{`smtp.from: "Feedserv <feedserv.example.com>" is not a valid email address`, `feeds./news: digest.recipients: "user.example.com" is not a valid email address`}},
+		{"stale expiry in aggregate", func(cfg *Config) {
+			cfg.Feeds["/all"].ExpireWhenStale = true
+		}, []string{"feeds./all: expire_when_stale: can't be used with aggregate feeds"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			cfg := makeValidTestConfig()
+			test.modify(cfg)
+			err := cfg.Validate()
+			if err == nil {
+				t.Fatal("invalid config was accepted")
+			}
+			for _, expected := range test.expected {
+				if !strings.Contains(err.Error(), expected) {
+					t.Errorf("error doesn't contain %q:\n%v", expected, err)
+				}
+			}
+			if lines := strings.Count(err.Error(), "\n") + 1; lines != len(test.expected) {
+				t.Errorf("expected %d errors, got %d:\n%v", len(test.expected), lines, err)
+			}
+		})
+	}
+}
+
+func TestNormalize(t *testing.T) {
+	cfg := makeValidTestConfig()
+	cfg.PublicURL = "https://feeds.example.com/"
+	cfg.Feeds["/News"] = cfg.Feeds["/news"]
+	delete(cfg.Feeds, "/news")
+	cfg.Feeds["/all"].Sources = []string{"/NEWS", "!Hidden:example.com"}
+	if err := cfg.normalize(); err != nil {
+		t.Fatal(err)
+	} else if cfg.PublicURL != "https://feeds.example.com" {
+		t.Errorf("trailing slash wasn't removed from %q", cfg.PublicURL)
+	} else if _, ok := cfg.Feeds["/news"]; !ok {
+		t.Error("feed ID wasn't lowercased")
+	} else if strings.Join(cfg.Feeds["/all"].Sources, " ") != "/news !Hidden:example.com" {
+		t.Errorf("unexpected sources %v", cfg.Feeds["/all"].Sources)
+	} else if err = cfg.Validate(); err != nil {
+		t.Errorf("normalized config is invalid: %v", err)
+	}
+
+	cfg.Feeds["/NEWS"] = &FeedConfig{RoomID: "!other:example.com", MaxEntries: 1}
+	if err := cfg.normalize(); err == nil {
+		t.Error("feed IDs differing only in case were accepted")
+	}
+}
+
+func TestCheckFiles(t *testing.T) {
+	dir := t.TempDir()
+	cfg := makeValidTestConfig()
+	cfg.Feeds["/news"].HTML = true
+	cfg.Feeds["/news"].HTMLTemplate = filepath.Join(dir, "broken.html")
+	cfg.Feeds["/secret"].Digest = DigestConfig{Enabled: true, Recipients: []string{"user@example.com"}, TextTemplate: filepath.Join(dir, "missing.txt")}
+	cfg.TLS.Cert, cfg.TLS.Key = filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	if err := os.WriteFile(cfg.Feeds["/news"].HTMLTemplate, []byte("{{ .Unclosed"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	err := (&FeedServ{Config: cfg}).checkFiles()
+	if err == nil {
+		t.Fatal("missing and broken files were accepted")
+	}
+	for _, expected := range []string{"tls: ", "feeds./news.html_template: ", "feeds./secret.digest: "} {
+		if !strings.Contains(err.Error(), expected) {
+			t.Errorf("error doesn't contain %q:\n%v", expected, err)
+		}
+	}
+
+	writeTestCert(t, cfg.TLS.Cert, cfg.TLS.Key, "feeds.example.com", time.Now())
+	cfg.Feeds["/news"].HTMLTemplate = ""
+	cfg.Feeds["/secret"].Digest.TextTemplate = ""
+	if err = (&FeedServ{Config: cfg}).checkFiles(); err != nil {
+		t.Errorf("valid files were rejected: %v", err)
+	}
+}